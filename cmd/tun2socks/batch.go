@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+
+	"github.com/ruilisi/go-tun2socks/core"
+)
+
+// Maximum number of packets input to the stack at once.
+const maxBatchSize = 64
+
+type readResult struct {
+	buf *core.InputBuffer
+	n   int
+	err error
+}
+
+// batchReader reads packets from TUN in its own goroutine, packets piling up
+// while the stack is busy are returned as a single batch.
+type batchReader struct {
+	results chan readResult
+	free    chan *core.InputBuffer
+
+	bufs  []*core.InputBuffer
+	sizes []int
+	err   error
+}
+
+func newBatchReader(r io.Reader) *batchReader {
+	br := &batchReader{
+		results: make(chan readResult, maxBatchSize),
+		free:    make(chan *core.InputBuffer, 2*maxBatchSize),
+		bufs:    make([]*core.InputBuffer, 0, maxBatchSize),
+		sizes:   make([]int, 0, maxBatchSize),
+	}
+	for i := 0; i < cap(br.free); i++ {
+		br.free <- core.NewInputBuffer()
+	}
+	go br.readLoop(r)
+	return br
+}
+
+func (br *batchReader) readLoop(r io.Reader) {
+	for buf := range br.free {
+		n, err := r.Read(buf.Bytes())
+		br.results <- readResult{buf: buf, n: n, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadBatch blocks until at least one packet is read and returns all
+// packets read so far, the buffers must be passed to Recycle once the
+// packets are input. A read error is returned after the packets read
+// before it.
+func (br *batchReader) ReadBatch() ([]*core.InputBuffer, []int, error) {
+	if br.err != nil {
+		return nil, nil, br.err
+	}
+	br.bufs, br.sizes = br.bufs[:0], br.sizes[:0]
+	res := <-br.results
+	for {
+		if res.err != nil {
+			br.err = res.err
+			break
+		}
+		br.bufs = append(br.bufs, res.buf)
+		br.sizes = append(br.sizes, res.n)
+		if len(br.bufs) == maxBatchSize {
+			break
+		}
+		select {
+		case res = <-br.results:
+			continue
+		default:
+		}
+		break
+	}
+	if len(br.bufs) == 0 {
+		return nil, nil, br.err
+	}
+	return br.bufs, br.sizes, nil
+}
+
+// Recycle hands the buffers of a batch back to the reader.
+func (br *batchReader) Recycle(bufs []*core.InputBuffer) {
+	for _, buf := range bufs {
+		br.free <- buf
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ruilisi/go-tun2socks/core"
+)
+
+// captureHandler reports whether capture is running, a POST with the
+// enable parameter starts or stops it and one with the filter parameter
+// replaces its filter expression.
+func captureHandler(capture *core.Capture) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if r.Form.Has("filter") {
+				if err := capture.SetFilter(r.Form.Get("filter")); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if r.Form.Has("enable") {
+				enable, err := strconv.ParseBool(r.Form.Get("enable"))
+				if err != nil {
+					http.Error(w, "invalid enable parameter", http.StatusBadRequest)
+					return
+				}
+				if enable {
+					err = capture.Start()
+				} else {
+					err = capture.Stop()
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "running: %v\n", capture.Running())
+	})
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/ruilisi/go-tun2socks/common/log"
 	_ "github.com/ruilisi/go-tun2socks/common/log/simple" // Register a simple logger.
 	"github.com/ruilisi/go-tun2socks/core"
+	"github.com/ruilisi/go-tun2socks/proxy/icmp"
 	"github.com/ruilisi/go-tun2socks/tun"
 )
 
@@ -40,12 +41,34 @@ type CmdArgs struct {
 	TunMask         *string
 	TunDns          *string
 	TunPersist      *bool
+	TunMTU          *int
+	TunOffload      *bool
+	TunQueues       *int
 	BlockOutsideDns *bool
 	ProxyType       *string
 	ProxyServer     *string
 	ProxyHost       *string
 	ProxyPort       *uint16
 	UdpTimeout      *time.Duration
+	UDPIdleTimeout  *time.Duration
+	DialTimeout     *time.Duration
+	MetricsAddr     *string
+	ICMPMode        *string
+	UDPNATMode      *string
+	ConnectFirst    *bool
+	MaxTCPSessions  *int
+	MaxUDPSessions  *int
+	MaxPerSource    *int
+	ConnRate        *float64
+	ConnBurst       *int
+	CapturePath     *string
+	CaptureFilter   *string
+	CaptureMaxSize  *int64
+	CaptureFiles    *int
+	CaptureStart    *bool
+	ReplayPath      *string
+	ReplaySpeed     *float64
+	ReplayClient    *string
 	LogLevel        *string
 	DnsFallback     *bool
 }
@@ -80,8 +103,6 @@ func (a *CmdArgs) addFlag(f cmdFlag) {
 
 var args = new(CmdArgs)
 
-var lwipWriter io.Writer
-
 func main() {
 	args.Version = flag.Bool("version", false, "Print version")
 	args.TunName = flag.String("tunName", "tun1", "TUN interface name")
@@ -89,9 +110,31 @@ func main() {
 	args.TunGw = flag.String("tunGw", "10.255.0.1", "TUN interface gateway")
 	args.TunMask = flag.String("tunMask", "255.255.255.0", "TUN interface netmask, it should be a prefixlen (a number) for IPv6 address")
 	args.TunDns = flag.String("tunDns", "8.8.8.8,8.8.4.4", "DNS resolvers for TUN interface (only need on Windows)")
+	args.TunMTU = flag.Int("tunMtu", core.MTU, "MTU of the TUN interface, from 1280 to 65535, it should match the MTU configured on the interface")
+	args.TunOffload = flag.Bool("tunOffload", false, "Open the TUN interface with TCP segmentation and checksum offload (Linux only)")
+	args.TunQueues = flag.Int("tunQueues", 1, "Number of queues of the TUN interface, each read by its own goroutine (Linux only)")
 	args.TunPersist = flag.Bool("tunPersist", false, "Persist TUN interface after the program exits or the last open file descriptor is closed (Linux only)")
 	args.BlockOutsideDns = flag.Bool("blockOutsideDns", false, "Prevent DNS leaks by blocking plaintext DNS queries going out through non-TUN interface (may require admin privileges) (Windows only) ")
 	args.ProxyType = flag.String("proxyType", "socks", "Proxy handler type")
+	args.DialTimeout = flag.Duration("dialTimeout", 0, "Maximum time for proxy handlers to connect the remote host, 0 means no limit")
+	args.ICMPMode = flag.String("icmpMode", "", "How to handle ICMP echo requests: forward (unprivileged ICMP sockets, Linux only) or fake (reply immediately), empty to let the TCP/IP stack reply")
+	args.UDPIdleTimeout = flag.Duration("udpIdleTimeout", core.DefaultUDPIdleTimeout, "Close UDP sessions without traffic in either direction for this long, 0 means no limit, DNS and NTP sessions expire sooner")
+	args.UDPNATMode = flag.String("udpNatMode", "full-cone", "How UDP datagrams are grouped into proxy sessions and which replies are let through: full-cone, port-restricted or symmetric")
+	args.ConnectFirst = flag.Bool("connectBeforeAccept", false, "Answer TCP connection attempts only once the proxy handler connected the remote host, failures are reported with a RST or ICMP unreachable")
+	args.MaxTCPSessions = flag.Int("maxTcpSessions", 0, "Maximum number of concurrent TCP connections, 0 means no limit")
+	args.MaxUDPSessions = flag.Int("maxUdpSessions", 0, "Maximum number of concurrent UDP sessions, 0 means no limit")
+	args.MaxPerSource = flag.Int("maxSessionsPerSource", 0, "Maximum number of concurrent TCP and UDP sessions of a source address, 0 means no limit")
+	args.ConnRate = flag.Float64("connRate", 0, "Maximum rate of new TCP connections and UDP sessions per second and source address, 0 means no limit")
+	args.ConnBurst = flag.Int("connBurst", 32, "Number of sessions a source address may open at once when -connRate is set")
+	args.CapturePath = flag.String("capture", "", "Capture packets to this pcapng file, capturing is toggled on the metrics address at /debug/capture, -captureStart is required without -metricsAddr")
+	args.CaptureFilter = flag.String("captureFilter", "", "Select captured packets with a tcpdump-like expression, e.g. \"host 1.1.1.1 and tcp port 443\"")
+	args.CaptureMaxSize = flag.Int64("captureMaxSize", 0, "Rotate the capture file once it grows beyond this many bytes, 0 means no rotation")
+	args.CaptureFiles = flag.Int("captureFiles", 1, "Number of rotated capture files kept")
+	args.CaptureStart = flag.Bool("captureStart", false, "Start capturing packets on startup")
+	args.ReplayPath = flag.String("replay", "", "Replay the client packets of this pcap or pcapng capture instead of reading the TUN interface")
+	args.ReplaySpeed = flag.Float64("replaySpeed", 1, "Pace of the replay relative to the capture, 0 replays packets as fast as possible")
+	args.ReplayClient = flag.String("replayClient", "", "Replay the packets whose source address is in this CIDR, by default those the capture records as inbound, required for captures recording no direction")
+	args.MetricsAddr = flag.String("metricsAddr", "", "Serve metrics in Prometheus format on this address, e.g. 127.0.0.1:9100, empty to disable")
 	args.LogLevel = flag.String("loglevel", "info", "Logging level. (debug, info, warn, error, none)")
 
 	flag.Parse()
@@ -124,11 +167,44 @@ func main() {
 		panic("unsupport logging level")
 	}
 
-	// Open the tun device.
+	// Without the metrics address a capture could not be started later.
+	if *args.CapturePath != "" && !*args.CaptureStart && !metricsEnabled() {
+		log.Fatalf("-capture requires -captureStart or -metricsAddr to start capturing")
+	}
+
+	// Open the tun device, every queue of it is read on its own, or the
+	// capture replayed in its place.
 	dnsServers := strings.Split(*args.TunDns, ",")
-	tunDev, err := tun.OpenTunDevice(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, *args.TunPersist)
-	if err != nil {
-		log.Fatalf("failed to open tun device: %v", err)
+	var tunDev io.Writer
+	var tunQueues []io.Reader
+	if *args.ReplayPath != "" {
+		replayer, err := openReplay(*args.ReplayPath, *args.ReplaySpeed, *args.ReplayClient)
+		if err != nil {
+			log.Fatalf("failed to open capture: %v", err)
+		}
+		// The replies of the stack are not kept, -capture records them.
+		tunDev = io.Discard
+		tunQueues = []io.Reader{replayer}
+	} else if *args.TunQueues > 1 {
+		mq, err := tun.OpenTunDeviceMultiQueue(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, *args.TunPersist, *args.TunQueues, *args.TunOffload)
+		if err != nil {
+			log.Fatalf("failed to open tun device: %v", err)
+		}
+		tunDev = mq
+		for _, q := range mq.Queues {
+			tunQueues = append(tunQueues, q)
+		}
+	} else {
+		openTunDevice := tun.OpenTunDevice
+		if *args.TunOffload {
+			openTunDevice = tun.OpenTunDeviceWithOffload
+		}
+		dev, err := openTunDevice(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, *args.TunPersist)
+		if err != nil {
+			log.Fatalf("failed to open tun device: %v", err)
+		}
+		tunDev = dev
+		tunQueues = []io.Reader{dev}
 	}
 
 	if runtime.GOOS == "windows" && *args.BlockOutsideDns {
@@ -138,7 +214,46 @@ func main() {
 	}
 
 	// Setup TCP/IP stack.
-	lwipWriter := core.NewLWIPStack(true, true).(io.Writer)
+	natMode, err := core.ParseUDPNATMode(*args.UDPNATMode)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	stackOpts := []core.StackOption{core.WithMTU(*args.TunMTU), core.WithDialTimeout(*args.DialTimeout), core.WithUDPNATMode(natMode), core.WithUDPIdleTimeout(*args.UDPIdleTimeout)}
+	if *args.ConnectFirst {
+		stackOpts = append(stackOpts, core.WithConnectBeforeAccept())
+	}
+	stackOpts = append(stackOpts,
+		core.WithMaxTCPSessions(*args.MaxTCPSessions),
+		core.WithMaxUDPSessions(*args.MaxUDPSessions),
+		core.WithMaxSessionsPerSource(*args.MaxPerSource),
+		core.WithConnRateLimit(*args.ConnRate, *args.ConnBurst),
+	)
+	var capture *core.Capture
+	if *args.CapturePath != "" {
+		capture, err = core.NewCapture(core.CaptureConfig{
+			Path:     *args.CapturePath,
+			MaxSize:  *args.CaptureMaxSize,
+			MaxFiles: *args.CaptureFiles,
+			Filter:   *args.CaptureFilter,
+		})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if *args.CaptureStart {
+			if err := capture.Start(); err != nil {
+				log.Fatalf("failed to start capture: %v", err)
+			}
+		}
+		stackOpts = append(stackOpts, core.WithPacketFilter(capture))
+	}
+	lwipStack, err := core.NewLWIPStackWithOptions(true, true, stackOpts...)
+	if err != nil {
+		log.Fatalf("failed to setup TCP/IP stack: %v", err)
+	}
+
+	if metricsEnabled() {
+		serveMetrics(*args.MetricsAddr, lwipStack, tunQueues, capture)
+	}
 
 	// Register TCP and UDP handlers to handle accepted connections.
 	if creater, found := handlerCreater[*args.ProxyType]; found {
@@ -156,23 +271,53 @@ func main() {
 		}
 	}
 
+	switch *args.ICMPMode {
+	case "":
+	case "forward":
+		core.RegisterICMPHandler(icmp.NewHandler(5 * time.Second))
+	case "fake":
+		core.RegisterICMPHandler(icmp.NewFakeHandler())
+	default:
+		log.Fatalf("unsupported ICMP mode")
+	}
+
 	// Register an output callback to write packets output from lwip stack to tun
 	// device, output function should be set before input any packets.
 	core.RegisterOutputFn(func(data []byte) (int, error) {
 		return tunDev.Write(data)
 	})
+	if bw, ok := tunDev.(tun.BatchWriter); ok {
+		core.RegisterOutputBatchFn(bw.WriteBatch)
+	}
 
-	// Copy packets from tun device to lwip stack, it's the main loop.
-	go func() {
-		_, err := io.CopyBuffer(lwipWriter, tunDev, make([]byte, core.MTU))
-		if err != nil {
-			log.Fatalf("copying data failed: %v", err)
-		}
-	}()
+	// Read packets from every queue of tun device straight into buffers
+	// handed to lwip stack in batches, it's the main loop.
+	for _, q := range tunQueues {
+		go func(q io.Reader) {
+			br := newBatchReader(q)
+			for {
+				bufs, sizes, err := br.ReadBatch()
+				if err == io.EOF && *args.ReplayPath != "" {
+					log.Infof("Replay finished")
+					return
+				}
+				if err != nil {
+					log.Fatalf("reading tun device failed: %v", err)
+				}
+				lwipStack.WriteBufferBatch(bufs, sizes)
+				br.Recycle(bufs)
+			}
+		}(q)
+	}
 
 	log.Infof("Running tun2socks")
 
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
 	<-osSignals
+
+	if capture != nil {
+		// Flush the packets captured last.
+		capture.Stop()
+	}
 }
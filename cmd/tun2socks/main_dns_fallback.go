@@ -5,7 +5,6 @@ package main
 import (
 	"flag"
 
-	"github.com/ruilisi/go-tun2socks/core"
 	"github.com/ruilisi/go-tun2socks/proxy/dnsfallback"
 )
 
@@ -13,6 +12,6 @@ func init() {
 	args.DnsFallback = flag.Bool("dnsFallback", false, "Enable DNS fallback over TCP (overrides the UDP proxy handler).")
 
 	registerHandlerCreater("dnsfallback", func() {
-		core.RegisterUDPConnHandler(dnsfallback.NewUDPHandler())
+		registerUDPConnHandler("dnsfallback", dnsfallback.NewUDPHandler())
 	})
 }
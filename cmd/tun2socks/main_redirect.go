@@ -3,7 +3,6 @@
 package main
 
 import (
-	"github.com/ruilisi/go-tun2socks/core"
 	"github.com/ruilisi/go-tun2socks/proxy/redirect"
 )
 
@@ -12,7 +11,7 @@ func init() {
 	args.addFlag(fUdpTimeout)
 
 	registerHandlerCreater("redirect", func() {
-		core.RegisterTCPConnHandler(redirect.NewTCPHandler(*args.ProxyServer))
-		core.RegisterUDPConnHandler(redirect.NewUDPHandler(*args.ProxyServer, *args.UdpTimeout))
+		registerTCPConnHandler("redirect", redirect.NewTCPHandler(*args.ProxyServer))
+		registerUDPConnHandler("redirect", redirect.NewUDPHandler(*args.ProxyServer, *args.UdpTimeout))
 	})
 }
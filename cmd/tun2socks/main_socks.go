@@ -6,7 +6,6 @@ import (
 	"net"
 
 	"github.com/ruilisi/go-tun2socks/common/log"
-	"github.com/ruilisi/go-tun2socks/core"
 	"github.com/ruilisi/go-tun2socks/proxy/socks"
 )
 
@@ -23,7 +22,7 @@ func init() {
 		proxyHost := proxyAddr.IP.String()
 		proxyPort := uint16(proxyAddr.Port)
 
-		core.RegisterTCPConnHandler(socks.NewTCPHandler(proxyHost, proxyPort))
-		core.RegisterUDPConnHandler(socks.NewUDPHandler(proxyHost, proxyPort, *args.UdpTimeout))
+		registerTCPConnHandler("socks", socks.NewTCPHandler(proxyHost, proxyPort))
+		registerUDPConnHandler("socks", socks.NewUDPHandler(proxyHost, proxyPort, *args.UdpTimeout))
 	})
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ruilisi/go-tun2socks/common/log"
+	"github.com/ruilisi/go-tun2socks/common/metrics"
+	"github.com/ruilisi/go-tun2socks/core"
+	"github.com/ruilisi/go-tun2socks/tun"
+)
+
+// handlerMetrics records the dial outcome of a proxy handler.
+type handlerMetrics struct {
+	handler string
+	network string
+
+	dialFailures metrics.Counter
+	dialDuration *metrics.Histogram
+}
+
+func (m *handlerMetrics) observe(start time.Time, err error) {
+	m.dialDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.dialFailures.Inc()
+	}
+}
+
+var (
+	handlerMetricsMu   sync.Mutex
+	handlerMetricsList []*handlerMetrics
+)
+
+func newHandlerMetrics(handler, network string) *handlerMetrics {
+	m := &handlerMetrics{
+		handler:      handler,
+		network:      network,
+		dialDuration: metrics.NewHistogram(),
+	}
+	handlerMetricsMu.Lock()
+	handlerMetricsList = append(handlerMetricsList, m)
+	handlerMetricsMu.Unlock()
+	return m
+}
+
+func metricsEnabled() bool {
+	return args.MetricsAddr != nil && *args.MetricsAddr != ""
+}
+
+// registerTCPConnHandler registers h under name, it is instrumented if the
+// metrics listener is enabled.
+func registerTCPConnHandler(name string, h core.TCPConnHandler) {
+	if metricsEnabled() {
+		m := &tcpHandlerMetrics{h, newHandlerMetrics(name, "tcp")}
+		if _, ok := h.(core.TCPConnDialer); ok {
+			h = &tcpDialerMetrics{m}
+		} else {
+			h = m
+		}
+	}
+	core.RegisterTCPConnHandler(h)
+}
+
+// registerUDPConnHandler registers h under name, it is instrumented if the
+// metrics listener is enabled.
+func registerUDPConnHandler(name string, h core.UDPConnHandler) {
+	if metricsEnabled() {
+		h = &udpHandlerMetrics{h, newHandlerMetrics(name, "udp")}
+	}
+	core.RegisterUDPConnHandler(h)
+}
+
+type tcpHandlerMetrics struct {
+	core.TCPConnHandler
+	m *handlerMetrics
+}
+
+func (h *tcpHandlerMetrics) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return h.HandleContext(context.Background(), conn, target)
+}
+
+func (h *tcpHandlerMetrics) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	start := time.Now()
+	var err error
+	if ch, ok := h.TCPConnHandler.(core.TCPConnContextHandler); ok {
+		err = ch.HandleContext(ctx, conn, target)
+	} else {
+		err = h.TCPConnHandler.Handle(conn, target)
+	}
+	h.m.observe(start, err)
+	return err
+}
+
+// tcpDialerMetrics instruments a handler implementing core.TCPConnDialer,
+// the dial is timed in DialContext when the stack connects before accept.
+type tcpDialerMetrics struct {
+	*tcpHandlerMetrics
+}
+
+func (h *tcpDialerMetrics) DialContext(ctx context.Context, target *net.TCPAddr) (net.Conn, error) {
+	start := time.Now()
+	c, err := h.TCPConnHandler.(core.TCPConnDialer).DialContext(ctx, target)
+	h.m.observe(start, err)
+	return c, err
+}
+
+func (h *tcpDialerMetrics) HandleDialed(ctx context.Context, conn, upstream net.Conn, target *net.TCPAddr) error {
+	return h.TCPConnHandler.(core.TCPConnDialer).HandleDialed(ctx, conn, upstream, target)
+}
+
+type udpHandlerMetrics struct {
+	core.UDPConnHandler
+	m *handlerMetrics
+}
+
+func (h *udpHandlerMetrics) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return h.ConnectContext(context.Background(), conn, target)
+}
+
+func (h *udpHandlerMetrics) ConnectContext(ctx context.Context, conn core.UDPConn, target *net.UDPAddr) error {
+	start := time.Now()
+	var err error
+	if ch, ok := h.UDPConnHandler.(core.UDPConnContextHandler); ok {
+		err = ch.ConnectContext(ctx, conn, target)
+	} else {
+		err = h.UDPConnHandler.Connect(conn, target)
+	}
+	h.m.observe(start, err)
+	return err
+}
+
+func (h *udpHandlerMetrics) Close(conn core.UDPConn) {
+	if closer, ok := h.UDPConnHandler.(core.UDPConnCloser); ok {
+		closer.Close(conn)
+	}
+}
+
+func collectStackMetrics(stack core.LWIPStack) metrics.Collector {
+	return func(w *metrics.Writer) {
+		s := stack.Stats()
+
+		var sndQueued, unacked, retransmitting uint64
+		var rttSum, rttMax time.Duration
+		var measured int
+		for _, sess := range stack.Sessions() {
+			if sess.Network != "tcp" {
+				continue
+			}
+			if info := sess.TCP; info != nil {
+				measured++
+				rttSum += info.SmoothedRTT
+				rttMax = max(rttMax, info.SmoothedRTT)
+				sndQueued += uint64(info.SendQueued)
+				unacked += uint64(info.UnackedSegments)
+				if info.CurrentRetransmits > 0 {
+					retransmitting++
+				}
+			}
+		}
+		w.Family("tun2socks_sessions_active", metrics.TypeGauge, "Number of active sessions.")
+		w.Sample("tun2socks_sessions_active", metrics.Labels("network", "tcp"), float64(s.TCPSessions))
+		w.Sample("tun2socks_sessions_active", metrics.Labels("network", "udp"), float64(s.UDPSessions))
+
+		w.Family("tun2socks_bytes_total", metrics.TypeCounter, "Bytes of IP packets read from (up) and written to (down) TUN.")
+		w.Sample("tun2socks_bytes_total", metrics.Labels("direction", "up"), float64(s.BytesUp))
+		w.Sample("tun2socks_bytes_total", metrics.Labels("direction", "down"), float64(s.BytesDown))
+
+		w.Family("tun2socks_packets_total", metrics.TypeCounter, "IP packets read from (up) and written to (down) TUN.")
+		w.Sample("tun2socks_packets_total", metrics.Labels("direction", "up"), float64(s.PacketsUp))
+		w.Sample("tun2socks_packets_total", metrics.Labels("direction", "down"), float64(s.PacketsDown))
+
+		w.Family("tun2socks_dropped_packets_total", metrics.TypeCounter, "Dropped packets by reason.")
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "pbuf_alloc"), float64(s.Dropped.PbufAlloc))
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "udp_pending_full"), float64(s.Dropped.UDPPendingFull))
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "unhandled"), float64(s.Dropped.Unhandled))
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "udp_filtered"), float64(s.Dropped.UDPFiltered))
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "tcp_limited"), float64(s.Dropped.TCPLimited))
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "udp_limited"), float64(s.Dropped.UDPLimited))
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "filtered"), float64(s.Dropped.Filtered))
+		w.Sample("tun2socks_dropped_packets_total", metrics.Labels("reason", "icmp_limited"), float64(s.Dropped.ICMPLimited))
+
+		w.Family("tun2socks_connections_total", metrics.TypeCounter, "Connections by outcome.")
+		w.Sample("tun2socks_connections_total", metrics.Labels("result", "accepted"), float64(s.ConnsAccepted))
+		w.Sample("tun2socks_connections_total", metrics.Labels("result", "refused"), float64(s.ConnsRefused))
+		w.Sample("tun2socks_connections_total", metrics.Labels("result", "aborted"), float64(s.ConnsAborted))
+
+		w.Family("tun2socks_udp_sessions_expired_total", metrics.TypeCounter, "UDP sessions closed after being idle.")
+		w.Sample("tun2socks_udp_sessions_expired_total", nil, float64(s.UDPSessionsExpired))
+
+		var rttAvg time.Duration
+		if measured > 0 {
+			rttAvg = rttSum / time.Duration(measured)
+		}
+		w.Family("tun2socks_tcp_rtt_seconds", metrics.TypeGauge, "Smoothed round-trip time to local clients over active TCP sessions.")
+		w.Sample("tun2socks_tcp_rtt_seconds", metrics.Labels("stat", "avg"), rttAvg.Seconds())
+		w.Sample("tun2socks_tcp_rtt_seconds", metrics.Labels("stat", "max"), rttMax.Seconds())
+		w.Family("tun2socks_tcp_send_queued_bytes", metrics.TypeGauge, "Bytes written to active TCP sessions and not yet acknowledged.")
+		w.Sample("tun2socks_tcp_send_queued_bytes", nil, float64(sndQueued))
+		w.Family("tun2socks_tcp_unacked_segments", metrics.TypeGauge, "Segments sent on active TCP sessions and not yet acknowledged.")
+		w.Sample("tun2socks_tcp_unacked_segments", nil, float64(unacked))
+		w.Family("tun2socks_tcp_sessions_retransmitting", metrics.TypeGauge, "Active TCP sessions retransmitting a segment.")
+		w.Sample("tun2socks_tcp_sessions_retransmitting", nil, float64(retransmitting))
+	}
+}
+
+func collectHandlerMetrics(w *metrics.Writer) {
+	handlerMetricsMu.Lock()
+	list := append([]*handlerMetrics(nil), handlerMetricsList...)
+	handlerMetricsMu.Unlock()
+
+	w.Family("tun2socks_handler_dial_failures_total", metrics.TypeCounter, "Connections the proxy handler failed to dial.")
+	for _, m := range list {
+		labels := metrics.Labels("handler", m.handler, "network", m.network)
+		w.Sample("tun2socks_handler_dial_failures_total", labels, float64(m.dialFailures.Value()))
+	}
+	w.Family("tun2socks_handler_dial_duration_seconds", metrics.TypeHistogram, "Time the proxy handler took to dial.")
+	for _, m := range list {
+		labels := metrics.Labels("handler", m.handler, "network", m.network)
+		m.dialDuration.Write(w, "tun2socks_handler_dial_duration_seconds", labels)
+	}
+}
+
+// collectTunMetrics collects the packets dropped by the queues of the TUN
+// device, before they reach the stack.
+func collectTunMetrics(queues []io.Reader) metrics.Collector {
+	return func(w *metrics.Writer) {
+		var dropped uint64
+		for _, q := range queues {
+			if dc, ok := q.(tun.DropCounter); ok {
+				dropped += dc.Dropped()
+			}
+		}
+		w.Family("tun2socks_tun_dropped_packets_total", metrics.TypeCounter, "Packets read from TUN too large for the read buffer.")
+		w.Sample("tun2socks_tun_dropped_packets_total", nil, float64(dropped))
+	}
+}
+
+// collectCaptureMetrics collects the packets capture failed to keep up
+// with.
+func collectCaptureMetrics(capture *core.Capture) metrics.Collector {
+	return func(w *metrics.Writer) {
+		w.Family("tun2socks_capture_dropped_packets_total", metrics.TypeCounter, "Packets not captured because the capture file fell behind.")
+		w.Sample("tun2socks_capture_dropped_packets_total", nil, float64(capture.Dropped()))
+	}
+}
+
+// serveMetrics serves the metrics of stack and the TUN queues on addr in
+// the background, and the capture control if capture is not nil.
+func serveMetrics(addr string, stack core.LWIPStack, queues []io.Reader, capture *core.Capture) {
+	mux := http.NewServeMux()
+	collectors := []metrics.Collector{collectStackMetrics(stack), collectTunMetrics(queues), collectHandlerMetrics}
+	if capture != nil {
+		collectors = append(collectors, collectCaptureMetrics(capture))
+	}
+	mux.Handle("/metrics", metrics.Handler(collectors...))
+	if capture != nil {
+		mux.Handle("/debug/capture", captureHandler(capture))
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("failed to serve metrics: %v", err)
+		}
+	}()
+	log.Infof("Serving metrics on %v/metrics", addr)
+}
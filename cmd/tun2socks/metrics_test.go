@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ruilisi/go-tun2socks/common/metrics"
+	"github.com/ruilisi/go-tun2socks/core"
+	"github.com/ruilisi/go-tun2socks/tun/tuntest"
+)
+
+// echoDialer connects targets on port 80 to an echo server and refuses
+// the others.
+type echoDialer struct {
+	addr string
+}
+
+func (d *echoDialer) Handle(conn net.Conn, target *net.TCPAddr) error {
+	upstream, err := d.DialContext(context.Background(), target)
+	if err != nil {
+		return err
+	}
+	return d.HandleDialed(context.Background(), conn, upstream, target)
+}
+
+func (d *echoDialer) DialContext(ctx context.Context, target *net.TCPAddr) (net.Conn, error) {
+	if target.Port != 80 {
+		return nil, syscall.ECONNREFUSED
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", d.addr)
+}
+
+func (d *echoDialer) HandleDialed(ctx context.Context, conn, upstream net.Conn, target *net.TCPAddr) error {
+	go func() {
+		defer conn.Close()
+		defer upstream.Close()
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}()
+	return nil
+}
+
+func TestHandlerMetricsConnectBeforeAccept(t *testing.T) {
+	echo, err := tuntest.ListenEcho()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	addr := "127.0.0.1:0"
+	args.MetricsAddr = &addr
+	defer func() { args.MetricsAddr = nil }()
+	registerTCPConnHandler("connect-first", &echoDialer{addr: echo.Addr()})
+
+	dev, peerDev := tuntest.NewPipe()
+	s, err := core.NewLWIPStackWithOptions(true, true, core.WithConnectBeforeAccept())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(core.DELAY)
+	core.RegisterOutputFn(dev.Write)
+	go io.CopyBuffer(s, dev, make([]byte, 65535))
+	peer := tuntest.NewPeer(peerDev, net.IPv4(10, 0, 0, 2))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := peer.DialTCP(ctx, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || !bytes.Equal(buf, []byte("ping")) {
+		t.Fatalf("echoed %q, %v", buf, err)
+	}
+	if _, err := peer.DialTCP(ctx, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 81}); err == nil {
+		t.Fatal("connection to a refused target established")
+	}
+
+	var out bytes.Buffer
+	w := metrics.NewWriter(&out)
+	collectHandlerMetrics(w)
+	w.Flush()
+	for _, want := range []string{
+		`tun2socks_handler_dial_failures_total{handler="connect-first",network="tcp"} 1`,
+		`tun2socks_handler_dial_duration_seconds_count{handler="connect-first",network="tcp"} 2`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %s in:\n%s", want, out.String())
+		}
+	}
+}
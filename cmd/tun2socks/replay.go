@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/ruilisi/go-tun2socks/common/pcap"
+)
+
+// openReplay opens the capture at path to be replayed in place of the TUN
+// device, client selects the packets replayed if not empty.
+func openReplay(path string, speed float64, client string) (*pcap.Replayer, error) {
+	cfg := pcap.ReplayConfig{Speed: speed}
+	if client != "" {
+		_, ipnet, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Client = ipnet
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// The file is read until the replay ends.
+	return pcap.NewReplayer(f, cfg)
+}
@@ -0,0 +1,195 @@
+// Package metrics writes metrics in the Prometheus text exposition format
+// without depending on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// Label is a name/value pair attached to a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Labels builds labels from name/value pairs, e.g.
+// Labels("network", "tcp").
+func Labels(kv ...string) []Label {
+	labels := make([]Label, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		labels = append(labels, Label{Name: kv[i], Value: kv[i+1]})
+	}
+	return labels
+}
+
+// Writer writes metric families in the text exposition format.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Family writes the HELP and TYPE lines of a metric family, it must be
+// called before the samples of the family.
+func (w *Writer) Family(name, typ, help string) {
+	w.printf("# HELP %s %s\n", name, escapeHelp(help))
+	w.printf("# TYPE %s %s\n", name, typ)
+}
+
+// Sample writes a single sample.
+func (w *Writer) Sample(name string, labels []Label, v float64) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatFloat(v))
+}
+
+// Flush flushes buffered samples and returns the first error encountered.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) printf(format string, a ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, a...)
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(l.Value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelEscaper.Replace(s) }
+
+// Counter is a monotonically increasing counter.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n uint64)  { c.v.Add(n) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+// DefaultBuckets are upper bounds in seconds suited for dial latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram returns a histogram with the given bucket upper bounds,
+// DefaultBuckets are used if none are given.
+func NewHistogram(buckets ...float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{buckets: b, counts: make([]uint64, len(b))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// Write writes the bucket, sum and count samples of h, the family must have
+// been written by the caller.
+func (h *Histogram) Write(w *Writer, name string, labels []Label) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	le := make([]Label, len(labels)+1)
+	copy(le, labels)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		le[len(labels)] = Label{Name: "le", Value: formatFloat(bound)}
+		w.Sample(name+"_bucket", le, float64(cumulative))
+	}
+	le[len(labels)] = Label{Name: "le", Value: "+Inf"}
+	w.Sample(name+"_bucket", le, float64(count))
+	w.Sample(name+"_sum", labels, sum)
+	w.Sample(name+"_count", labels, float64(count))
+}
+
+// Collector writes one or more metric families.
+type Collector func(w *Writer)
+
+// Handler returns an HTTP handler serving the metrics written by
+// collectors.
+func Handler(collectors ...Collector) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := NewWriter(rw)
+		for _, c := range collectors {
+			c(w)
+		}
+		w.Flush()
+	})
+}
@@ -0,0 +1,194 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// ipv4Packet returns a minimal IPv4 header from src to dst.
+func ipv4Packet(src, dst net.IP) []byte {
+	pkt := make([]byte, 20)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], 20)
+	copy(pkt[12:], src.To4())
+	copy(pkt[16:], dst.To4())
+	return pkt
+}
+
+func readAll(r io.Reader, t *testing.T) []*Packet {
+	pr, err := NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkts []*Packet
+	for {
+		pkt, err := pr.Next()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	client, server := net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1)
+	in := []Packet{
+		{time.Unix(1700000000, 123456789), DirectionInbound, ipv4Packet(client, server)},
+		{time.Unix(1700000001, 1), DirectionOutbound, append(ipv4Packet(server, client), 1, 2, 3)},
+		{time.Unix(1700000002, 0), DirectionUnknown, ipv4Packet(client, server)},
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 21, "tun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range in {
+		if err := w.WritePacket(pkt.Timestamp, pkt.Direction, pkt.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out := readAll(&buf, t)
+	if len(out) != len(in) {
+		t.Fatalf("read %d packets, want %d", len(out), len(in))
+	}
+	for i, pkt := range out {
+		want := in[i].Data[:min(len(in[i].Data), 21)]
+		if !pkt.Timestamp.Equal(in[i].Timestamp) || pkt.Direction != in[i].Direction || !bytes.Equal(pkt.Data, want) {
+			t.Errorf("packet %d: got %v %v %x, want %v %v %x", i,
+				pkt.Timestamp, pkt.Direction, pkt.Data, in[i].Timestamp, in[i].Direction, want)
+		}
+	}
+}
+
+func TestReadClassic(t *testing.T) {
+	pkt := ipv4Packet(net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1))
+	var buf bytes.Buffer
+	hdr := make([]byte, 24)
+	binary.BigEndian.PutUint32(hdr, 0xa1b2c3d4)
+	binary.BigEndian.PutUint32(hdr[16:], 65535)
+	binary.BigEndian.PutUint32(hdr[20:], linkTypeEthernet)
+	buf.Write(hdr)
+	record := func(etherType uint16, payload []byte) {
+		frame := make([]byte, 14, 14+len(payload))
+		binary.BigEndian.PutUint16(frame[12:], etherType)
+		frame = append(frame, payload...)
+		rec := make([]byte, 16)
+		binary.BigEndian.PutUint32(rec[0:], 1700000000)
+		binary.BigEndian.PutUint32(rec[4:], 250000)
+		binary.BigEndian.PutUint32(rec[8:], uint32(len(frame)))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(frame)))
+		buf.Write(rec)
+		buf.Write(frame)
+	}
+	record(0x0806, make([]byte, 28)) // ARP, skipped.
+	record(0x0800, pkt)
+
+	out := readAll(&buf, t)
+	if len(out) != 1 {
+		t.Fatalf("read %d packets, want 1", len(out))
+	}
+	if !out[0].Timestamp.Equal(time.Unix(1700000000, 250000000)) || !bytes.Equal(out[0].Data, pkt) {
+		t.Errorf("got %v %x", out[0].Timestamp, out[0].Data)
+	}
+}
+
+func TestReadInvalidResolution(t *testing.T) {
+	block := func(typ uint32, body []byte) []byte {
+		b := make([]byte, 8, 12+len(body))
+		binary.LittleEndian.PutUint32(b, typ)
+		binary.LittleEndian.PutUint32(b[4:], uint32(12+len(body)))
+		b = append(b, body...)
+		return binary.LittleEndian.AppendUint32(b, uint32(12+len(body)))
+	}
+	pkt := ipv4Packet(net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1))
+	epb := make([]byte, 20, 20+len(pkt))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(pkt)))
+	epb = append(epb, pkt...)
+
+	// 2^64 and 10^20 units per second overflow.
+	for _, res := range []byte{0xc0, 0xff, 20} {
+		shb := []byte{0, 0, 0, 0, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		binary.LittleEndian.PutUint32(shb, byteOrderMagic)
+		idb := []byte{LinkTypeRaw, 0, 0, 0, 0, 0, 0, 0, optIfTsresol, 0, 1, 0, res, 0, 0, 0, 0, 0, 0, 0}
+		var buf bytes.Buffer
+		buf.Write(block(blockSectionHeader, shb))
+		buf.Write(block(blockInterfaceDesc, idb))
+		buf.Write(block(blockEnhancedPacket, epb))
+
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Next(); err == nil {
+			t.Errorf("resolution %#x: read a packet, want an error", res)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	client, server := net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 0)
+	w.WritePacket(start, DirectionUnknown, ipv4Packet(client, server))
+	w.WritePacket(start.Add(100*time.Millisecond), DirectionUnknown, ipv4Packet(server, client))
+	w.WritePacket(start.Add(200*time.Millisecond), DirectionUnknown, ipv4Packet(client, server))
+
+	_, clients, _ := net.ParseCIDR("10.0.0.0/24")
+	p, err := NewReplayer(&buf, ReplayConfig{Speed: 2, Client: clients})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	begin := time.Now()
+	var n int
+	for {
+		_, err := p.Read(b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+		p.Write(ipv4Packet(server, client))
+	}
+	if n != 2 {
+		t.Errorf("replayed %d packets, want 2", n)
+	}
+	if d := time.Since(begin); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("replayed in %v, want 100ms", d)
+	}
+	if emitted := p.Emitted(); len(emitted) != 2 || emitted[0].Direction != DirectionOutbound {
+		t.Errorf("unexpected packets emitted: %v", emitted)
+	}
+}
+
+func TestReplayWithoutDirection(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WritePacket(time.Unix(1700000000, 0), DirectionUnknown, ipv4Packet(net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1)))
+
+	p, err := NewReplayer(&buf, ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Read(make([]byte, 1500)); err != ErrNoDirection {
+		t.Errorf("got %v, want ErrNoDirection", err)
+	}
+}
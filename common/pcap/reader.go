@@ -0,0 +1,319 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// Link types of the captures Reader understands besides LinkTypeRaw.
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeLoop      = 108
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+// Block types read besides those written.
+const (
+	blockSimplePacket = 0x00000003
+	optIfTsoffset     = 14
+)
+
+// maxBlockSize bounds the blocks and records read, larger ones are
+// considered corrupt.
+const maxBlockSize = 16 << 20
+
+// Packet is an IP packet read from a capture.
+type Packet struct {
+	Timestamp time.Time
+
+	// Direction is read from the packet flags of pcapng captures and the
+	// header of Linux cooked captures, it is unknown otherwise.
+	Direction Direction
+
+	// Data is the IP packet, without its link-layer header. It may be
+	// truncated to the snapshot length of the capture.
+	Data []byte
+}
+
+// iface is an interface described in a pcapng section.
+type iface struct {
+	linkType uint16
+
+	// unitsPerSec is the resolution of timestamps, offset is added to
+	// them.
+	unitsPerSec uint64
+	offset      int64
+}
+
+// Reader reads the IP packets of a pcap or pcapng capture, packets of other
+// protocols are skipped. Captures of TUN devices, loopback interfaces,
+// Ethernet and Linux cooked captures are supported.
+type Reader struct {
+	r  *bufio.Reader
+	ng bool
+
+	// order is the byte order of the classic capture or current pcapng
+	// section, ifaces the interfaces of the section.
+	order  binary.ByteOrder
+	ifaces []iface
+}
+
+// NewReader reads the header of a pcap or pcapng capture from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("pcap: reading header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == blockSectionHeader {
+		pr.ng = true
+		return pr, nil
+	}
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		return nil, fmt.Errorf("pcap: reading header: %w", err)
+	}
+	f := iface{}
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == 0xa1b2c3d4:
+		pr.order, f.unitsPerSec = binary.LittleEndian, 1e6
+	case binary.BigEndian.Uint32(hdr) == 0xa1b2c3d4:
+		pr.order, f.unitsPerSec = binary.BigEndian, 1e6
+	case binary.LittleEndian.Uint32(hdr) == 0xa1b23c4d:
+		pr.order, f.unitsPerSec = binary.LittleEndian, 1e9
+	case binary.BigEndian.Uint32(hdr) == 0xa1b23c4d:
+		pr.order, f.unitsPerSec = binary.BigEndian, 1e9
+	default:
+		return nil, errors.New("pcap: unknown capture format")
+	}
+	f.linkType = uint16(pr.order.Uint32(hdr[20:]))
+	pr.ifaces = []iface{f}
+	return pr, nil
+}
+
+// Next returns the next IP packet of the capture, or io.EOF at its end.
+func (r *Reader) Next() (*Packet, error) {
+	for {
+		var pkt *Packet
+		var err error
+		if r.ng {
+			pkt, err = r.nextBlock()
+		} else {
+			pkt, err = r.nextRecord()
+		}
+		if err != nil || pkt != nil {
+			return pkt, err
+		}
+	}
+}
+
+// nextRecord reads a record of a classic capture, it returns a nil packet
+// if the record is skipped.
+func (r *Reader) nextRecord() (*Packet, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r.r, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("pcap: truncated record header")
+		}
+		return nil, err
+	}
+	caplen := r.order.Uint32(hdr[8:])
+	if caplen > maxBlockSize {
+		return nil, fmt.Errorf("pcap: record of %d bytes", caplen)
+	}
+	data := make([]byte, caplen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, fmt.Errorf("pcap: truncated record: %w", err)
+	}
+	f := r.ifaces[0]
+	ts := uint64(r.order.Uint32(hdr[0:]))*f.unitsPerSec + uint64(r.order.Uint32(hdr[4:]))
+	return f.packet(ts, data, DirectionUnknown), nil
+}
+
+// nextBlock reads a pcapng block, it returns a nil packet for blocks other
+// than packets and skipped packets.
+func (r *Reader) nextBlock() (*Packet, error) {
+	hdr, err := r.r.Peek(12)
+	if err != nil {
+		if err == io.EOF && len(hdr) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("pcap: truncated block header")
+	}
+	typ := binary.LittleEndian.Uint32(hdr)
+	if typ == blockSectionHeader {
+		switch binary.LittleEndian.Uint32(hdr[8:]) {
+		case byteOrderMagic:
+			r.order = binary.LittleEndian
+		case 0x4d3c2b1a:
+			r.order = binary.BigEndian
+		default:
+			return nil, errors.New("pcap: invalid section header")
+		}
+		r.ifaces = nil
+	} else if r.order == nil {
+		return nil, errors.New("pcap: block outside of a section")
+	}
+	typ = r.order.Uint32(hdr)
+	length := r.order.Uint32(hdr[4:])
+	if length < 12 || length%4 != 0 || length > maxBlockSize {
+		return nil, fmt.Errorf("pcap: invalid block length %d", length)
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(r.r, block); err != nil {
+		return nil, fmt.Errorf("pcap: truncated block: %w", err)
+	}
+	body := block[8 : length-4]
+
+	switch typ {
+	case blockInterfaceDesc:
+		if len(body) < 8 {
+			return nil, errors.New("pcap: short interface description")
+		}
+		f := iface{linkType: r.order.Uint16(body), unitsPerSec: 1e6}
+		var err error
+		r.options(body[8:], func(code uint16, value []byte) {
+			switch {
+			case code == optIfTsresol && len(value) >= 1:
+				// Resolutions not fitting in 64 bits are rejected.
+				if v := value[0]; v&0x80 != 0 {
+					if v&0x7f > 63 {
+						err = fmt.Errorf("pcap: invalid timestamp resolution %#x", v)
+						return
+					}
+					f.unitsPerSec = 1 << (v & 0x7f)
+				} else {
+					if v > 19 {
+						err = fmt.Errorf("pcap: invalid timestamp resolution %#x", v)
+						return
+					}
+					f.unitsPerSec = 1
+					for i := byte(0); i < v; i++ {
+						f.unitsPerSec *= 10
+					}
+				}
+			case code == optIfTsoffset && len(value) >= 8:
+				f.offset = int64(r.order.Uint64(value))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		r.ifaces = append(r.ifaces, f)
+	case blockEnhancedPacket:
+		if len(body) < 20 {
+			return nil, errors.New("pcap: short packet block")
+		}
+		id, caplen := r.order.Uint32(body), r.order.Uint32(body[12:])
+		if int(id) >= len(r.ifaces) {
+			return nil, fmt.Errorf("pcap: packet of undescribed interface %d", id)
+		}
+		if int(caplen) > len(body)-20 {
+			return nil, errors.New("pcap: invalid packet length")
+		}
+		data := body[20 : 20+caplen]
+		dir := DirectionUnknown
+		r.options(body[20+int(caplen)+pad4(int(caplen)):], func(code uint16, value []byte) {
+			if code == optEpbFlags && len(value) >= 4 {
+				dir = Direction(r.order.Uint32(value) & 0x3)
+			}
+		})
+		ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+		return r.ifaces[id].packet(ts, data, dir), nil
+	case blockSimplePacket:
+		if len(r.ifaces) == 0 || len(body) < 4 {
+			return nil, errors.New("pcap: invalid simple packet block")
+		}
+		data := body[4:]
+		if n := int(r.order.Uint32(body)); n < len(data) {
+			data = data[:n]
+		}
+		return r.ifaces[0].packet(0, data, DirectionUnknown), nil
+	}
+	return nil, nil
+}
+
+// options calls f with the options of a pcapng block.
+func (r *Reader) options(b []byte, f func(code uint16, value []byte)) {
+	for len(b) >= 4 {
+		code, n := r.order.Uint16(b), int(r.order.Uint16(b[2:]))
+		if code == optEndOfOpt || 4+n > len(b) {
+			return
+		}
+		f(code, b[4:4+n])
+		b = b[min(4+n+pad4(n), len(b)):]
+	}
+}
+
+// packet strips the link-layer header of data captured on f at ts, it
+// returns nil if data is not an IP packet.
+func (f *iface) packet(ts uint64, data []byte, dir Direction) *Packet {
+	switch f.linkType {
+	case LinkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		if etherType == 0x8100 && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		dir = sllDirection(binary.BigEndian.Uint16(data))
+		data = data[16:]
+	case linkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		dir = sllDirection(uint16(data[10]))
+		data = data[20:]
+	default:
+		return nil
+	}
+	if len(data) == 0 || data[0]>>4 != 4 && data[0]>>4 != 6 {
+		return nil
+	}
+
+	secs := ts / f.unitsPerSec
+	hi, lo := bits.Mul64(ts%f.unitsPerSec, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, f.unitsPerSec)
+	return &Packet{
+		Timestamp: time.Unix(int64(secs)+f.offset, int64(nanos)),
+		Direction: dir,
+		Data:      data,
+	}
+}
+
+// sllDirection maps the packet type of a Linux cooked capture.
+func sllDirection(pktType uint16) Direction {
+	switch pktType {
+	case 0: // Sent to this host.
+		return DirectionInbound
+	case 4: // Sent by this host.
+		return DirectionOutbound
+	}
+	return DirectionUnknown
+}
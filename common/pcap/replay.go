@@ -0,0 +1,166 @@
+package pcap
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReplayConfig configures a Replayer.
+type ReplayConfig struct {
+	// Speed scales the pace of the capture, 1 replays packets at their
+	// original times and 10 ten times faster. Zero replays them as fast as
+	// they are read.
+	Speed float64
+
+	// Client selects the packets sent by clients by their source address.
+	// If nil, the packets recorded as inbound are replayed, which is how
+	// core.Capture records the packets read from TUN.
+	Client *net.IPNet
+}
+
+// Replayer stands in for a TUN device: Read returns the packets sent by
+// clients in a capture at their pace and Write records the packets written
+// in reply.
+type Replayer struct {
+	r   *Reader
+	cfg ReplayConfig
+
+	// first is the capture time of the first packet replayed, start the
+	// time it was replayed.
+	first time.Time
+	start time.Time
+
+	// directed is set once a packet with a known direction was read.
+	directed bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	emitted []Packet
+}
+
+// ErrNoDirection is returned by Read at the end of a capture recording the
+// direction of no packet, when the clients are not selected by address.
+var ErrNoDirection = errors.New("pcap: no packet direction in capture, select the clients by address")
+
+// NewReplayer reads the capture in r.
+func NewReplayer(r io.Reader, cfg ReplayConfig) (*Replayer, error) {
+	if cfg.Speed < 0 {
+		return nil, errors.New("pcap: negative replay speed")
+	}
+	pr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Replayer{r: pr, cfg: cfg, done: make(chan struct{})}, nil
+}
+
+// client reports whether pkt was sent by a client.
+func (p *Replayer) client(pkt *Packet) bool {
+	if p.cfg.Client == nil {
+		return pkt.Direction == DirectionInbound
+	}
+	var src net.IP
+	switch pkt.Data[0] >> 4 {
+	case 4:
+		if len(pkt.Data) < 20 {
+			return false
+		}
+		src = pkt.Data[12:16]
+	case 6:
+		if len(pkt.Data) < 40 {
+			return false
+		}
+		src = pkt.Data[8:24]
+	}
+	return p.cfg.Client.Contains(src)
+}
+
+// Read waits for the time of the next packet sent by a client and copies it
+// to b, it returns io.EOF at the end of the capture or once the Replayer is
+// closed. Without Client it returns ErrNoDirection at the end of a capture
+// whose packets were all skipped for lacking a direction.
+func (p *Replayer) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-p.done:
+			return 0, io.EOF
+		default:
+		}
+		pkt, err := p.r.Next()
+		if err == io.EOF && p.cfg.Client == nil && !p.directed {
+			return 0, ErrNoDirection
+		}
+		if err != nil {
+			return 0, err
+		}
+		if pkt.Direction != DirectionUnknown {
+			p.directed = true
+		}
+		if !p.client(pkt) {
+			continue
+		}
+		if len(pkt.Data) > len(b) {
+			return 0, io.ErrShortBuffer
+		}
+		if err := p.wait(pkt.Timestamp); err != nil {
+			return 0, err
+		}
+		return copy(b, pkt.Data), nil
+	}
+}
+
+// wait sleeps until the replay time of a packet captured at ts.
+func (p *Replayer) wait(ts time.Time) error {
+	if p.start.IsZero() {
+		p.first, p.start = ts, time.Now()
+		return nil
+	}
+	if p.cfg.Speed == 0 {
+		return nil
+	}
+	d := time.Until(p.start.Add(time.Duration(float64(ts.Sub(p.first)) / p.cfg.Speed)))
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-p.done:
+		return io.EOF
+	}
+}
+
+// Write records a packet written by the stack.
+func (p *Replayer) Write(b []byte) (int, error) {
+	pkt := Packet{
+		Timestamp: time.Now(),
+		Direction: DirectionOutbound,
+		Data:      append([]byte(nil), b...),
+	}
+	p.mu.Lock()
+	p.emitted = append(p.emitted, pkt)
+	p.mu.Unlock()
+	return len(b), nil
+}
+
+// Emitted returns the packets written so far.
+func (p *Replayer) Emitted() []Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Packet(nil), p.emitted...)
+}
+
+// Close ends the replay, a pending Read returns io.EOF.
+func (p *Replayer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
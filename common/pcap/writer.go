@@ -0,0 +1,131 @@
+// Package pcap writes packet captures of raw IP packets in the pcapng
+// format, which Wireshark and tcpdump open directly, and reads pcap and
+// pcapng captures back.
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// LinkTypeRaw is the link type of captures holding IP packets without a
+// link-layer header.
+const LinkTypeRaw = 101
+
+// Direction is the direction of a packet relative to the capturing
+// interface, it is recorded in the flags of the packet.
+type Direction uint8
+
+const (
+	DirectionUnknown Direction = iota
+	DirectionInbound
+	DirectionOutbound
+)
+
+// pcapng block types and options.
+const (
+	blockSectionHeader    = 0x0a0d0d0a
+	blockInterfaceDesc    = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1a2b3c4d
+	optEndOfOpt           = 0
+	optIfName             = 2
+	optIfTsresol          = 9
+	optEpbFlags           = 2
+	enhancedPacketHdrSize = 28
+)
+
+// Writer writes packets to a pcapng stream with a single interface of
+// LinkTypeRaw and nanosecond timestamps.
+type Writer struct {
+	w       io.Writer
+	snapLen int
+	buf     []byte
+}
+
+// NewWriter writes the section and interface headers to w, packets longer
+// than snapLen are truncated, zero meaning no limit. ifName names the
+// interface, it may be empty.
+func NewWriter(w io.Writer, snapLen int, ifName string) (*Writer, error) {
+	if snapLen < 0 {
+		return nil, errors.New("negative snapshot length")
+	}
+	pw := &Writer{w: w, snapLen: snapLen}
+
+	shb := make([]byte, 0, 28)
+	shb = binary.LittleEndian.AppendUint32(shb, blockSectionHeader)
+	shb = binary.LittleEndian.AppendUint32(shb, 28)
+	shb = binary.LittleEndian.AppendUint32(shb, byteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // Section length not specified.
+	shb = binary.LittleEndian.AppendUint32(shb, 28)
+
+	var opts []byte
+	if ifName != "" {
+		opts = appendOption(opts, optIfName, []byte(ifName))
+	}
+	opts = appendOption(opts, optIfTsresol, []byte{9})
+	opts = appendOption(opts, optEndOfOpt, nil)
+	idbLen := 20 + len(opts)
+	idb := make([]byte, 0, idbLen)
+	idb = binary.LittleEndian.AppendUint32(idb, blockInterfaceDesc)
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(idbLen))
+	idb = binary.LittleEndian.AppendUint16(idb, LinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(snapLen))
+	idb = append(idb, opts...)
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(idbLen))
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// appendOption appends a pcapng option, padded to 32 bits.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// WritePacket writes pkt captured at ts in direction dir.
+func (w *Writer) WritePacket(ts time.Time, dir Direction, pkt []byte) error {
+	data := pkt
+	if w.snapLen > 0 && len(data) > w.snapLen {
+		data = data[:w.snapLen]
+	}
+	var opts int
+	if dir != DirectionUnknown {
+		opts = 12 // epb_flags and opt_endofopt.
+	}
+	blockLen := enhancedPacketHdrSize + len(data) + pad4(len(data)) + opts + 4
+
+	b := w.buf[:0]
+	nanos := uint64(ts.UnixNano())
+	b = binary.LittleEndian.AppendUint32(b, blockEnhancedPacket)
+	b = binary.LittleEndian.AppendUint32(b, uint32(blockLen))
+	b = binary.LittleEndian.AppendUint32(b, 0) // Interface ID.
+	b = binary.LittleEndian.AppendUint32(b, uint32(nanos>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(nanos))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+	b = append(b, data...)
+	b = append(b, make([]byte, pad4(len(data)))...)
+	if dir != DirectionUnknown {
+		b = appendOption(b, optEpbFlags, binary.LittleEndian.AppendUint32(nil, uint32(dir)))
+		b = appendOption(b, optEndOfOpt, nil)
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(blockLen))
+	w.buf = b
+	_, err := w.w.Write(b)
+	return err
+}
@@ -1,8 +0,0 @@
-package syncex
-
-import "errors"
-
-// Package specific errors.
-var (
-	ErrNotLocked = errors.New("not locked")
-)
@@ -1,4 +0,0 @@
-package syncex
-
-// ReentrantMutex is synonym for RecursiveMutex.
-type ReentrantMutex RecursiveMutex
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PacketError is the error of a packet rejected by the stack, Index is the
+// position of the packet in its batch.
+type PacketError struct {
+	Index int
+	Err   error
+}
+
+func (e PacketError) Error() string {
+	return fmt.Sprintf("packet %d: %v", e.Index, e.Err)
+}
+
+func (e PacketError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by WriteBatch and WriteBufferBatch when some
+// packets of a batch were rejected, the other packets of the batch were
+// input regardless.
+type BatchError []PacketError
+
+func (e BatchError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d packets rejected: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// batchResult turns the errors of a batch into the error returned to the
+// caller.
+func batchResult(n int, errs BatchError) (int, error) {
+	if len(errs) != 0 {
+		return n, errs
+	}
+	return n, nil
+}
+
+// inputBatch passes copies of pkts to lwIP in a single call on the lwIP
+// thread, it returns the number of packets input. Empty packets are
+// skipped.
+func inputBatch(pkts [][]byte) (int, error) {
+	var errs BatchError
+	bufs := make([]InputBuffer, len(pkts))
+	for i, pkt := range pkts {
+		if len(pkt) == 0 {
+			continue
+		}
+		if err := bufs[i].load(pkt); err != nil {
+			errs = append(errs, PacketError{Index: i, Err: err})
+		}
+	}
+	var n int
+	lwipCall(func() {
+		for i := range bufs {
+			if bufs[i].b == nil {
+				continue
+			}
+			if _, err := lwipInput(&bufs[i], len(pkts[i])); err != nil {
+				errs = append(errs, PacketError{Index: i, Err: err})
+				continue
+			}
+			n++
+		}
+	})
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+	return batchResult(n, errs)
+}
+
+// inputBufferBatch passes the first sizes[i] bytes of every bufs[i] to lwIP
+// in a single call on the lwIP thread, it returns the number of packets
+// input. Buffers of size 0 are skipped and keep their memory.
+func inputBufferBatch(bufs []*InputBuffer, sizes []int) (int, error) {
+	var n int
+	var errs BatchError
+	lwipCall(func() {
+		for i, b := range bufs {
+			size := sizes[i]
+			if size == 0 {
+				continue
+			}
+			if size < 0 || size > len(b.data) {
+				errs = append(errs, PacketError{Index: i, Err: errInvalidBufferLength})
+				continue
+			}
+			if _, err := lwipInput(b, size); err != nil {
+				errs = append(errs, PacketError{Index: i, Err: err})
+				continue
+			}
+			n++
+		}
+	})
+	return batchResult(n, errs)
+}
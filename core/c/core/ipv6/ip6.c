@@ -1032,6 +1032,10 @@ netif_found:
         hlen = hlen_tot = IP6_HLEN;
         pbuf_remove_header(p, IP6_HLEN);
 
+        /* The header chain is walked again from the start, skip the check
+         * below as a Hop-by-Hop header is valid as the first option. */
+        continue;
+
 #else /* LWIP_IPV6_REASS */
         /* free (drop) packet pbufs */
         LWIP_DEBUGF(IP6_DEBUG, ("ip6_input: packet with Fragment header dropped (with LWIP_IPV6_REASS==0)\n"));
@@ -1695,6 +1695,7 @@ tcp_rexmit_rto_commit(struct tcp_pcb *pcb)
   if (pcb->nrtx < 0xFF) {
     ++pcb->nrtx;
   }
+  ++pcb->rtx_total;
   /* Do the actual retransmission */
   tcp_output(pcb);
 }
@@ -1766,6 +1767,7 @@ tcp_rexmit(struct tcp_pcb *pcb)
   if (pcb->nrtx < 0xFF) {
     ++pcb->nrtx;
   }
+  ++pcb->rtx_total;
 
   /* Don't take any rtt measurements after retransmitting. */
   pcb->rttest = 0;
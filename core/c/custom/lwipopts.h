@@ -120,9 +120,17 @@
 
 #define LWIP_TCP_TIMESTAMPS             1
 #define IP_REASS_MAX_PBUFS              (MEMP_NUM_PBUF / 2)
+// Incomplete IPv4 and IPv6 datagrams are dropped after 15 seconds, IPv6
+// defaults to 60 which holds pbufs too long under a fragment flood.
+#define IP_REASS_MAXAGE                 15
+#define IPV6_REASS_MAXAGE               15
 
 
-#define TCP_MSS                         1460
+// TCP_MSS is the MSS of 9000 bytes jumbo frames, lwIP lowers the MSS
+// advertised to local clients to fit the MTU of the netif set at runtime,
+// 1460 with the default MTU. Larger MTUs advertise TCP_MSS. Smaller heaps
+// keep the buffers of 1460 bytes segments below.
+#define TCP_MSS                         8960
 
 #define TCP_CALCULATE_EFF_SEND_MSS      1
 
@@ -133,15 +141,23 @@
 #define TCP_WND                         ((64 * _KB) - 1)
 #define TCP_SND_BUF                     (64  * _KB)
 #elif MEM_SIZE >= (4 * _MB)
+#undef  TCP_MSS
+#define TCP_MSS                         1460
 #define TCP_WND                         (32  * _KB)
 #define TCP_SND_BUF                     (32  * _KB)
 #elif MEM_SIZE >= (1 * _MB)
+#undef  TCP_MSS
+#define TCP_MSS                         1460
 #define TCP_WND                         (16  * _KB)
 #define TCP_SND_BUF                     (32  * _KB)
 #elif MEM_SIZE >= (512 * _KB)
+#undef  TCP_MSS
+#define TCP_MSS                         1460
 #define TCP_WND                         ( 8  * _KB)
 #define TCP_SND_BUF                     (16  * _KB)
 #elif MEM_SIZE >= (128 * _KB)
+#undef  TCP_MSS
+#define TCP_MSS                         1460
 #define TCP_WND                         ( 8  * _KB)
 #define TCP_SND_BUF                     ( 8  * _KB)
 #elif MEM_SIZE >= (64 * _KB)  /* MEM_SIZE < 128 _KB  SMALL TCP_MSS XXX */
@@ -160,8 +176,19 @@
 #define TCP_WND                         ( 4  * TCP_MSS)
 #endif
 
+// The send queue is sized for the segments of the default MTU rather than
+// for TCP_MSS, segments are that small unless a larger MTU is set.
+#if TCP_MSS > 1460
+#define TCP_SND_QUEUELEN                ((4 * (TCP_SND_BUF) + (1460 - 1))/(1460))
+#else
 #define TCP_SND_QUEUELEN                ((4 * (TCP_SND_BUF) + (TCP_MSS - 1))/(TCP_MSS))
+#endif
 #define MEMP_NUM_TCP_SEG                (8 * TCP_SND_QUEUELEN)
+#if TCP_MSS > 1460
+// The default low-water mark, half of TCP_SND_BUF, is not 4 * TCP_MSS below
+// u16_t overflow with jumbo segments. It is only used by the netconn API.
+#define TCP_SNDLOWAT                    (TCP_SND_BUF / 4)
+#endif
 
 #define LWIP_WND_SCALE                  1
 #define TCP_RCV_SCALE                   0
@@ -180,6 +207,10 @@
 // is used regardless of the platform
 #define IPV6_FRAG_COPYHEADER 1
 
+// packets read from TUN are handed to lwIP as custom pbufs, see
+// input_buffer.go
+#define LWIP_SUPPORT_CUSTOM_PBUF 1
+
 // whether we are in debug mode
 // modify any golang (*.go) file to take effect
 #define TUN2SOCKS_DEBUG 0
@@ -101,8 +101,8 @@
     return (u32_t)sys_get_ms_longlong();
   }
   
-  u32_t
-  sys_now(void)
+  static u32_t
+  sys_arch_now(void)
   {
     return (u32_t)sys_get_ms_longlong();
   }
@@ -201,7 +201,7 @@
   }
 #elif __APPLE__
     #include <mach/mach_time.h>
-    u32_t sys_now(void) {
+    static u32_t sys_arch_now(void) {
         uint64_t now = mach_absolute_time();
         mach_timebase_info_data_t info;
         mach_timebase_info(&info);
@@ -212,8 +212,8 @@
 
 #include <time.h>
 
-u32_t
-sys_now(void)
+static u32_t
+sys_arch_now(void)
 {
   struct timespec ts;
   clock_gettime(CLOCK_MONOTONIC, &ts);
@@ -232,7 +232,7 @@ sys_jiffies(void)
 #elif __linux
     // linux
     #include <sys/time.h>
-    u32_t sys_now(void)
+    static u32_t sys_arch_now(void)
     {
         struct timeval te;
         gettimeofday(&te, NULL);
@@ -244,3 +244,18 @@ sys_jiffies(void)
 #elif __posix
     // POSIX
 #endif
+
+/* The virtual clock of core/clock.go: while sys_clock_virtual is set,
+ * sys_now returns sys_clock_now instead of reading the system clock. Both
+ * are only accessed on the lwIP thread. */
+int sys_clock_virtual;
+u32_t sys_clock_now;
+
+u32_t
+sys_now(void)
+{
+  if (sys_clock_virtual) {
+    return sys_clock_now;
+  }
+  return sys_arch_now();
+}
@@ -303,6 +303,7 @@ struct tcp_pcb {
 
   s16_t rto;    /* retransmission time-out (in ticks of TCP_SLOW_INTERVAL) */
   u8_t nrtx;    /* number of retransmissions */
+  u32_t rtx_total; /* retransmissions over the lifetime of the pcb, not reset by ACKs */
 
   /* fast retransmit/recovery */
   u8_t dupacks;
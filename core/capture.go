@@ -0,0 +1,305 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ruilisi/go-tun2socks/common/log"
+	"github.com/ruilisi/go-tun2socks/common/pcap"
+)
+
+// captureFlushInterval bounds the time captured packets stay buffered.
+const captureFlushInterval = time.Second
+
+// captureQueueLen bounds the packets waiting to be written, packets
+// captured beyond it are dropped.
+const captureQueueLen = 1024
+
+// CaptureConfig configures a Capture.
+type CaptureConfig struct {
+	// Path is the file packets are written to, in the pcapng format.
+	Path string
+
+	// MaxSize rotates the file once it grows beyond MaxSize bytes, zero
+	// disables rotation. Rotated files are renamed Path.1 for the most
+	// recent up to Path.<MaxFiles>, older ones are removed. MaxFiles
+	// defaults to 1.
+	MaxSize  int64
+	MaxFiles int
+
+	// Filter selects the packets captured with an expression in a subset
+	// of the tcpdump syntax: "host ADDR", "net CIDR" and "port N",
+	// optionally qualified by "src" or "dst", "tcp", "udp", "icmp",
+	// "icmp6", "ip", "ip6" and "proto N", combined with "and", "or", "not"
+	// and parentheses, e.g. "host 1.1.1.1 and tcp port 443". Empty
+	// captures every packet.
+	Filter string
+
+	// SnapLen truncates captured packets, zero captures them whole.
+	SnapLen int
+}
+
+// Capture is a PacketFilter writing the packets it sees to a pcapng file,
+// it accepts all of them. Packets read from TUN are recorded as inbound,
+// packets written to TUN as outbound. It captures nothing until Start is
+// called and can be started and stopped at any time.
+//
+// Packets are copied to a queue written to the file in the background, so
+// that the stack does not wait on the file. Packets captured while the
+// queue is full are dropped, see Dropped.
+type Capture struct {
+	cfg     CaptureConfig
+	running atomic.Bool
+	match   atomic.Pointer[captureMatch]
+	packets chan capturedPacket
+	dropped atomic.Uint64
+
+	// mu serializes Start and Stop. queueMu is held for reading while
+	// queueing packets and for writing while stopping, so that no packet
+	// is queued once stopped.
+	mu      sync.Mutex
+	queueMu sync.RWMutex
+	stop    chan struct{}
+	done    chan error
+
+	// The file is only used by the writer goroutine while capturing.
+	file *os.File
+	buf  *bufio.Writer
+	w    *pcap.Writer
+	size int64
+}
+
+type capturedPacket struct {
+	time time.Time
+	dir  pcap.Direction
+	data []byte
+}
+
+// NewCapture returns a stopped Capture writing to cfg.Path.
+func NewCapture(cfg CaptureConfig) (*Capture, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("capture: empty path")
+	}
+	if cfg.MaxSize < 0 || cfg.MaxFiles < 0 || cfg.SnapLen < 0 {
+		return nil, fmt.Errorf("capture: negative limit")
+	}
+	if cfg.MaxFiles == 0 {
+		cfg.MaxFiles = 1
+	}
+	match, err := parseCaptureFilter(cfg.Filter)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{cfg: cfg, packets: make(chan capturedPacket, captureQueueLen)}
+	c.match.Store(&match)
+	return c, nil
+}
+
+// Start starts capturing, a file left at the path by a previous capture is
+// rotated first.
+func (c *Capture) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running.Load() {
+		return nil
+	}
+	// The writer may have stopped on an error, the packets it left in the
+	// queue belong to the previous capture.
+	c.stopWriter()
+	for len(c.packets) > 0 {
+		<-c.packets
+	}
+	if fi, err := os.Stat(c.cfg.Path); err == nil && fi.Size() > 0 {
+		c.rotateFiles()
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan error, 1)
+	go c.writeLoop(c.stop, c.done)
+	c.running.Store(true)
+	log.Infof("Capturing packets to %v", c.cfg.Path)
+	return nil
+}
+
+// Stop stops capturing, writes the packets queued and closes the file.
+func (c *Capture) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop == nil {
+		return nil
+	}
+	c.setStopped()
+	log.Infof("Stopped capturing packets to %v", c.cfg.Path)
+	return c.stopWriter()
+}
+
+// Running reports whether packets are being captured.
+func (c *Capture) Running() bool {
+	return c.running.Load()
+}
+
+// Dropped returns the number of packets not captured because the queue of
+// packets waiting to be written was full.
+func (c *Capture) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// SetFilter replaces the filter expression selecting the packets captured.
+func (c *Capture) SetFilter(expr string) error {
+	match, err := parseCaptureFilter(expr)
+	if err != nil {
+		return err
+	}
+	c.match.Store(&match)
+	return nil
+}
+
+func (c *Capture) Filter(pkt []byte, info *PacketInfo) Verdict {
+	if !c.running.Load() {
+		return VerdictAccept
+	}
+	if match := *c.match.Load(); match != nil && !match(info) {
+		return VerdictAccept
+	}
+	p := capturedPacket{time: time.Now(), dir: pcap.DirectionOutbound}
+	if info.Direction == DirectionIn {
+		p.dir = pcap.DirectionInbound
+	}
+	p.data = append([]byte(nil), pkt...)
+	c.queueMu.RLock()
+	defer c.queueMu.RUnlock()
+	if !c.running.Load() {
+		return VerdictAccept
+	}
+	select {
+	case c.packets <- p:
+	default:
+		c.dropped.Add(1)
+	}
+	return VerdictAccept
+}
+
+// setStopped stops capturing, packets being queued concurrently are
+// queued before it returns.
+func (c *Capture) setStopped() {
+	c.queueMu.Lock()
+	c.running.Store(false)
+	c.queueMu.Unlock()
+}
+
+// stopWriter stops the writer goroutine if any and returns the error of
+// closing the file, it is called with c.mu held.
+func (c *Capture) stopWriter() error {
+	if c.stop == nil {
+		return nil
+	}
+	close(c.stop)
+	err := <-c.done
+	c.stop, c.done = nil, nil
+	return err
+}
+
+// writeLoop writes the queued packets to the file until stop is closed,
+// it then writes the packets left and closes the file. It stops capturing
+// on errors.
+func (c *Capture) writeLoop(stop <-chan struct{}, done chan<- error) {
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+	var err error
+	for err == nil {
+		select {
+		case p := <-c.packets:
+			err = c.write(p)
+		case <-ticker.C:
+			err = c.buf.Flush()
+		case <-stop:
+			for err == nil {
+				select {
+				case p := <-c.packets:
+					err = c.write(p)
+				default:
+					done <- c.close()
+					return
+				}
+			}
+		}
+	}
+	log.Errorf("capture to %v failed, stopping: %v", c.cfg.Path, err)
+	c.setStopped()
+	c.close()
+	done <- nil
+}
+
+// write writes p to the file, rotating it once it grows beyond MaxSize.
+func (c *Capture) write(p capturedPacket) error {
+	if err := c.w.WritePacket(p.time, p.dir, p.data); err != nil {
+		return err
+	}
+	if c.cfg.MaxSize > 0 && c.size >= c.cfg.MaxSize {
+		if err := c.close(); err != nil {
+			return err
+		}
+		c.rotateFiles()
+		return c.open()
+	}
+	return nil
+}
+
+// open creates the capture file.
+func (c *Capture) open() error {
+	f, err := os.OpenFile(c.cfg.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	c.buf = bufio.NewWriterSize(f, 64*1024)
+	c.size = 0
+	if c.w, err = pcap.NewWriter(countingWriter{c.buf, &c.size}, c.cfg.SnapLen, "tun"); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+// close flushes and closes the capture file.
+func (c *Capture) close() error {
+	if c.file == nil {
+		return nil
+	}
+	err := c.buf.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	c.file, c.buf, c.w = nil, nil, nil
+	return err
+}
+
+// rotateFiles renames the capture file and the files rotated before, the
+// oldest one is overwritten.
+func (c *Capture) rotateFiles() {
+	for i := c.cfg.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.cfg.Path, i), fmt.Sprintf("%s.%d", c.cfg.Path, i+1))
+	}
+	if err := os.Rename(c.cfg.Path, c.cfg.Path+".1"); err != nil {
+		log.Warnf("failed to rotate capture %v: %v", c.cfg.Path, err)
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	*w.n += int64(n)
+	return n, err
+}
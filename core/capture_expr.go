@@ -0,0 +1,218 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// captureMatch reports whether a packet is selected by a capture filter.
+type captureMatch func(info *PacketInfo) bool
+
+// parseCaptureFilter compiles a filter expression in a subset of the
+// tcpdump syntax:
+//
+//	expr      = and { ("or" | "||") and }
+//	and       = unary { ["and" | "&&"] unary }
+//	unary     = ("not" | "!") unary | "(" expr ")" | primitive
+//	primitive = ["src" | "dst"] ("host" ADDR | "net" CIDR | "port" N)
+//	          | "tcp" | "udp" | "icmp" | "icmp6" | "ip" | "ip6" | "proto" N
+//
+// Primitives following each other are and'ed, e.g. "tcp port 443".
+func parseCaptureFilter(expr string) (captureMatch, error) {
+	p := &captureParser{tokens: tokenizeCaptureFilter(expr)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("capture filter: unexpected %q", tok)
+	}
+	return m, nil
+}
+
+func tokenizeCaptureFilter(expr string) []string {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	return strings.Fields(expr)
+}
+
+type captureParser struct {
+	tokens []string
+}
+
+func (p *captureParser) peek() (string, bool) {
+	if len(p.tokens) == 0 {
+		return "", false
+	}
+	return p.tokens[0], true
+}
+
+func (p *captureParser) next() (string, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return "", fmt.Errorf("capture filter: unexpected end")
+	}
+	p.tokens = p.tokens[1:]
+	return tok, nil
+}
+
+func (p *captureParser) or() (captureMatch, error) {
+	m, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, _ := p.peek()
+		if tok != "or" && tok != "||" {
+			return m, nil
+		}
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := m
+		m = func(info *PacketInfo) bool { return l(info) || r(info) }
+	}
+}
+
+func (p *captureParser) and() (captureMatch, error) {
+	m, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok == "or" || tok == "||" || tok == ")" {
+			return m, nil
+		}
+		if tok == "and" || tok == "&&" {
+			p.next()
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := m
+		m = func(info *PacketInfo) bool { return l(info) && r(info) }
+	}
+}
+
+func (p *captureParser) unary() (captureMatch, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case "not", "!":
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(info *PacketInfo) bool { return !m(info) }, nil
+	case "(":
+		m, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("capture filter: missing )")
+		}
+		return m, nil
+	}
+	return p.primitive(tok)
+}
+
+func (p *captureParser) primitive(tok string) (captureMatch, error) {
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+	case "dst":
+		src = false
+	}
+	if !src || !dst {
+		var err error
+		if tok, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch tok {
+	case "host", "net":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		var contains func(net.IP) bool
+		if tok == "host" {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, fmt.Errorf("capture filter: invalid host %q", arg)
+			}
+			contains = ip.Equal
+		} else {
+			_, ipnet, err := net.ParseCIDR(arg)
+			if err != nil {
+				return nil, fmt.Errorf("capture filter: invalid net %q", arg)
+			}
+			contains = ipnet.Contains
+		}
+		return func(info *PacketInfo) bool {
+			return src && info.Src != nil && contains(info.Src) || dst && info.Dst != nil && contains(info.Dst)
+		}, nil
+	case "port":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("capture filter: invalid port %q", arg)
+		}
+		n := uint16(port)
+		return func(info *PacketInfo) bool {
+			if info.Protocol != proto_tcp && info.Protocol != proto_udp || !info.transport {
+				return false
+			}
+			return src && info.SrcPort == n || dst && info.DstPort == n
+		}, nil
+	}
+	if !src || !dst {
+		return nil, fmt.Errorf("capture filter: %q after src or dst", tok)
+	}
+
+	switch tok {
+	case "tcp":
+		return protocolMatch(proto_tcp), nil
+	case "udp":
+		return protocolMatch(proto_udp), nil
+	case "icmp":
+		return protocolMatch(proto_icmp), nil
+	case "icmp6":
+		return protocolMatch(proto_icmpv6), nil
+	case "ip":
+		return func(info *PacketInfo) bool { return info.Version == ipv4 }, nil
+	case "ip6":
+		return func(info *PacketInfo) bool { return info.Version == ipv6 }, nil
+	case "proto":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseUint(arg, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("capture filter: invalid protocol %q", arg)
+		}
+		return protocolMatch(int(n)), nil
+	}
+	return nil, fmt.Errorf("capture filter: unexpected %q", tok)
+}
+
+func protocolMatch(proto int) captureMatch {
+	return func(info *PacketInfo) bool { return info.Protocol == proto }
+}
@@ -0,0 +1,95 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/custom -I./c/include
+#include "lwip/sys.h"
+#include "lwip/timeouts.h"
+
+extern int sys_clock_virtual;
+extern u32_t sys_clock_now;
+*/
+import "C"
+import (
+	"sync"
+	"time"
+)
+
+// VirtualClock replaces the system clock of the lwIP timers for a stack
+// created with WithVirtualClock. lwIP time only passes when Advance is
+// called, which runs the timers due synchronously, so retransmissions,
+// keep-alives and TIME_WAIT can be tested quickly and reproducibly. The
+// timers of the Go side of the stack, such as the UDP idle expiry and the
+// dial timeout, keep using the system clock.
+type VirtualClock struct {
+	mu sync.Mutex
+
+	// elapsed is the time advanced so far, lwIP time only moves by whole
+	// milliseconds and rem holds the fraction not passed on yet.
+	elapsed time.Duration
+	rem     time.Duration
+}
+
+// NewVirtualClock returns a clock standing still until it is advanced.
+func NewVirtualClock() *VirtualClock {
+	return &VirtualClock{}
+}
+
+// Elapsed returns the time the clock was advanced by.
+func (c *VirtualClock) Elapsed() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.elapsed
+}
+
+// Advance moves the clock forward by d. Every lwIP timer due in the
+// meantime runs at its due time in order, Advance returns once they all
+// ran. The packets they send are output asynchronously as usual.
+func (c *VirtualClock) Advance(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elapsed += d
+	c.rem += d
+	ms := c.rem.Milliseconds()
+	c.rem -= time.Duration(ms) * time.Millisecond
+	lwipCall(func() {
+		if C.sys_clock_virtual == 0 {
+			// No stack uses the clock.
+			return
+		}
+		for ms > 0 {
+			// SYS_TIMEOUTS_SLEEPTIME_INFINITE when there is no timer.
+			step := int64(C.sys_timeouts_sleeptime())
+			if step > ms {
+				step = ms
+			}
+			C.sys_clock_now += C.u32_t(step)
+			ms -= step
+			C.sys_check_timeouts()
+		}
+	})
+}
+
+// useVirtualClock makes lwIP read the time from the virtual clock, which
+// starts at the current time so that pending timers keep their deadlines.
+// It must be called on the lwIP thread.
+func useVirtualClock() {
+	if C.sys_clock_virtual != 0 {
+		return
+	}
+	C.sys_clock_now = C.sys_now()
+	C.sys_clock_virtual = 1
+}
+
+// useSystemClock makes lwIP read the time from the system clock again, the
+// pending timers are rescheduled relative to it. It must be called on the
+// lwIP thread.
+func useSystemClock() {
+	if C.sys_clock_virtual == 0 {
+		return
+	}
+	C.sys_clock_virtual = 0
+	C.sys_restart_timeouts()
+}
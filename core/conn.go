@@ -8,8 +8,7 @@ import (
 // TCPConn abstracts a TCP connection comming from TUN. This connection
 // should be handled by a registered TCP proxy handler. It's important
 // to note that callback members are called from lwIP, they are already
-// in the lwIP thread when they are called, that is, they are holding
-// the lwipMutex.
+// in the lwIP thread when they are called.
 type TCPConn interface {
 	// Sent will be called when sent data has been acknowledged by peer.
 	Sent(len uint16) error
@@ -55,9 +54,34 @@ type TCPConn interface {
 	// Abort aborts the connection by sending a RST segment.
 	Abort()
 
+	// SetDeadline, SetReadDeadline and SetWriteDeadline behave as
+	// described in net.Conn, an exceeded deadline makes Read and Write
+	// return an error whose Timeout() reports true.
 	SetDeadline(t time.Time) error
 	SetReadDeadline(t time.Time) error
 	SetWriteDeadline(t time.Time) error
+
+	// SetNoDelay controls whether data written to TUN is sent without
+	// waiting for acknowledgements of smaller segments, i.e. disables
+	// Nagle's algorithm. It is true by default.
+	SetNoDelay(noDelay bool) error
+
+	// SetKeepAliveConfig configures keep-alive probes to the local client
+	// as described in net.TCPConn, zero fields select the lwIP defaults of
+	// 2 hours, 75 seconds and 9 probes. Keep-alive is enabled with these
+	// defaults on new connections.
+	SetKeepAliveConfig(config net.KeepAliveConfig) error
+
+	// SetReceiveWindow sets the receive window advertised to the local
+	// client, which bounds the data buffered for Read. It may be up to
+	// the TCP_WND lwIP is built with, which is the default. A window
+	// already advertised is not retracted, it shrinks as Read consumes
+	// data.
+	SetReceiveWindow(size int) error
+
+	// Info returns the lwIP state of the connection, it fails with
+	// net.ErrClosed once lwIP is done with the connection.
+	Info() (TCPInfo, error)
 }
 
 // TCPConn abstracts a UDP connection comming from TUN. This connection
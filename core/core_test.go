@@ -2,22 +2,40 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/ruilisi/go-tun2socks/common/pcap"
 )
 
 const (
-	ipv4Header = 20 // Length of the IPv4 header in bytes.
-	udpHeader  = 8  // Length of the UDP header in bytes.
+	ipv4Header     = 20 // Length of the IPv4 header in bytes.
+	ipv6Header     = 40 // Length of the IPv6 header in bytes.
+	ipv6FragHeader = 8  // Length of the IPv6 Fragment header in bytes.
+	udpHeader      = 8  // Length of the UDP header in bytes.
 	// A small NTP query packet (UDP)
 	ntpHex = "45b8004c72e94000401125a2646a4100d8ef2304007b007b0038a1a7230209e8000003620000072ed8ef230ce10ff888c730e992e10ffbdbc742a583e10ffbdbcaa4151ae10ffde6c3cf01e3"
 	// Two fragments of a large UDP packet.
 	frag1Hex = "450003fc0001200040117bab646a41005db8d8220afa00000774af62691c476d4d1f5bd3b2d5f17b926562b91de7ab5ee5bea9fe13ed6223891668ab17e4236a4ec1bed53fb9db397f2885e0fd418dbe2f29416b3e01dfa633bd72d1486e6aa39d568a4b9906834ba06d0c39f9696cbbe96c13638c4cef0fedab2f17d9aa3eb87b6fcf7a3e614cbf7cc7141fbf174d97ef220f17d7e669752bad3965785ec1355b19a3adea31a6c148a0b77ade200962dc4f02ad302e1f927c537627dc1f56f613e1a9d69847a8adc5b965059e973312c013f3916f6c54ddedb96605590f9d81e39e3649d007a44e1b57d9086487c073b511da5b868a44ad043e013feb23903eade049bcac0c0486c6e832aabce435a054159242a27784260bdbe8318f677dc58cbcc90f5ec7a065504b8ddd66c5a53480e634deed9b075a9d23dbabd37c97a825e2c6d17b179bbe83a35b09c852db9aa8d04ee23f285d83c68ae808c1a16cb2ed7c93e1d9724c1e0f4e413dfd50814f12d648201bc3352dd87640609937db0eef31c335b182e6969b32a50cd7af1116013caeeccc9417d0918bbfb1320cdb6e215b6a0c70654bb196e99636b70c503d9d1837f1a33f4a43913390f2585b361c33912cf16ccbb0a5cfbba90be9c3a360cf11193b9738b1a1459860e0bb99418df9368174a9184aac6f9ecb1299876ce62ab5028f48cf6c93b58b4fb1ced3199d36ae9dfa4b4eb9109ca62f8b186c912939018a8257b79a93cec689223b04a62de256019d56dbe54ba989b1f22aa00ea81e50b0895b152d7841416e9f5ed209d99cb38534820c82b4298a8d93afdc134aa41a2e3cd62d43419873ac8d17487de28b15e186eefe538c2019023086923b3f9aec506589fb5504f483dd820993f6950262231cb0f914415d37a929a77c435ba3ecdab90a817d683abd4dc8028c3294770d4ee28ea71eb09fc027b9dc9afedc00fbe414eef5756d409909786c82186fce59f4305ad3ca47d72d59d2bff2224f5a2115f01bee7b71552160fefd14587f150a67ffc08e92c73f40d8ad7b6b900324ae56ea84eccdbb2872f644cea1b2e011e862f2dba10dbac8452f53a2c6c9ac9d5b33ab03fa16a1f146197d1c649ee2c65636f4973b916190107b1977fb55f4157ff57e62251d3a3e0fcc3357665c13287009a3f11fc0cfe4495a4b9bb981b0893fd06c938c5d99e3b7e68d6ad16326ea54314d5c6a428cf105bf95aea4e8374bd7ff81ecc5b6b9f050dc6482aa123c470d7c068a2f171949cb5dee61ddf3c40ec97099c527926dddb84b0ffa3f69564bb3b9632da0fc6914a80e2044793ac302e3763d762f42abc07b0ed52968f09e96ce3e5fa83822a5d35548973fdda478610fa39355db82bb4c743479743c32a93521082a131cd21439bca3735c8b01d295c67b8dfe8a0071487d8472"
 	frag2Hex = "450003a00001007d40119b8a646a41005db8d822c726296a575ed8996bdad7392375d166d9894a6f0c0c08e4ae1ae9e55ae13a9f206b15cf74a43bff8f579f85344b972e7298f8c56d6a23081c19a369488a1b680af5f2e96e7d650261ac937ac709b74f45d15aa053b734cea3f5cbf400379a0e30e49bf696640a61a86076d867834cb79e7bcb798d129a28a8d81f47448ddc38b6040bd45607013d839c9198daabf8ae2f2994908e8b5d04f3194fe2def74e95e52aaf313119b9cef0bde9232fb7a95003e5fdcb9d8b759cf52d570c75f885333b600348b93fe8d0ccaa113465e37f20ce72b432ecc9c8a25809c2b2ed201a88d39b7f47023651ed6841e50b8fb298ef703888d603cd02438ac2ca563ae1ee273da555c3929a6221467f122a60bdb6484bd99d22fd4f4f3bfc41fd39e49c090acf33f46544c0705dbeb03b7249d90a398eacfbf239bcbb279e2596b06d25cfb9c6e247c34a57d55a272797f27df4fd2fc0fb23623f7c4890e05133ab2fa4f02cdd44eecabb3a49d7abae7dcb95f1429c82a685c4f69901cf22e355e31916bd20d038efc66dc37387d63a4330c516d03b6a2dd23bb9228d94c225723487792ae62888282a41e8c1c834d68ae58b4db92243671fd171157439282cfbab316439224dfb522f304a788f91c52715dc6588f0e1055455f159a28865d97292a7af670ec78afb229fcfa7cb97590d51d7fc8eb40edef005b19c8fb235f41b3bb5f6f7923b7534bf8ca8437ef93f40fabeb49b9eb9c5e8de9ad27ad8de282cea26adf3ddbd5b3ea4537535e2ddb864b125e73d330bf25d923e3df41be562b8de3bb3ce969defb159bc77cacb2337b07ac5204d8f1a39520089932ca6649a742f63c7e5e2ab25dc4bbed75faf68796dd5d521aee6452fbecc6af63623a1c55ad02de7c727c265ef8a4cdd109d41a7be9a5597dc69c3803e77340f2dff5608817b9c6d7c340c351e451401599a6ede93a0a897bd9bfe2dba1bfc7b61683ee9ff266a8a49fbec63ea60e4a58473c3705404cd3b3ff96415fcc92672a045555f48418a7125f0f4bda7b2df2d367af6d0e9d27a1f3895148c002b1503c6b83efa2a1e93def67fa07937d355b04a193465094e16128f33017e892d0bd154b9b87985eb6571d074d6011863b5af1395972d9415b21bd83d971cf5f3f67cc73dc0ab057aad3c83af4f6b10d5a6d8102ee3fe9f25929a14306871bf579e56dfd69cf45dd1472bbfcb1f0ab7fbb3972e27e2aba98273383b50700872d73f5c2ecf6ce3ea384ec08c4818fcfe0ed86513d617025f52"
+
+	// Two fragments of a large UDP packet over IPv6.
+	frag6_1Hex = "6000000004d82c40fd00000000000000000000000000000220010db8000000000000000000000053110000011234abcd14e9003507107a73cb92d2147cc342090025a99678f7c2bc5f51c505457dcd32badf69e9898aae1831908db3ceba43a9cd9caf16d86c55fd175ccc68ce4071b318c132b3a2cb4a18f30b96e733d3a7e95c7ceed5e8318393a5f8b2e4ce80f9ea07a25c3e9a6e4d5b961e1680e1ad86321d9ba9444fb832617b39239835d5dde0b2850330c72b04a5558ee7ab9e9e4e5f6087634a20adff7d0d2f6c98bfff6518fb703ecefa16e49aabdee37272c8d461cb13846d784db4d168f01531bfae44737cb8c8f72c0405891f4096cd5c3041807354ed8441fb69ede16b9c7c449a79a87a7d24b8607f4ea2ce77525da829f8e9ec9e60b19a4451a565f97cbacb28efd34a8f019f73f60e2e079cc6911caeb75e5cfbf07fda960feb3127f2449d036ccec8ccd0867d13783b195e5cf625aea03e9b512409a0ab18b61a0ba57a76b9e611a107b38d209dd5ec15299ea1e943e8d6e4a7737fb105caa323d1f130e8ef707ac770728e467ab69410d4cc4afa5d495cf0081580db464746f7796e71ec5f08b6153fd09aa33d89be08bd2c565e080df3febdc3c0f335b36e57e21328bbad1d668c2276be7ea31320125985fa072f86b5262f48bd268191d963cb39f138b290b7e9206bb029c151fe3d8f9201c9ce916230c253da6186700265d8ff878dd9a922b73ba58bcebe5f45aa2ff8262ab0a02262130f030a78c20f1da6b68a19ac5e98080f8a39c96839c390b0ecf34b177813b992dd0f2be4a9701ef51cb3fb2d0cafeb07c0d7adfeba6ca6b54941713b33d0dba7c789c9a5364797034186cabbbef9fef8b5dfaf54c684179598a5085c5db01d39f2c3075cebb1f2576fafd5f80d5823070256117c0076d44316ad979d453a21206b8b2e3efaa962fb986d9084a0d47aed4540234ce30831c2721ace2d931bf2edcf0083291e269764797cdcde87c4b18acfcb7837d7a4e66327c5eb75dee9da02566a405122495e96daad5c3901c74e2d15689f9ec43beda41631616920c0e9e9d62585edf40c8586c6f77ceb5de2fe54d7b69763de45a6a9ccf71142210a1c969a9cb8fd27d181811dc8b0c3c7f71616fad5aac11f37595628f9bad1ea3e2cf72f39a020dc7abded759f1cb99d2274f8cd32925fbb25f855a043e91146c0000fe1a7077afea174510f0246e4b81962ef9f561abcd5db5f24d5c1255eaac378be67c904f288e3d6261afc725f03e4fef1f820ad8d7a43127a1e66b432cb8bfdf9dc2b705441cd8ac6584b8bb0e245738efbe2b7c40b80bf3fa9fc9ff80086e0d17e8e89412bd8095203db35924d3027470e45ba4db3fbe15f37b5ba2b980017d0e0d35b932f592e7aeca3387962e38c9f5b1fa7bb16f86e0d95e49e349b704438a3fbf80e7ba9a480d686408544a3f85c4cc96dbf5e18fec38b6ae5a429f0470fa68151d1a9fb810e14aa1c0f706e88172daf435a001044b74f58636797b4dad5b713bd1d48cd7e72ba41e44f3dc403eb0dc6838adf612738c84ba4a6ddbee6031b43cbf6228f1e0766417d3611ba46c32ce3222719da06cb379853e46be6b1799c927c7352f69d7431cc2d881c38abd2236439965a7790c5a54697d698da3191e939bc06683e65fb93bf1eeba408e7505dcd7fa540ffe86f604d5c86b6965f95e70e69a3962e4e4a96aa783d1a75e393295d936dadf677cc5312746eff7c03dbe21b9b107b6fa30fa306d4bbf9d3838659ff5c29e92d7a88126796991d07"
+	frag6_2Hex = "6000000002482c40fd00000000000000000000000000000220010db8000000000000000000000053110004d01234abcd58d1a63b9cbc8940d4ec9b85f8e0cfec43d4c8625cb5f1009e586b4c2c7ed9c95a09048acd3401c60bd20779a51a8f6a7b53efe07833345fff241c360cef39def9446a385b795e265eb1c1e3a3b947d730bed0e78f0e80333366f9ea87eeeb0bac6ca3f506ebeaf1daa313bb141eac9baaca3181fdc1198491917bf954e2ab2f7035c4dbc5f7023853368a914b269901074a1a6783e137aa35ba698e988ba7c099ec7f166eddde98dd8ae52bf123ab9b33a1b3d9486b4cb266a808f87037324c3bbc6e5cc10ca6ea505cb95b676e5b8768d549c8279af7a79841a7329c77802ca18d012610398841769a03f7368b4e0ef7ddd68f0a7d631f595223de4a8afd00ea9545cbc7dc2144a15216bea4879959fe1e949be9003e4e9ffc3535116efbe6069d5aca50e833ecdb93c16861ca90bed40d0f2fa78fdafc9b3c86f33f4a2b412d9b5b5a4990c73928122093cc8e730e1d14d08d0a5b5f72674684c23d6aed97946c53e5a37261ce8f8a98cd3f0cdebb17ddeee36ca982641b9d827355949cebaf2c19b41219e530347fadf3ba3ec88a015ba32fd70b08640148e271b1c5b4fdc4f99c1e337b28000379a8a4aaf7fd5a3ee92571606af08f3c53e1b3a337c4d51dedcda16676bdae0c374b9090a145d689bb1b914139a2c554c5fa985ddc4e46666ea3e95072fa59331d966adfcf44143b5982d4d9fad9d3dbecb60a13b9eb1d28d803d18157046c0b203103fb1d462bdad5f13638c21a9637b0a302b0ba52a6c76512ec06b95c8ca828d8ebf272e825f8e29cc56f470d909162ea4cc99878a2"
 )
 
 var ntp, ntpPayload, frag1, frag2, fragPayload []byte
+var frag6_1, frag6_2, frag6Payload []byte
 
 func decode(s string) []byte {
 	b, err := hex.DecodeString(s)
@@ -38,13 +56,17 @@ func (h *fakeUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr)
 	return nil
 }
 
-func setupUDP(t *testing.T) (LWIPStack, *fakeUDPHandler) {
+func setupUDP(t testing.TB) (LWIPStack, *fakeUDPHandler) {
 	ntp = decode(ntpHex)
 	ntpPayload = ntp[ipv4Header+udpHeader:]
 	frag1 = decode(frag1Hex)
 	frag2 = decode(frag2Hex)
 	fragPayload = append([]byte(nil), frag1[ipv4Header+udpHeader:]...)
 	fragPayload = append(fragPayload, frag2[ipv4Header:]...)
+	frag6_1 = decode(frag6_1Hex)
+	frag6_2 = decode(frag6_2Hex)
+	frag6Payload = append([]byte(nil), frag6_1[ipv6Header+ipv6FragHeader+udpHeader:]...)
+	frag6Payload = append(frag6Payload, frag6_2[ipv6Header+ipv6FragHeader:]...)
 
 	// Reset registry (replaces prior sync.Map reset).
 	udpConns = newUDPConnRegistry()
@@ -114,3 +136,1511 @@ func TestUDPFragmentationMemoryAndReordering(t *testing.T) {
 	write(s, buf[:len(frag1)], t)
 	assertEqual(<-h.packets, fragPayload, t)
 }
+
+func TestWriteBatch(t *testing.T) {
+	s, h := setupUDP(t)
+	h.packets = make(chan []byte, 2)
+	n, err := s.WriteBatch([][]byte{frag1, make([]byte, 0x10000), nil, frag2})
+	if n != 2 {
+		t.Errorf("%d packets input, want 2", n)
+	}
+	var errs BatchError
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Index != 1 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertEqual(<-h.packets, fragPayload, t)
+}
+
+func TestWriteBufferBatch(t *testing.T) {
+	s, h := setupUDP(t)
+	bufs := []*InputBuffer{NewInputBuffer(), NewInputBuffer()}
+	sizes := []int{copy(bufs[0].Bytes(), ntp), MTU + 1}
+	n, err := s.WriteBufferBatch(bufs, sizes)
+	if n != 1 {
+		t.Errorf("%d packets input, want 1", n)
+	}
+	var errs BatchError
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Index != 1 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertEqual(<-h.packets, ntpPayload, t)
+}
+
+func TestWithMTU(t *testing.T) {
+	for _, mtu := range []int{MinMTU - 1, MaxMTU + 1} {
+		if _, err := NewLWIPStackWithOptions(true, true, WithMTU(mtu)); err == nil {
+			t.Errorf("MTU %d accepted", mtu)
+		}
+	}
+}
+
+// synAckMSS sends a SYN to a stack created with the given MTU and returns
+// the MSS option of the SYN-ACK.
+func synAckMSS(mtu int, t *testing.T) int {
+	s, err := NewLWIPStackWithOptions(true, true, WithMTU(mtu))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	out := make(chan []byte, 1)
+	defer RegisterOutputFn(*outputFn.Load())
+	RegisterOutputFn(func(data []byte) (int, error) {
+		select {
+		case out <- append([]byte(nil), data...):
+		default:
+		}
+		return len(data), nil
+	})
+	syn := make([]byte, 24)
+	// A source port per MTU, the half-open connections are left behind.
+	binary.BigEndian.PutUint16(syn[0:], uint16(mtu))
+	binary.BigEndian.PutUint16(syn[2:], 80)
+	syn[12] = 6 << 4 // Data offset.
+	syn[13] = 0x02   // SYN.
+	binary.BigEndian.PutUint16(syn[14:], 0xffff)
+	syn[20], syn[21] = 2, 4 // MSS option.
+	binary.BigEndian.PutUint16(syn[22:], 0xffff)
+	write(s, buildIPPacket(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1), proto_tcp, syn), t)
+	pkt := <-out
+	tcp := pkt[ipv4Header:]
+	if tcp[13] != 0x12 || tcp[20] != 2 {
+		t.Fatalf("unexpected reply: %x", pkt)
+	}
+	return int(binary.BigEndian.Uint16(tcp[22:]))
+}
+
+func TestMSSClamping(t *testing.T) {
+	for _, c := range []struct{ mtu, mss int }{
+		{1280, 1240},
+		{MTU, 1460},
+		{9000, 8960},
+		{MaxMTU, 8960},
+	} {
+		if mss := synAckMSS(c.mtu, t); mss != c.mss {
+			t.Errorf("MTU %d: advertised MSS %d, want %d", c.mtu, mss, c.mss)
+		}
+	}
+}
+
+type closingUDPHandler struct {
+	fakeUDPHandler
+	closed chan UDPConn
+}
+
+func (h *closingUDPHandler) Close(conn UDPConn) {
+	h.closed <- conn
+}
+
+func TestUDPIdleExpiry(t *testing.T) {
+	setupUDP(t)
+	s, err := NewLWIPStackWithOptions(true, true, WithUDPPortIdleTimeout(123, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	h := &closingUDPHandler{fakeUDPHandler{packets: make(chan []byte, 1)}, make(chan UDPConn, 1)}
+	RegisterUDPConnHandler(h)
+	write(s, ntp, t)
+	assertEqual(<-h.packets, ntpPayload, t)
+	select {
+	case <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session not closed")
+	}
+	if n := len(s.Sessions()); n != 0 {
+		t.Errorf("%d sessions left", n)
+	}
+	if n := s.Stats().UDPSessions; n != 0 {
+		t.Errorf("%d active UDP sessions counted", n)
+	}
+	if s.Stats().UDPSessionsExpired == 0 {
+		t.Errorf("expired session not counted")
+	}
+}
+
+// sessionUDPHandler collects the sessions it receives datagrams on.
+type sessionUDPHandler struct {
+	conns chan UDPConn
+}
+
+func (h *sessionUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error { return nil }
+func (h *sessionUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.conns <- conn
+	return nil
+}
+
+func udpPacket4(src, dst *net.UDPAddr) []byte {
+	udp := make([]byte, udpHeader+4)
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	return buildIPPacket(src.IP, dst.IP, proto_udp, udp)
+}
+
+func TestUDPNATModes(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+	dst1 := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3478}
+	dst2 := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3479}
+	dst3 := &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 3478}
+	unseen := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3480}
+	for _, c := range []struct {
+		mode     UDPNATMode
+		sessions int
+		// Whether replies from dst2, dst3 and unseen reach the session
+		// of dst1.
+		allowed [3]bool
+	}{
+		{UDPNATFullCone, 1, [3]bool{true, true, true}},
+		{UDPNATPortRestricted, 2, [3]bool{true, false, false}},
+		{UDPNATSymmetric, 3, [3]bool{false, false, false}},
+	} {
+		setupUDP(t)
+		s, err := NewLWIPStackWithOptions(true, true, WithUDPNATMode(c.mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &sessionUDPHandler{conns: make(chan UDPConn, 3)}
+		RegisterUDPConnHandler(h)
+		write(s, udpPacket4(src, dst1), t)
+		conn := <-h.conns
+		write(s, udpPacket4(src, dst2), t)
+		write(s, udpPacket4(src, dst3), t)
+		<-h.conns
+		<-h.conns
+		if n := len(s.Sessions()); n != c.sessions {
+			t.Errorf("%v: %d sessions, want %d", c.mode, n, c.sessions)
+		}
+		if n := s.Stats().UDPSessions; n != uint64(c.sessions) {
+			t.Errorf("%v: %d active UDP sessions counted, want %d", c.mode, n, c.sessions)
+		}
+		for i, from := range []*net.UDPAddr{dst2, dst3, unseen} {
+			before := s.Stats().Dropped.UDPFiltered
+			if _, err := conn.WriteFrom([]byte("reply"), from); err != nil {
+				t.Fatal(err)
+			}
+			if allowed := s.Stats().Dropped.UDPFiltered == before; allowed != c.allowed[i] {
+				t.Errorf("%v: reply from %v allowed %v, want %v", c.mode, from, allowed, c.allowed[i])
+			}
+		}
+	}
+}
+
+type fakeTCPDialer struct {
+	// errs maps target ports to the error of DialContext, dials to other
+	// ports wait for release.
+	errs    map[int]error
+	release chan struct{}
+}
+
+func (h *fakeTCPDialer) Handle(conn net.Conn, target *net.TCPAddr) error { return nil }
+func (h *fakeTCPDialer) DialContext(ctx context.Context, target *net.TCPAddr) (net.Conn, error) {
+	if err, ok := h.errs[target.Port]; ok {
+		return nil, err
+	}
+	<-h.release
+	c, _ := net.Pipe()
+	return c, nil
+}
+func (h *fakeTCPDialer) HandleDialed(ctx context.Context, conn, upstream net.Conn, target *net.TCPAddr) error {
+	return nil
+}
+
+// tcpSegment4 builds a segment from src to 10.0.0.1.
+func tcpSegment4(src net.IP, srcPort, dstPort uint16, seq, ack uint32, flags byte, payload []byte) []byte {
+	seg := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(seg[0:], srcPort)
+	binary.BigEndian.PutUint16(seg[2:], dstPort)
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = 5 << 4 // Data offset.
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], 0xffff)
+	copy(seg[20:], payload)
+	return buildIPPacket(src, net.IPv4(10, 0, 0, 1), proto_tcp, seg)
+}
+
+// withWindow sets the window advertised by a segment of tcpSegment4.
+func withWindow(pkt []byte, wnd uint16) []byte {
+	binary.BigEndian.PutUint16(pkt[ipv4Header+14:], wnd)
+	return pkt
+}
+
+func tcpSyn4(src net.IP, srcPort, dstPort uint16, seq uint32) []byte {
+	return tcpSegment4(src, srcPort, dstPort, seq, 0, 0x02, nil)
+}
+
+// connectBeforeAcceptPort is the client port of TestConnectBeforeAccept,
+// the half-open connection to port 80 is left behind in lwIP.
+var connectBeforeAcceptPort uint16 = 5000
+
+func TestConnectBeforeAccept(t *testing.T) {
+	port := connectBeforeAcceptPort
+	connectBeforeAcceptPort++
+	s, err := NewLWIPStackWithOptions(true, true, WithConnectBeforeAccept())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer func(h TCPConnContextHandler, d TCPConnDialer) {
+		tcpConnHandler, tcpConnDialer = h, d
+	}(tcpConnHandler, tcpConnDialer)
+	h := &fakeTCPDialer{
+		errs: map[int]error{
+			1: syscall.ECONNREFUSED,
+			2: syscall.EHOSTUNREACH,
+		},
+		release: make(chan struct{}),
+	}
+	RegisterTCPConnHandler(h)
+	refused := s.Stats().ConnsRefused
+	out := make(chan []byte, 4)
+	defer RegisterOutputFn(*outputFn.Load())
+	RegisterOutputFn(func(data []byte) (int, error) {
+		// Skip retransmissions to connections of other tests.
+		if data[9] == proto_icmp || binary.BigEndian.Uint16(data[ipv4Header+2:]) == port {
+			out <- append([]byte(nil), data...)
+		}
+		return len(data), nil
+	})
+
+	write(s, tcpSyn4(net.IPv4(10, 0, 0, 2), port, 1, 100), t)
+	pkt := <-out
+	tcp := pkt[ipv4Header:]
+	if pkt[9] != proto_tcp || tcp[13] != 0x14 || binary.BigEndian.Uint32(tcp[8:]) != 101 {
+		t.Errorf("refused connection: unexpected reply %x", pkt)
+	}
+
+	write(s, tcpSyn4(net.IPv4(10, 0, 0, 2), port, 2, 100), t)
+	pkt = <-out
+	icmp := pkt[ipv4Header:]
+	if pkt[9] != proto_icmp || icmp[0] != 3 || icmp[1] != 1 || !bytes.Equal(icmp[8:], tcpSyn4(net.IPv4(10, 0, 0, 2), port, 2, 100)[:ipv4Header+8]) {
+		t.Errorf("unreachable host: unexpected reply %x", pkt)
+	}
+
+	// The SYN and its retransmission are held until the dial succeeds.
+	write(s, tcpSyn4(net.IPv4(10, 0, 0, 2), port, 80, 100), t)
+	write(s, tcpSyn4(net.IPv4(10, 0, 0, 2), port, 80, 100), t)
+	select {
+	case pkt := <-out:
+		t.Fatalf("reply before the dial succeeded: %x", pkt)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(h.release)
+	pkt = <-out
+	if tcp := pkt[ipv4Header:]; tcp[13] != 0x12 || binary.BigEndian.Uint32(tcp[8:]) != 101 {
+		t.Errorf("connected: unexpected reply %x", pkt)
+	}
+	if n := s.Stats().ConnsRefused - refused; n != 2 {
+		t.Errorf("%d connections refused, want 2", n)
+	}
+}
+
+// limitedSource is the last byte of the client address of
+// TestSessionLimits, its half-open connections are left behind in lwIP.
+var limitedSource byte
+
+func TestSessionLimits(t *testing.T) {
+	limitedSource += 2
+	src1, src2 := net.IPv4(10, 0, 18, limitedSource), net.IPv4(10, 0, 18, limitedSource+1)
+	out := make(chan []byte, 8)
+	defer RegisterOutputFn(*outputFn.Load())
+	RegisterOutputFn(func(data []byte) (int, error) {
+		if dst := net.IP(data[16:20]); dst.Equal(src1) || dst.Equal(src2) {
+			out <- append([]byte(nil), data...)
+		}
+		return len(data), nil
+	})
+
+	// The per-source limit: two UDP sessions and a TCP connection.
+	setupUDP(t)
+	s, err := NewLWIPStackWithOptions(true, true, WithMaxSessionsPerSource(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &sessionUDPHandler{conns: make(chan UDPConn, 2)}
+	RegisterUDPConnHandler(h)
+	before := s.Stats().Dropped
+	dst := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 3478}
+	write(s, udpPacket4(&net.UDPAddr{IP: src1, Port: 5000}, dst), t)
+	write(s, udpPacket4(&net.UDPAddr{IP: src1, Port: 5001}, dst), t)
+	<-h.conns
+	<-h.conns
+	write(s, tcpSyn4(src1, 5000, 80, 100), t)
+	if pkt := <-out; pkt[ipv4Header+13] != 0x12 {
+		t.Fatalf("connection within limits: unexpected reply %x", pkt)
+	}
+	write(s, udpPacket4(&net.UDPAddr{IP: src1, Port: 5002}, dst), t)
+	write(s, tcpSyn4(src1, 5001, 80, 100), t)
+	if pkt := <-out; pkt[ipv4Header+13] != 0x14 {
+		t.Errorf("connection beyond limits: unexpected reply %x", pkt)
+	}
+	after := s.Stats().Dropped
+	if n := after.TCPLimited - before.TCPLimited; n != 1 {
+		t.Errorf("%d SYNs reset, want 1", n)
+	}
+	if n := after.UDPLimited - before.UDPLimited; n != 1 {
+		t.Errorf("%d UDP datagrams dropped, want 1", n)
+	}
+	s.Close(DELAY)
+
+	// The rate limit: a burst of 4 connections.
+	s, err = NewLWIPStackWithOptions(true, true, WithConnRateLimit(0.001, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	for port := uint16(5000); port < 5005; port++ {
+		write(s, tcpSyn4(src2, port, 80, 100), t)
+		want := byte(0x12)
+		if port == 5004 {
+			want = 0x14
+		}
+		if pkt := <-out; pkt[ipv4Header+13] != want {
+			t.Errorf("connection %d: unexpected reply %x", port-5000, pkt)
+		}
+	}
+}
+
+// filteredSource is the last byte of the client address of the next run of
+// TestPacketFilter.
+var filteredSource byte
+
+func TestPacketFilter(t *testing.T) {
+	filteredSource++
+	src := net.IPv4(10, 0, 21, filteredSource)
+	out := make(chan []byte, 8)
+	defer RegisterOutputFn(*outputFn.Load())
+	RegisterOutputFn(func(data []byte) (int, error) {
+		if net.IP(data[16:20]).Equal(src) {
+			out <- append([]byte(nil), data...)
+		}
+		return len(data), nil
+	})
+	infos := make(chan PacketInfo, 16)
+	record := PacketFilterFunc(func(pkt []byte, info *PacketInfo) Verdict {
+		if info.Src.Equal(src) || info.Dst.Equal(src) {
+			i := *info
+			i.Src = append(net.IP(nil), info.Src...)
+			i.Dst = append(net.IP(nil), info.Dst...)
+			select {
+			case infos <- i:
+			default:
+			}
+		}
+		return VerdictAccept
+	})
+	block := PacketFilterFunc(func(pkt []byte, info *PacketInfo) Verdict {
+		switch {
+		case info.Direction == DirectionIn && info.DstPort == 25:
+			return VerdictReject
+		case info.Direction == DirectionIn && info.DstPort == 23:
+			return VerdictDrop
+		case info.Direction == DirectionIn && info.Protocol == proto_udp:
+			return VerdictReject
+		case info.Direction == DirectionOut && info.SrcPort == 8080 && info.Dst.Equal(src):
+			return VerdictReject
+		}
+		return VerdictAccept
+	})
+	s, err := NewLWIPStackWithOptions(true, true, WithPacketFilter(record), WithPacketFilter(block))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	before := s.Stats().Dropped.Filtered
+
+	// A rejected SYN is reset.
+	write(s, tcpSyn4(src, 7000, 25, 100), t)
+	want := PacketInfo{
+		Direction: DirectionIn,
+		Version:   4,
+		Protocol:  proto_tcp,
+		Src:       src.To4(),
+		Dst:       net.IPv4(10, 0, 0, 1).To4(),
+		SrcPort:   7000,
+		DstPort:   25,
+		TCPFlags:  tcpFlagSYN,
+	}
+	if info := <-infos; info.Direction != want.Direction || info.Version != want.Version ||
+		info.Protocol != want.Protocol || !info.Src.Equal(want.Src) || !info.Dst.Equal(want.Dst) ||
+		info.SrcPort != want.SrcPort || info.DstPort != want.DstPort || info.TCPFlags != want.TCPFlags {
+		t.Errorf("packet info %+v, want %+v", info, want)
+	}
+	rst := <-out
+	if rst[ipv4Header+13] != tcpFlagRST|tcpFlagACK || binary.BigEndian.Uint32(rst[ipv4Header+8:]) != 101 ||
+		binary.BigEndian.Uint16(rst[ipv4Header:]) != 25 {
+		t.Errorf("rejected SYN: unexpected reply %x", rst)
+	}
+	if info := <-infos; info.Direction != DirectionOut || info.TCPFlags != tcpFlagRST|tcpFlagACK {
+		t.Errorf("reply seen as %+v", info)
+	}
+
+	// A rejected UDP datagram is answered with an ICMP administratively
+	// prohibited from its destination.
+	write(s, udpPacket4(&net.UDPAddr{IP: src, Port: 7000}, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 9}), t)
+	if pkt := <-out; pkt[9] != proto_icmp || pkt[ipv4Header] != 3 || pkt[ipv4Header+1] != 13 ||
+		!net.IP(pkt[12:16]).Equal(net.IPv4(1, 1, 1, 1)) {
+		t.Errorf("rejected datagram: unexpected reply %x", pkt)
+	}
+
+	// A dropped SYN is not answered, a rejected SYN-ACK resets the
+	// connection in lwIP.
+	write(s, tcpSyn4(src, 7000, 23, 100), t)
+	write(s, tcpSyn4(src, 7000, 8080, 100), t)
+	client := &net.TCPAddr{IP: src, Port: 7000}
+	target := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8080}
+	for deadline := time.Now().Add(time.Second); ; {
+		var active bool
+		lwipCall(func() {
+			active = tcpPCBActive(client, target)
+		})
+		if !active {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection with rejected SYN-ACK still active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case pkt := <-out:
+		t.Errorf("unexpected packet %x", pkt)
+	default:
+	}
+	if n := s.Stats().Dropped.Filtered - before; n != 4 {
+		t.Errorf("%d packets filtered, want 4", n)
+	}
+}
+
+func TestCaptureFilter(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+	dns := udpPacket4(client, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53})
+	syn := tcpSyn4(client.IP, 40000, 443, 100)
+	for _, tt := range []struct {
+		expr     string
+		dns, syn bool
+	}{
+		{"", true, true},
+		{"udp", true, false},
+		{"tcp port 443", false, true},
+		{"host 1.1.1.1", true, false},
+		{"src host 10.0.0.2 and not udp", false, true},
+		{"dst net 10.0.0.0/8 || port 53", true, true},
+		{"ip6 or (src port 5353 && dst port 53)", true, false},
+		{"proto 6", false, true},
+	} {
+		match, err := parseCaptureFilter(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		for _, c := range []struct {
+			pkt  []byte
+			want bool
+		}{{dns, tt.dns}, {syn, tt.syn}} {
+			var info PacketInfo
+			info.parse(c.pkt)
+			if got := match == nil || match(&info); got != c.want {
+				t.Errorf("%q matches %x: %v, want %v", tt.expr, c.pkt, got, c.want)
+			}
+		}
+	}
+	for _, expr := range []string{"host", "port 70000", "src tcp", "(udp", "udp)", "host example.com"} {
+		if _, err := parseCaptureFilter(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+}
+
+// capturedPackets returns the packets of the pcapng file at path.
+func capturedPackets(path string, t *testing.T) []*pcap.Packet {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkts []*pcap.Packet
+	for {
+		pkt, err := r.Next()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tun.pcapng")
+	c, err := NewCapture(CaptureConfig{Path: path, MaxSize: 300, Filter: "udp dst port 53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewLWIPStackWithOptions(true, true, WithPacketFilter(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	RegisterUDPConnHandler(discardUDPHandler{})
+	client := &net.UDPAddr{IP: net.IPv4(10, 0, 22, 1), Port: 5353}
+	query := func(port int) {
+		write(s, udpPacket4(client, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: port}), t)
+	}
+
+	query(53) // Not captured yet.
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The file is rotated after the fourth packet of 76 bytes.
+	for i := 0; i < 6; i++ {
+		query(53)
+		query(54)
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	query(53)
+
+	rotated := capturedPackets(path+".1", t)
+	if len(rotated) != 4 {
+		t.Fatalf("%d packets in rotated file, want 4", len(rotated))
+	}
+	if rotated[0].Direction != pcap.DirectionInbound {
+		t.Errorf("packet direction %v, want inbound", rotated[0].Direction)
+	}
+	if pkts := capturedPackets(path, t); len(pkts) != 2 {
+		t.Errorf("%d packets in current file, want 2", len(pkts))
+	} else if !bytes.Equal(pkts[0].Data, rotated[0].Data) {
+		t.Errorf("unexpected packet %x", pkts[0].Data)
+	}
+}
+
+func TestCaptureDropsWhenQueueFull(t *testing.T) {
+	c, err := NewCapture(CaptureConfig{Path: filepath.Join(t.TempDir(), "tun.pcapng")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the writer running nothing is taken off the queue.
+	c.running.Store(true)
+	pkt := udpPacket4(&net.UDPAddr{IP: net.IPv4(10, 0, 22, 1), Port: 5353}, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53})
+	info := &PacketInfo{Direction: DirectionIn}
+	for i := 0; i < captureQueueLen+3; i++ {
+		if v := c.Filter(pkt, info); v != VerdictAccept {
+			t.Fatalf("verdict %v, want accept", v)
+		}
+	}
+	if got := c.Dropped(); got != 3 {
+		t.Errorf("%d packets dropped, want 3", got)
+	}
+}
+
+func TestCaptureDiscardsStalePackets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tun.pcapng")
+	c, err := NewCapture(CaptureConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	pkt := udpPacket4(&net.UDPAddr{IP: net.IPv4(10, 0, 22, 1), Port: 5353}, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 53})
+	if v := c.Filter(pkt, &PacketInfo{Direction: DirectionIn}); v != VerdictAccept {
+		t.Fatalf("verdict %v, want accept", v)
+	}
+	// A packet left in the queue by the previous capture is not written
+	// to the next one.
+	c.packets <- capturedPacket{time: time.Now(), data: pkt}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if pkts := capturedPackets(path, t); len(pkts) != 0 {
+		t.Errorf("%d packets captured, want none", len(pkts))
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	s, h := setupUDP(t)
+	port := acceptPort
+	acceptPort += 2
+	client := net.IPv4(10, 0, 0, 2)
+
+	// A capture of a datagram and a SYN sent by clients, and a SYN the
+	// stack sent that is not replayed.
+	var capture bytes.Buffer
+	w, err := pcap.NewWriter(&capture, 0, "tun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now()
+	w.WritePacket(ts, pcap.DirectionInbound, ntp)
+	w.WritePacket(ts.Add(time.Millisecond), pcap.DirectionInbound, tcpSyn4(client, port, 80, 100))
+	w.WritePacket(ts.Add(2*time.Millisecond), pcap.DirectionOutbound, tcpSyn4(client, port+1, 80, 100))
+
+	p, err := pcap.NewReplayer(&capture, pcap.ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RegisterOutputFn(*outputFn.Load())
+	RegisterOutputFn(p.Write)
+	if _, err := io.CopyBuffer(s, p, make([]byte, MTU)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(<-h.packets, ntpPayload, t)
+	// Output is written asynchronously.
+	var synAcks int
+	for deadline := time.Now().Add(time.Second); synAcks == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		for _, pkt := range p.Emitted() {
+			dst := binary.BigEndian.Uint16(pkt.Data[ipv4Header+2:])
+			if dst == port+1 {
+				t.Fatal("outbound packet replayed")
+			}
+			if dst == port && pkt.Data[ipv4Header+13] == tcpFlagSYN|tcpFlagACK {
+				synAcks++
+			}
+		}
+	}
+	if synAcks != 1 {
+		t.Errorf("%d SYN-ACKs emitted, want 1", synAcks)
+	}
+}
+
+type acceptingTCPHandler struct {
+	conns chan net.Conn
+}
+
+func (h *acceptingTCPHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	h.conns <- conn
+	return nil
+}
+
+// acceptPort is the client port of the next connection of acceptTCP4.
+var acceptPort uint16 = 6000
+
+// acceptTCP4 opens a connection from 10.0.0.2 to s and returns it with the
+// channel of the segments sent to the client and the SYN-ACK.
+func acceptTCP4(s LWIPStack, t *testing.T) (TCPConn, chan []byte, []byte) {
+	h := &acceptingTCPHandler{conns: make(chan net.Conn, 1)}
+	RegisterTCPConnHandler(h)
+	port := acceptPort
+	acceptPort++
+	segs := make(chan []byte, 64)
+	RegisterOutputFn(func(data []byte) (int, error) {
+		if binary.BigEndian.Uint16(data[ipv4Header+2:]) == port {
+			segs <- append([]byte(nil), data[ipv4Header:]...)
+		}
+		return len(data), nil
+	})
+	write(s, tcpSyn4(net.IPv4(10, 0, 0, 2), port, 80, 100), t)
+	synAck := <-segs
+	ack := binary.BigEndian.Uint32(synAck[4:]) + 1
+	write(s, tcpSegment4(net.IPv4(10, 0, 0, 2), port, 80, 101, ack, 0x10, nil), t)
+	return (<-h.conns).(TCPConn), segs, synAck
+}
+
+func TestSetReceiveWindow(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	conn, acks, synAck := acceptTCP4(s, t)
+	defer conn.Abort()
+	client := net.IPv4(10, 0, 0, 2)
+	port := binary.BigEndian.Uint16(synAck[2:])
+	ack := binary.BigEndian.Uint32(synAck[4:]) + 1
+	window := func(seg []byte) int { return int(binary.BigEndian.Uint16(seg[14:])) }
+	wnd := window(synAck)
+	if err := conn.SetNoDelay(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReceiveWindow(wnd + 1); err == nil {
+		t.Errorf("window larger than %d accepted", wnd)
+	}
+
+	// Data read after the window is shrunk does not reopen it.
+	if err := conn.SetReceiveWindow(1000); err != nil {
+		t.Fatal(err)
+	}
+	const segs, segLen = 15, 1400
+	seq := uint32(101)
+	for i := 0; i < segs; i++ {
+		write(s, tcpSegment4(client, port, 80, seq, ack, 0x18, make([]byte, segLen)), t)
+		seq += segLen
+	}
+	buf := make([]byte, segs*segLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	var last []byte
+	for last == nil || binary.BigEndian.Uint32(last[8:]) != seq {
+		last = <-acks
+	}
+	if w := window(last); w != wnd-segs*segLen {
+		t.Errorf("window %d after reading %d bytes, want %d", w, segs*segLen, wnd-segs*segLen)
+	}
+
+	// Growing it back gives back the withheld window.
+	if err := conn.SetReceiveWindow(wnd); err != nil {
+		t.Fatal(err)
+	}
+	if w := window(<-acks); w != wnd {
+		t.Errorf("window %d after growing, want %d", w, wnd)
+	}
+}
+
+func TestReadAfterFIN(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	conn, _, synAck := acceptTCP4(s, t)
+	defer conn.Abort()
+	port := binary.BigEndian.Uint16(synAck[2:])
+	ack := binary.BigEndian.Uint32(synAck[4:]) + 1
+
+	// The FIN arrives before the handler reads the data preceding it.
+	data := []byte("data before FIN")
+	write(s, tcpSegment4(net.IPv4(10, 0, 0, 2), port, 80, 101, ack, 0x19, data), t)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(got, data, t)
+}
+
+// waitErr returns the error sent on errs, failing if none comes.
+func waitErr(errs chan error, t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("call still blocked")
+		return nil
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	conn, _, synAck := acceptTCP4(s, t)
+	defer conn.Abort()
+	client := net.IPv4(10, 0, 0, 2)
+	port := binary.BigEndian.Uint16(synAck[2:])
+	ack := binary.BigEndian.Uint32(synAck[4:]) + 1
+	buf := make([]byte, 64)
+
+	// A Read times out once its deadline passes.
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+
+	// Re-arming the deadline clears the timeout.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	write(s, tcpSegment4(client, port, 80, 101, ack, 0x18, []byte("data")), t)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Fatalf("read %q, %v after re-arming the deadline", buf[:n], err)
+	}
+
+	// A pending Read returns once the deadline is moved into the past.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buf)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	if err := waitErr(errs, t); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("pending read: %v", err)
+	}
+
+	// So does a Write waiting for the closed window of the client.
+	write(s, withWindow(tcpSegment4(client, port, 80, 105, ack, 0x10, nil), 0), t)
+	go func() {
+		_, err := conn.Write(make([]byte, 1<<20))
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("write returned %v with the window closed", err)
+	default:
+	}
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err := waitErr(errs, t); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("pending write: %v", err)
+	}
+	if _, err := conn.Write(nil); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("write past the deadline: %v", err)
+	}
+
+	// Clearing both deadlines lets the connection be used again.
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(nil); err != nil {
+		t.Errorf("write after clearing the deadline: %v", err)
+	}
+	write(s, tcpSegment4(client, port, 80, 105, ack, 0x18, []byte("more")), t)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "more" {
+		t.Errorf("read %q, %v after clearing the deadline", buf[:n], err)
+	}
+}
+
+// writeParked reports whether a goroutine is blocked in tcpConn.Write
+// waiting for the send buffer.
+func writeParked() bool {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.Contains(g, []byte(" [select")) && bytes.Contains(g, []byte("(*tcpConn).Write(")) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitWriteParked waits for a Write to park and checks that it stays
+// parked rather than retrying.
+func waitWriteParked(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !writeParked() {
+		if time.Now().After(deadline) {
+			t.Fatal("write not parked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if !writeParked() {
+			t.Fatal("parked write woke up")
+		}
+	}
+}
+
+func TestWriteBlocksUntilAcked(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	conn, segs, synAck := acceptTCP4(s, t)
+	defer conn.Abort()
+	client := net.IPv4(10, 0, 0, 2)
+	port := binary.BigEndian.Uint16(synAck[2:])
+	ack := binary.BigEndian.Uint32(synAck[4:]) + 1
+
+	// With the window of the client closed the send buffer fills up.
+	write(s, withWindow(tcpSegment4(client, port, 80, 101, ack, 0x10, nil), 0), t)
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	data := make([]byte, 200<<10)
+	go func() {
+		n, err := conn.Write(data)
+		done <- result{n, err}
+	}()
+	waitWriteParked(t)
+
+	// Acknowledging the segments sent once the window opens resumes it.
+	write(s, tcpSegment4(client, port, 80, 101, ack, 0x10, nil), t)
+	timeout := time.After(10 * time.Second)
+	for resumed := false; !resumed; {
+		select {
+		case seg := <-segs:
+			end := binary.BigEndian.Uint32(seg[4:]) + uint32(len(seg)-int(seg[12]>>4)*4)
+			if int32(end-ack) > 0 {
+				ack = end
+				write(s, tcpSegment4(client, port, 80, 101, ack, 0x10, nil), t)
+			}
+		case r := <-done:
+			if r.err != nil || r.n != len(data) {
+				t.Fatalf("wrote %d bytes, %v", r.n, r.err)
+			}
+			resumed = true
+		case <-timeout:
+			t.Fatal("write not resumed by acknowledgements")
+		}
+	}
+
+	// A Write parked when the connection is aborted fails.
+	write(s, withWindow(tcpSegment4(client, port, 80, 101, ack, 0x10, nil), 0), t)
+	go func() {
+		for range segs {
+		}
+	}()
+	go func() {
+		n, err := conn.Write(data)
+		done <- result{n, err}
+	}()
+	waitWriteParked(t)
+	conn.Abort()
+	select {
+	case r := <-done:
+		if r.err == nil {
+			t.Errorf("write to aborted connection returned %d bytes without error", r.n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("parked write not woken by abort")
+	}
+}
+
+// findSession returns the session of s with the given local address.
+func findSession(s LWIPStack, network string, local net.Addr, t *testing.T) SessionInfo {
+	t.Helper()
+	for _, sess := range s.Sessions() {
+		if sess.Network == network && sess.LocalAddr.String() == local.String() {
+			return sess
+		}
+	}
+	t.Fatalf("no %v session of %v", network, local)
+	return SessionInfo{}
+}
+
+func TestSessions(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+
+	if err := s.CloseSession(lastSessionID.Load() + 1); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("closing an unknown session: %v", err)
+	}
+	if err := s.AbortSession(lastSessionID.Load() + 1); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("aborting an unknown session: %v", err)
+	}
+
+	// Closing a TCP session sends a FIN.
+	conn, segs, _ := acceptTCP4(s, t)
+	defer conn.Abort()
+	sess := findSession(s, "tcp", conn.LocalAddr(), t)
+	if sess.RemoteAddr.String() != conn.RemoteAddr().String() || sess.TCP == nil {
+		t.Errorf("unexpected session: %+v", sess)
+	}
+	if err := s.CloseSession(sess.ID); err != nil {
+		t.Fatal(err)
+	}
+	nextSegment(segs, 0x01, t)
+
+	// Aborting one sends a RST.
+	conn, segs, _ = acceptTCP4(s, t)
+	defer conn.Abort()
+	if err := s.AbortSession(findSession(s, "tcp", conn.LocalAddr(), t).ID); err != nil {
+		t.Fatal(err)
+	}
+	nextSegment(segs, 0x04, t)
+
+	// Closing a UDP session notifies the handler.
+	h := &closingUDPHandler{fakeUDPHandler{packets: make(chan []byte, 1)}, make(chan UDPConn, 1)}
+	RegisterUDPConnHandler(h)
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5400}
+	write(s, udpPacket4(src, &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 5400}), t)
+	<-h.packets
+	if err := s.CloseSession(findSession(s, "udp", src, t).ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not notified of the closed session")
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	s, err := NewLWIPStackWithOptions(true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	conn, segs, synAck := acceptTCP4(s, t)
+	if _, err := conn.Write(make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	// Without an MSS option segments are 536 bytes, the initial
+	// congestion window holds 4 of them.
+	<-segs
+	info, err := conn.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State != "ESTABLISHED" || info.MSS != 536 || info.CongestionWindow != 4*536 || info.SendQueued != 3000 || info.UnackedSegments != 4 {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if info.ReceiveWindow != uint32(binary.BigEndian.Uint16(synAck[14:])) || info.SendWindow != 0xffff {
+		t.Errorf("unexpected windows: %+v", info)
+	}
+	var found bool
+	for _, sess := range s.Sessions() {
+		if sess.Network == "tcp" && sess.TCP != nil && *sess.TCP == info {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("session of %v without info", conn.LocalAddr())
+	}
+
+	conn.Abort()
+	if _, err := conn.Info(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("info of aborted connection: %v", err)
+	}
+}
+
+func TestTCPInfoRetransmissions(t *testing.T) {
+	clock := NewVirtualClock()
+	s, err := NewLWIPStackWithOptions(true, true, WithVirtualClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	conn, segs, synAck := acceptTCP4(s, t)
+	defer conn.Abort()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	nextSegment(segs, 0x18, t)
+
+	// The unacknowledged segment is retransmitted once the RTO expires.
+	clock.Advance(5 * time.Second)
+	nextSegment(segs, 0x18, t)
+	info, err := conn.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Retransmissions == 0 || info.CurrentRetransmits == 0 {
+		t.Fatalf("retransmission not counted: %+v", info)
+	}
+
+	// Acknowledging it resets the current count only.
+	port := binary.BigEndian.Uint16(synAck[2:])
+	ack := binary.BigEndian.Uint32(synAck[4:]) + 1 + 5
+	write(s, tcpSegment4(net.IPv4(10, 0, 0, 2), port, 80, 101, ack, tcpFlagACK, nil), t)
+	acked, err := conn.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acked.CurrentRetransmits != 0 || acked.Retransmissions != info.Retransmissions {
+		t.Errorf("unexpected counts after the ACK: %+v, before %+v", acked, info)
+	}
+}
+
+// nextSegment returns the next segment of segs with all the given flags
+// set, other segments are skipped.
+func nextSegment(segs chan []byte, flags byte, t *testing.T) []byte {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case seg := <-segs:
+			if seg[13]&flags == flags {
+				return seg
+			}
+		case <-timeout:
+			t.Fatalf("no segment with flags %#x", flags)
+			return nil
+		}
+	}
+}
+
+func TestVirtualClockKeepAlive(t *testing.T) {
+	clock := NewVirtualClock()
+	s, err := NewLWIPStackWithOptions(true, true, WithVirtualClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	start := time.Now()
+	conn, segs, _ := acceptTCP4(s, t)
+	defer conn.Abort()
+	if err := conn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: 10 * time.Second, Interval: time.Second, Count: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Probes are sent after 10, 11 and 12 seconds without an answer, the
+	// connection is reset after 13.
+	clock.Advance(10 * time.Second)
+	if info, err := conn.Info(); err != nil || info.State != "ESTABLISHED" {
+		t.Fatalf("connection not established before the keep-alive expired: %+v %v", info, err)
+	}
+	clock.Advance(4 * time.Second)
+	var probes int
+	for seg := nextSegment(segs, 0, t); seg[13]&tcpFlagRST == 0; seg = nextSegment(segs, 0, t) {
+		probes++
+	}
+	if probes != 3 {
+		t.Errorf("%d keep-alive probes, want 3", probes)
+	}
+	if _, err := conn.Info(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("info of expired connection: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("keep-alive expired in %v", d)
+	}
+}
+
+func TestVirtualClockTimeWait(t *testing.T) {
+	clock := NewVirtualClock()
+	s, err := NewLWIPStackWithOptions(true, true, WithVirtualClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(DELAY)
+	defer RegisterOutputFn(*outputFn.Load())
+	start := time.Now()
+	conn, segs, synAck := acceptTCP4(s, t)
+	client := net.IPv4(10, 0, 0, 2)
+	port := binary.BigEndian.Uint16(synAck[2:])
+
+	// Closing first leaves the connection in TIME_WAIT, where the FIN of
+	// the client is acknowledged again.
+	conn.Close()
+	fin := nextSegment(segs, tcpFlagFIN, t)
+	ack := binary.BigEndian.Uint32(fin[4:]) + 1
+	write(s, tcpSegment4(client, port, 80, 101, ack, tcpFlagFIN|tcpFlagACK, nil), t)
+	nextSegment(segs, tcpFlagACK, t)
+	write(s, tcpSegment4(client, port, 80, 101, ack, tcpFlagFIN|tcpFlagACK, nil), t)
+	if seg := nextSegment(segs, tcpFlagACK, t); seg[13]&tcpFlagRST != 0 {
+		t.Fatal("FIN reset in TIME_WAIT")
+	}
+
+	// After 2MSL the connection is gone and the FIN is reset.
+	clock.Advance(2*time.Minute + time.Second)
+	write(s, tcpSegment4(client, port, 80, 101, ack, tcpFlagFIN|tcpFlagACK, nil), t)
+	nextSegment(segs, tcpFlagRST, t)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("TIME_WAIT ended in %v", d)
+	}
+	if clock.Elapsed() != 2*time.Minute+time.Second {
+		t.Errorf("clock advanced by %v", clock.Elapsed())
+	}
+}
+
+// withHopByHop inserts an empty Hop-by-Hop options header into an IPv6
+// packet.
+func withHopByHop(pkt []byte) []byte {
+	hbh := []byte{pkt[6], 0, 1, 4, 0, 0, 0, 0} // PadN
+	b := append([]byte(nil), pkt[:ipv6Header]...)
+	b = append(b, hbh...)
+	b = append(b, pkt[ipv6Header:]...)
+	b[6] = ipv6HopByHop
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)-ipv6Header))
+	return b
+}
+
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	setupUDP(t)
+	tests := []struct {
+		name       string
+		pkt        []byte
+		offset     int
+		fragOffset uint16
+		moreFrags  bool
+	}{
+		{"first fragment", frag6_1, ipv6Header + ipv6FragHeader, 0, true},
+		{"last fragment", frag6_2, ipv6Header + ipv6FragHeader, 154, false},
+		{"hop-by-hop first fragment", withHopByHop(frag6_1), ipv6Header + 8 + ipv6FragHeader, 0, true},
+		{"hop-by-hop last fragment", withHopByHop(frag6_2), ipv6Header + 8 + ipv6FragHeader, 154, false},
+	}
+	for _, tt := range tests {
+		h, err := parseIPv6Headers(tt.pkt)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if h.proto != proto_udp || h.offset != tt.offset || !h.fragmented {
+			t.Errorf("%s: unexpected headers %+v", tt.name, h)
+		}
+		if fragOffset(ipv6, tt.pkt) != tt.fragOffset || moreFrags(ipv6, tt.pkt) != tt.moreFrags {
+			t.Errorf("%s: unexpected fragment offset or flag", tt.name)
+		}
+		if p, _ := peekNextProto(ipv6, tt.pkt); p != proto_udp {
+			t.Errorf("%s: unexpected protocol %d", tt.name, p)
+		}
+	}
+	if _, err := parseIPv6Headers(withHopByHop(frag6_1)[:ipv6Header+4]); err == nil {
+		t.Error("truncated extension header accepted")
+	}
+}
+
+func TestUDPIPv6Fragmentation(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, frag6_1, t)
+	write(s, frag6_2, t)
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+func TestUDPIPv6FragmentReordering(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, frag6_2, t)
+	write(s, frag6_1, t)
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+func TestUDPIPv6FragmentationWithHopByHop(t *testing.T) {
+	s, h := setupUDP(t)
+	write(s, withHopByHop(frag6_1), t)
+	write(s, withHopByHop(frag6_2), t)
+	assertEqual(<-h.packets, frag6Payload, t)
+}
+
+// icmpEcho builds an echo request from src to dst, or a reply.
+func icmpEcho(src, dst net.IP, reply bool, id, seq uint16, data []byte) []byte {
+	msg := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], data)
+	if src.To4() != nil {
+		msg[0] = icmpv4EchoRequest
+		if reply {
+			msg[0] = icmpv4EchoReply
+		}
+		binary.BigEndian.PutUint16(msg[2:], foldChecksum(checksum(0, msg)))
+		return buildIPPacket(src, dst, proto_icmp, msg)
+	}
+	msg[0] = icmpv6EchoRequest
+	if reply {
+		msg[0] = icmpv6EchoReply
+	}
+	sum := pseudoHeaderSum(src, dst, proto_icmpv6, len(msg))
+	binary.BigEndian.PutUint16(msg[2:], foldChecksum(checksum(sum, msg)))
+	return buildIPPacket(src, dst, proto_icmpv6, msg)
+}
+
+func TestParseICMPEcho(t *testing.T) {
+	src4, dst4 := net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1)
+	src6, dst6 := net.ParseIP("fd00::2"), net.ParseIP("2001:db8::1")
+	data := []byte("abcdefgh")
+
+	fragmented := icmpEcho(src4, dst4, false, 1, 2, data)
+	fragmented[6] |= 0x20 // More fragments.
+	padded := append(icmpEcho(src4, dst4, false, 1, 2, data), 0, 0, 0, 0)
+	for _, c := range []struct {
+		name string
+		pkt  []byte
+		ok   bool
+	}{
+		{"IPv4", icmpEcho(src4, dst4, false, 1, 2, data), true},
+		{"IPv4 trailing bytes", padded, true},
+		{"IPv6", icmpEcho(src6, dst6, false, 1, 2, data), true},
+		{"IPv6 hop-by-hop", withHopByHop(icmpEcho(src6, dst6, false, 1, 2, data)), true},
+		{"IPv4 reply", icmpEcho(src4, dst4, true, 1, 2, data), false},
+		{"IPv6 reply", icmpEcho(src6, dst6, true, 1, 2, data), false},
+		{"IPv4 fragment", fragmented, false},
+		{"IPv4 truncated", icmpEcho(src4, dst4, false, 1, 2, nil)[:ipv4Header+4], false},
+		{"UDP", ntp, false},
+	} {
+		req, err := parseICMPEcho(c.pkt)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: parsed as an echo request", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		src, dst := src4, dst4
+		if req.IsIPv6() {
+			src, dst = src6, dst6
+		}
+		if !req.Src.Equal(src) || !req.Dst.Equal(dst) || req.ID != 1 || req.Seq != 2 || !bytes.Equal(req.Data, data) {
+			t.Errorf("%s: parsed %+v", c.name, req)
+		}
+	}
+}
+
+func TestICMPEchoReply(t *testing.T) {
+	s := NewLWIPStack(true, true)
+	defer s.Close(DELAY)
+	out := make(chan []byte, 1)
+	defer RegisterOutputFn(*outputFn.Load())
+	RegisterOutputFn(func(data []byte) (int, error) {
+		out <- append([]byte(nil), data...)
+		return len(data), nil
+	})
+
+	for _, req := range []*ICMPEchoRequest{
+		{Src: net.IPv4(10, 0, 0, 2), Dst: net.IPv4(1, 1, 1, 1), ID: 7, Seq: 9},
+		{Src: net.ParseIP("fd00::2"), Dst: net.ParseIP("2001:db8::1"), ID: 7, Seq: 9},
+	} {
+		data := []byte("odd length")
+		if err := req.Reply(data); err != nil {
+			t.Fatal(err)
+		}
+		pkt := <-out
+		if want := icmpEcho(req.Dst, req.Src, true, 7, 9, data); !bytes.Equal(pkt, want) {
+			t.Errorf("reply to %v: got %x, want %x", req.Src, pkt, want)
+		}
+		var sum uint32
+		msg := pkt[ipv4Header:]
+		if req.IsIPv6() {
+			msg = pkt[ipv6Header:]
+			sum = pseudoHeaderSum(req.Dst, req.Src, proto_icmpv6, len(msg))
+		} else if foldChecksum(checksum(0, pkt[:ipv4Header])) != 0 {
+			t.Errorf("reply to %v: bad IPv4 header checksum", req.Src)
+		}
+		if foldChecksum(checksum(sum, msg)) != 0 {
+			t.Errorf("reply to %v: bad ICMP checksum", req.Src)
+		}
+	}
+}
+
+func TestOutputPacketStats(t *testing.T) {
+	s := NewLWIPStack(true, true)
+	defer s.Close(DELAY)
+	first := icmpEcho(net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 2), true, 1, 1, nil)
+	second := icmpEcho(net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 2), true, 1, 2, nil)
+	written := make(chan []byte, 2)
+	defer RegisterOutputFn(*outputFn.Load())
+	// Only the second packet is written, retransmissions to connections of
+	// other tests fail too so that they are not counted.
+	RegisterOutputFn(func(data []byte) (int, error) {
+		if bytes.Equal(data, first) || bytes.Equal(data, second) {
+			written <- append([]byte(nil), data...)
+		}
+		if bytes.Equal(data, second) {
+			return len(data), nil
+		}
+		return 0, errors.New("write failed")
+	})
+
+	before := s.Stats()
+	outputPacket(first)
+	outputPacket(second)
+	// Packets are written in order by the output loop.
+	assertEqual(<-written, first, t)
+	assertEqual(<-written, second, t)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().PacketsDown == before.PacketsDown && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	after := s.Stats()
+	if n := after.PacketsDown - before.PacketsDown; n != 1 {
+		t.Errorf("%d packets counted, want only the one written", n)
+	}
+	if n := after.BytesDown - before.BytesDown; n != uint64(len(second)) {
+		t.Errorf("%d bytes counted, want %d", n, len(second))
+	}
+}
+
+// blockingICMPHandler holds echo requests until release is closed.
+type blockingICMPHandler struct {
+	handled chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingICMPHandler) HandleEcho(req *ICMPEchoRequest) error {
+	h.handled <- struct{}{}
+	<-h.release
+	return nil
+}
+
+func TestICMPEchoLimit(t *testing.T) {
+	s := NewLWIPStack(true, true)
+	defer s.Close(DELAY)
+	h := &blockingICMPHandler{make(chan struct{}, maxICMPEchoWorkers+1), make(chan struct{})}
+	RegisterICMPHandler(h)
+	defer RegisterICMPHandler(nil)
+
+	before := s.Stats().Dropped.ICMPLimited
+	for i := 0; i <= maxICMPEchoWorkers; i++ {
+		write(s, icmpEcho(net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1), false, 1, uint16(i), nil), t)
+	}
+	for i := 0; i < maxICMPEchoWorkers; i++ {
+		<-h.handled
+	}
+	if n := s.Stats().Dropped.ICMPLimited - before; n != 1 {
+		t.Errorf("%d echo requests dropped, want 1", n)
+	}
+	close(h.release)
+
+	// Requests are handled again once the workers are done.
+	timeout := time.After(5 * time.Second)
+	for {
+		write(s, icmpEcho(net.IPv4(10, 0, 0, 2), net.IPv4(1, 1, 1, 1), false, 1, 0, nil), t)
+		select {
+		case <-h.handled:
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("echo request not handled after the workers were released")
+		}
+	}
+}
+
+type discardUDPHandler struct{}
+
+func (h discardUDPHandler) Connect(conn UDPConn, target *net.UDPAddr) error              { return nil }
+func (h discardUDPHandler) ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error { return nil }
+
+// benchmarkInput feeds full-sized UDP packets to the stack, reading a packet
+// from TUN is simulated by a copy into the read buffer.
+func benchmarkInput(b *testing.B, zeroCopy bool) {
+	s, _ := setupUDP(b)
+	RegisterUDPConnHandler(discardUDPHandler{})
+	udp := make([]byte, MTU-ipv4Header)
+	binary.BigEndian.PutUint16(udp[0:], 5353)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	pkt := buildIPPacket(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1), proto_udp, udp)
+
+	rbuf := make([]byte, MTU)
+	ibuf := NewInputBuffer()
+	b.SetBytes(int64(len(pkt)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if zeroCopy {
+			n := copy(ibuf.Bytes(), pkt)
+			_, err = s.WriteBuffer(ibuf, n)
+		} else {
+			n := copy(rbuf, pkt)
+			_, err = s.Write(rbuf[:n])
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	// Share of a CPU needed to input 1 Gbit/s of full-sized packets.
+	pps := 1e9 / 8 / float64(len(pkt))
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)*pps/1e9*100, "%cpu@1Gbps")
+}
+
+func BenchmarkInputCopy(b *testing.B) {
+	benchmarkInput(b, false)
+}
+
+func BenchmarkInputZeroCopy(b *testing.B) {
+	benchmarkInput(b, true)
+}
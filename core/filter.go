@@ -0,0 +1,239 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/ruilisi/go-tun2socks/common/log"
+)
+
+// Direction tells whether a packet enters or leaves the stack.
+type Direction int
+
+const (
+	// DirectionIn packets are read from TUN and input to lwIP.
+	DirectionIn Direction = iota
+
+	// DirectionOut packets are written to TUN by the stack.
+	DirectionOut
+)
+
+func (d Direction) String() string {
+	if d == DirectionIn {
+		return "in"
+	}
+	return "out"
+}
+
+// Verdict is the decision of a PacketFilter on a packet.
+type Verdict int
+
+const (
+	// VerdictAccept passes the packet on.
+	VerdictAccept Verdict = iota
+
+	// VerdictDrop discards the packet silently.
+	VerdictDrop
+
+	// VerdictReject discards the packet and tells its sender, with a RST
+	// for TCP segments and an ICMP administratively prohibited otherwise.
+	// Outgoing packets are rejected towards lwIP, the connection they
+	// belong to fails as if the client refused it.
+	VerdictReject
+)
+
+// PacketInfo holds the parsed headers of a packet seen by a PacketFilter.
+// Fields the packet is too short for are left zero.
+type PacketInfo struct {
+	Direction Direction
+
+	// Version is 4 or 6, Protocol the upper-layer protocol, after IPv6
+	// extension headers.
+	Version  int
+	Protocol int
+
+	// Src and Dst refer to the packet, they must not be retained.
+	Src net.IP
+	Dst net.IP
+
+	// SrcPort and DstPort are set for TCP and UDP, TCPFlags for TCP. They
+	// are only set in the first fragment of fragmented packets.
+	SrcPort  uint16
+	DstPort  uint16
+	TCPFlags uint8
+
+	// Fragment is set for the fragments of a fragmented packet.
+	Fragment bool
+
+	// hdrLen is the length of the IP headers and length the length of
+	// the packet according to them, transport is set if the packet holds
+	// the upper-layer header.
+	hdrLen    int
+	length    int
+	transport bool
+}
+
+// parse fills info from the headers of pkt, it reports whether they are
+// well-formed.
+func (info *PacketInfo) parse(pkt []byte) bool {
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return false
+	}
+	info.Version = int(ipv)
+	var first bool
+	switch ipv {
+	case ipv4:
+		if len(pkt) < 20 {
+			return false
+		}
+		info.Protocol = int(pkt[9])
+		info.Src, info.Dst = pkt[12:16], pkt[16:20]
+		info.hdrLen = int(pkt[0]&0x0f) * 4
+		info.length = int(binary.BigEndian.Uint16(pkt[2:]))
+		info.Fragment = moreFrags(ipv, pkt) || fragOffset(ipv, pkt) != 0
+		first = fragOffset(ipv, pkt) == 0
+		if info.hdrLen < 20 || info.length > len(pkt) || info.hdrLen > info.length {
+			info.hdrLen = 0
+			return false
+		}
+	case ipv6:
+		if len(pkt) < 40 {
+			return false
+		}
+		info.Src, info.Dst = pkt[8:24], pkt[24:40]
+		info.length = 40 + int(binary.BigEndian.Uint16(pkt[4:]))
+		if info.length > len(pkt) {
+			return false
+		}
+		h, err := parseIPv6Headers(pkt[:info.length])
+		if err != nil {
+			return false
+		}
+		info.Protocol = int(h.proto)
+		info.hdrLen = h.offset
+		info.Fragment = h.fragmented
+		first = h.fragOffset == 0
+	default:
+		return false
+	}
+	if !first {
+		return true
+	}
+	info.transport = true
+	l4 := pkt[info.hdrLen:info.length]
+	switch info.Protocol {
+	case proto_tcp:
+		if len(l4) >= 20 {
+			info.TCPFlags = l4[13]
+		}
+		fallthrough
+	case proto_udp:
+		if len(l4) >= 4 {
+			info.SrcPort = binary.BigEndian.Uint16(l4[0:])
+			info.DstPort = binary.BigEndian.Uint16(l4[2:])
+		}
+	}
+	return true
+}
+
+// PacketFilter inspects the packets entering and leaving the stack.
+type PacketFilter interface {
+	// Filter decides on pkt, it must neither modify nor retain pkt. It is
+	// called on the lwIP thread for incoming packets and must not block.
+	Filter(pkt []byte, info *PacketInfo) Verdict
+}
+
+// PacketFilterFunc adapts a function to a PacketFilter.
+type PacketFilterFunc func(pkt []byte, info *PacketInfo) Verdict
+
+func (f PacketFilterFunc) Filter(pkt []byte, info *PacketInfo) Verdict {
+	return f(pkt, info)
+}
+
+// PacketFilterChain runs its filters in order, the first verdict other than
+// VerdictAccept is the verdict of the chain.
+type PacketFilterChain []PacketFilter
+
+func (c PacketFilterChain) Filter(pkt []byte, info *PacketInfo) Verdict {
+	for _, f := range c {
+		if v := f.Filter(pkt, info); v != VerdictAccept {
+			return v
+		}
+	}
+	return VerdictAccept
+}
+
+// packetFilters is the filter chain of the active stack, unlike
+// activeStack it is read off the lwIP thread by the output path.
+var packetFilters atomic.Pointer[PacketFilterChain]
+
+// filterPacket runs the packet filters of the stack on pkt and answers it
+// if it is rejected, it reports whether the packet passes.
+func filterPacket(dir Direction, pkt []byte) bool {
+	filters := packetFilters.Load()
+	if filters == nil || len(*filters) == 0 {
+		return true
+	}
+	info := PacketInfo{Direction: dir}
+	info.parse(pkt)
+	v := filters.Filter(pkt, &info)
+	if v == VerdictAccept {
+		return true
+	}
+	stats.dropFiltered.Add(1)
+	if v == VerdictReject {
+		if reply := rejectPacket(pkt, &info); reply != nil {
+			if dir == DirectionIn {
+				outputPacket(reply)
+			} else {
+				// Input waits for the lwIP thread, which may be
+				// waiting for output itself.
+				go func() {
+					if _, err := input(reply); err != nil {
+						log.Debugf("failed to reject packet to %v: %v", info.Dst, err)
+					}
+				}()
+			}
+		}
+	}
+	return false
+}
+
+// rejectPacket builds the answer to a rejected packet, or returns nil if it
+// must not be answered.
+func rejectPacket(pkt []byte, info *PacketInfo) []byte {
+	if !info.transport {
+		return nil
+	}
+	if info.Protocol == proto_tcp {
+		if info.TCPFlags&tcpFlagRST != 0 || info.length-info.hdrLen < 20 {
+			return nil
+		}
+		return tcpReset(pkt, info)
+	}
+	if isICMPError(pkt, info) {
+		return nil
+	}
+	if info.Version == ipv6 {
+		return icmpUnreachable(pkt, info, 1) // Administratively prohibited
+	}
+	return icmpUnreachable(pkt, info, 13) // Communication administratively prohibited
+}
+
+// isICMPError reports whether pkt is an ICMP error message, which are never
+// answered with another one.
+func isICMPError(pkt []byte, info *PacketInfo) bool {
+	if info.length-info.hdrLen < 1 {
+		return false
+	}
+	typ := pkt[info.hdrLen]
+	switch info.Protocol {
+	case proto_icmp:
+		return typ == 3 || typ == 4 || typ == 5 || typ == 11 || typ == 12
+	case proto_icmpv6:
+		return typ < 128
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"net"
 )
 
@@ -19,13 +20,93 @@ type UDPConnHandler interface {
 	ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error
 }
 
-var tcpConnHandler TCPConnHandler
-var udpConnHandler UDPConnHandler
+// TCPConnContextHandler is a TCPConnHandler receiving a context that lives
+// as long as the connection. The context is cancelled when the connection
+// is aborted, errored or closed, when the stack is closed, or when the
+// stack dial timeout exceeds before HandleContext returns.
+type TCPConnContextHandler interface {
+	// HandleContext handles the conn for target.
+	HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error
+}
+
+// UDPConnContextHandler is a UDPConnHandler receiving a context that lives
+// as long as the connection. The context is cancelled when the connection
+// is closed, when the stack is closed, or when the stack dial timeout
+// exceeds before ConnectContext returns.
+type UDPConnContextHandler interface {
+	// ConnectContext connects the proxy server. Note that target can be nil.
+	ConnectContext(ctx context.Context, conn UDPConn, target *net.UDPAddr) error
+
+	// ReceiveTo will be called when data arrives from TUN.
+	ReceiveTo(conn UDPConn, data []byte, addr *net.UDPAddr) error
+}
+
+// TCPConnDialer is implemented by TCP handlers that can connect the remote
+// host before the connection from TUN is accepted, it is used instead of
+// Handle and HandleContext when the stack is created with
+// WithConnectBeforeAccept.
+type TCPConnDialer interface {
+	// DialContext connects target, the SYN of the client is held until it
+	// returns. On error the client receives a RST or an ICMP destination
+	// unreachable depending on the error, see WithConnectBeforeAccept.
+	DialContext(ctx context.Context, target *net.TCPAddr) (net.Conn, error)
+
+	// HandleDialed handles conn for target over upstream, the connection
+	// returned by DialContext. The stack closes upstream itself if the
+	// client never completes the handshake.
+	HandleDialed(ctx context.Context, conn, upstream net.Conn, target *net.TCPAddr) error
+}
+
+// tcpConnHandlerAdapter adapts a TCPConnHandler to TCPConnContextHandler,
+// the context is ignored.
+type tcpConnHandlerAdapter struct {
+	TCPConnHandler
+}
+
+func (a tcpConnHandlerAdapter) HandleContext(_ context.Context, conn net.Conn, target *net.TCPAddr) error {
+	return a.Handle(conn, target)
+}
+
+// udpConnHandlerAdapter adapts a UDPConnHandler to UDPConnContextHandler,
+// the context is ignored.
+type udpConnHandlerAdapter struct {
+	UDPConnHandler
+}
+
+func (a udpConnHandlerAdapter) ConnectContext(_ context.Context, conn UDPConn, target *net.UDPAddr) error {
+	return a.Connect(conn, target)
+}
+
+var tcpConnHandler TCPConnContextHandler
+var tcpConnDialer TCPConnDialer
+var udpConnHandler UDPConnContextHandler
 
+// RegisterTCPConnHandler registers h, the context-aware variant is used if
+// h also implements TCPConnContextHandler.
 func RegisterTCPConnHandler(h TCPConnHandler) {
-	tcpConnHandler = h
+	tcpConnDialer, _ = h.(TCPConnDialer)
+	if ch, ok := h.(TCPConnContextHandler); ok {
+		tcpConnHandler = ch
+		return
+	}
+	tcpConnHandler = tcpConnHandlerAdapter{h}
 }
 
+// RegisterUDPConnHandler registers h, the context-aware variant is used if
+// h also implements UDPConnContextHandler.
 func RegisterUDPConnHandler(h UDPConnHandler) {
+	if ch, ok := h.(UDPConnContextHandler); ok {
+		udpConnHandler = ch
+		return
+	}
+	udpConnHandler = udpConnHandlerAdapter{h}
+}
+
+func RegisterTCPConnContextHandler(h TCPConnContextHandler) {
+	tcpConnDialer, _ = h.(TCPConnDialer)
+	tcpConnHandler = h
+}
+
+func RegisterUDPConnContextHandler(h UDPConnContextHandler) {
 	udpConnHandler = h
 }
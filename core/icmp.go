@@ -0,0 +1,159 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/ruilisi/go-tun2socks/common/log"
+)
+
+const (
+	proto_icmpv6 = 58
+
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// ICMPEchoRequest is an ICMP or ICMPv6 echo request coming from TUN.
+type ICMPEchoRequest struct {
+	// Src is the address of the local client, Dst is the address being
+	// pinged.
+	Src net.IP
+	Dst net.IP
+
+	ID   uint16
+	Seq  uint16
+	Data []byte
+}
+
+// IsIPv6 reports whether the request is an ICMPv6 echo request.
+func (r *ICMPEchoRequest) IsIPv6() bool {
+	return r.Src.To4() == nil
+}
+
+// Reply writes an echo reply carrying data back to TUN, as if it was sent
+// by Dst.
+func (r *ICMPEchoRequest) Reply(data []byte) error {
+	msg := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(msg[4:], r.ID)
+	binary.BigEndian.PutUint16(msg[6:], r.Seq)
+	copy(msg[8:], data)
+	var pkt []byte
+	if r.IsIPv6() {
+		msg[0] = icmpv6EchoReply
+		sum := pseudoHeaderSum(r.Dst.To16(), r.Src.To16(), proto_icmpv6, len(msg))
+		binary.BigEndian.PutUint16(msg[2:], foldChecksum(checksum(sum, msg)))
+		pkt = buildIPPacket(r.Dst, r.Src, proto_icmpv6, msg)
+	} else {
+		msg[0] = icmpv4EchoReply
+		binary.BigEndian.PutUint16(msg[2:], foldChecksum(checksum(0, msg)))
+		pkt = buildIPPacket(r.Dst, r.Src, proto_icmp, msg)
+	}
+	outputPacket(pkt)
+	return nil
+}
+
+// ICMPHandler handles ICMP echo requests coming from TUN. Without a
+// registered handler echo requests are passed to lwIP which answers them
+// itself.
+type ICMPHandler interface {
+	// HandleEcho handles req, replies are written with req.Reply. It is
+	// called in its own goroutine, at most maxICMPEchoWorkers at once.
+	HandleEcho(req *ICMPEchoRequest) error
+}
+
+// maxICMPEchoWorkers bounds the echo requests being handled, requests
+// coming beyond it are dropped.
+const maxICMPEchoWorkers = 64
+
+var icmpEchoWorkers = make(chan struct{}, maxICMPEchoWorkers)
+
+var icmpHandler ICMPHandler
+
+func RegisterICMPHandler(h ICMPHandler) {
+	icmpHandler = h
+}
+
+var errNotEchoRequest = errors.New("not an echo request")
+
+// parseICMPEcho parses pkt as an echo request, fragmented packets are not
+// recognized.
+func parseICMPEcho(pkt []byte) (*ICMPEchoRequest, error) {
+	ipv, err := peekIPVer(pkt)
+	if err != nil {
+		return nil, err
+	}
+	req := &ICMPEchoRequest{}
+	var msg []byte
+	switch ipv {
+	case ipv4:
+		if len(pkt) < 20 || pkt[9] != proto_icmp || moreFrags(ipv, pkt) || fragOffset(ipv, pkt) != 0 {
+			return nil, errNotEchoRequest
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:]))
+		if ihl < 20 || total > len(pkt) || ihl > total {
+			return nil, errNotEchoRequest
+		}
+		req.Src = net.IP(append([]byte(nil), pkt[12:16]...))
+		req.Dst = net.IP(append([]byte(nil), pkt[16:20]...))
+		msg = pkt[ihl:total]
+		if len(msg) < 8 || msg[0] != icmpv4EchoRequest || msg[1] != 0 {
+			return nil, errNotEchoRequest
+		}
+	case ipv6:
+		if len(pkt) < 40 {
+			return nil, errNotEchoRequest
+		}
+		total := 40 + int(binary.BigEndian.Uint16(pkt[4:]))
+		if total > len(pkt) {
+			return nil, errNotEchoRequest
+		}
+		h, err := parseIPv6Headers(pkt[:total])
+		if err != nil || h.proto != proto_icmpv6 || h.fragmented {
+			return nil, errNotEchoRequest
+		}
+		req.Src = net.IP(append([]byte(nil), pkt[8:24]...))
+		req.Dst = net.IP(append([]byte(nil), pkt[24:40]...))
+		msg = pkt[h.offset:total]
+		if len(msg) < 8 || msg[0] != icmpv6EchoRequest || msg[1] != 0 {
+			return nil, errNotEchoRequest
+		}
+	default:
+		return nil, errNotEchoRequest
+	}
+	req.ID = binary.BigEndian.Uint16(msg[4:])
+	req.Seq = binary.BigEndian.Uint16(msg[6:])
+	req.Data = append([]byte(nil), msg[8:]...)
+	return req, nil
+}
+
+// handleICMPEcho passes pkt to the registered ICMPHandler if it is an echo
+// request, it reports whether the packet was consumed. The request is
+// dropped if too many are being handled already.
+func handleICMPEcho(pkt []byte) bool {
+	h := icmpHandler
+	if h == nil {
+		return false
+	}
+	req, err := parseICMPEcho(pkt)
+	if err != nil {
+		return false
+	}
+	select {
+	case icmpEchoWorkers <- struct{}{}:
+	default:
+		stats.dropICMPLimited.Add(1)
+		return true
+	}
+	go func() {
+		defer func() { <-icmpEchoWorkers }()
+		if err := h.HandleEcho(req); err != nil {
+			log.Debugf("ICMP echo %v -> %v failed: %v", req.Src, req.Dst, err)
+		}
+	}()
+	return true
+}
@@ -15,7 +15,6 @@ import "C"
 import (
 	"encoding/binary"
 	"errors"
-	"unsafe"
 
 	"github.com/ruilisi/go-tun2socks/common/log"
 )
@@ -42,16 +41,89 @@ func peekIPVer(p []byte) (ipver, error) {
 	return ipver((p[0] & 0xf0) >> 4), nil
 }
 
+// IPv6 extension headers.
+const (
+	ipv6HopByHop = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6AH       = 51
+	ipv6DestOpts = 60
+)
+
+// ipv6Headers is the result of walking the extension header chain of an
+// IPv6 packet.
+type ipv6Headers struct {
+	// proto is the upper-layer protocol and offset the position of its
+	// header, for non-first fragments it is the position of the
+	// fragment data.
+	proto  proto
+	offset int
+
+	// fragmented is set if a Fragment header is present, fragOffset is
+	// in units of 8 octets.
+	fragmented bool
+	fragOffset uint16
+	moreFrags  bool
+}
+
+// parseIPv6Headers walks the extension header chain of p until it reaches
+// the upper-layer header or a non-first fragment.
+func parseIPv6Headers(p []byte) (*ipv6Headers, error) {
+	if len(p) < 40 {
+		return nil, errors.New("short IPv6 packet")
+	}
+	h := &ipv6Headers{proto: proto(p[6]), offset: 40}
+	for {
+		var hdrLen int
+		switch h.proto {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+			if len(p) < h.offset+2 {
+				return nil, errors.New("short IPv6 extension header")
+			}
+			hdrLen = 8 * (1 + int(p[h.offset+1]))
+		case ipv6AH:
+			if len(p) < h.offset+2 {
+				return nil, errors.New("short IPv6 extension header")
+			}
+			hdrLen = 4 * (2 + int(p[h.offset+1]))
+		case ipv6Fragment:
+			if h.fragmented {
+				return nil, errors.New("duplicate IPv6 fragment header")
+			}
+			if len(p) < h.offset+8 {
+				return nil, errors.New("short IPv6 fragment header")
+			}
+			off := binary.BigEndian.Uint16(p[h.offset+2:])
+			h.fragmented = true
+			h.fragOffset = off >> 3
+			h.moreFrags = off&0x1 != 0
+			hdrLen = 8
+		default:
+			return h, nil
+		}
+		if len(p) < h.offset+hdrLen {
+			return nil, errors.New("short IPv6 extension header")
+		}
+		h.proto = proto(p[h.offset])
+		h.offset += hdrLen
+		if h.fragmented && h.fragOffset != 0 {
+			// Headers following the Fragment header are in the
+			// first fragment.
+			return h, nil
+		}
+	}
+}
+
 func moreFrags(ipv ipver, p []byte) bool {
 	switch ipv {
 	case ipv4:
-		if (p[6] & 0x20) > 0 /* has MF (More Fragments) bit set */ {
+		if len(p) >= 20 && (p[6]&0x20) > 0 /* has MF (More Fragments) bit set */ {
 			return true
 		}
 	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning true simply indicate do the copy anyway.
-		return true
+		if h, err := parseIPv6Headers(p); err == nil {
+			return h.moreFrags
+		}
 	}
 	return false
 }
@@ -59,12 +131,13 @@ func moreFrags(ipv ipver, p []byte) bool {
 func fragOffset(ipv ipver, p []byte) uint16 {
 	switch ipv {
 	case ipv4:
-		return binary.BigEndian.Uint16(p[6:8]) & 0x1fff
+		if len(p) >= 20 {
+			return binary.BigEndian.Uint16(p[6:8]) & 0x1fff
+		}
 	case ipv6:
-		// FIXME Just too lazy to implement this for IPv6, for now
-		// returning a value greater than 0 simply indicate do the
-		// copy anyway.
-		return 1
+		if h, err := parseIPv6Headers(p); err == nil {
+			return h.fragOffset
+		}
 	}
 	return 0
 }
@@ -72,84 +145,85 @@ func fragOffset(ipv ipver, p []byte) uint16 {
 func peekNextProto(ipv ipver, p []byte) (proto, error) {
 	switch ipv {
 	case ipv4:
-		if len(p) < 9 {
+		if len(p) < 20 {
 			return 0, errors.New("short IPv4 packet")
 		}
 		return proto(p[9]), nil
 	case ipv6:
-		if len(p) < 6 {
-			return 0, errors.New("short IPv6 packet")
+		h, err := parseIPv6Headers(p)
+		if err != nil {
+			return 0, err
 		}
-		return proto(p[6]), nil
+		return h.proto, nil
 	default:
 		return 0, errors.New("unknown IP version")
 	}
 }
 
 func input(pkt []byte) (int, error) {
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
-	pktLen := len(pkt)
-	if pktLen == 0 {
+	if len(pkt) == 0 {
 		return 0, nil
 	}
-	remaining := pktLen
-	startPos := 0
-	singleCopyLen := 0
-
-	var buf *C.struct_pbuf
-	var newBuf *C.struct_pbuf
-	var ierr C.err_t = C.ERR_ARG // initial value to free pbuf if errors occur
-
-	// TODO Copy the data only when lwip need to keep it, e.g. in
-	// case we are returning ERR_CONN in tcpRecvFn.
-	//
-	// XXX: always copy since the address might got moved to other location during GC
-
-	// PBUF_POOL  pbuf payload refers to RAM. This one comes from a pool and should be used for RX.
-	// Payload can be chained (scatter-gather RX) but like PBUF_RAM, struct pbuf and its payload are allocated in one piece of contiguous memory
-	// (so the first payload byte can be calculated from struct pbuf). Don't use this for TX, if the pool becomes empty e.g. because of TCP queuing,
-	// you are unable to receive TCP acks!
-
-	buf = C.pbuf_alloc(C.PBUF_RAW, C.u16_t(pktLen), C.PBUF_POOL)
-	newBuf = buf
-	defer func(pb *C.struct_pbuf, err *C.err_t) {
-		if pb != nil && *err != C.ERR_OK {
-			lwipMutex.Lock()
-			log.Infof("lwip Input() pbuf_free(deferred func call)")
-			C.pbuf_free(pb)
-			pb = nil
-			lwipMutex.Unlock()
-		}
-	}(newBuf, &ierr)
-	if newBuf == nil {
-		log.Errorf("lwip Input() pbuf_alloc returns NULL")
-		return 0, errors.New("lwip Input() pbuf_alloc returns NULL")
+	var b InputBuffer
+	if err := b.load(pkt); err != nil {
+		return 0, err
 	}
-	for remaining > 0 {
-		if remaining > int(newBuf.tot_len) {
-			singleCopyLen = int(newBuf.tot_len)
-		} else {
-			singleCopyLen = remaining
-		}
-		r := C.pbuf_take_at(newBuf, unsafe.Pointer(&pkt[startPos]), C.u16_t(singleCopyLen), C.u16_t(startPos))
-		if r == C.ERR_MEM {
-			log.Errorf("Input pbuf_take_at this should not happen")
-			return 0, errors.New("Input pbuf_take_at this should not happen")
-		}
-		startPos += singleCopyLen
-		remaining -= singleCopyLen
+	return inputBuffer(&b, len(pkt))
+}
+
+// load copies pkt into b. lwIP may keep a packet after input returns, e.g.
+// in reassembly queues, so it can not refer to Go memory.
+func (b *InputBuffer) load(pkt []byte) error {
+	pktLen := len(pkt)
+	if pktLen > 0xffff {
+		return errors.New("IP packet too large")
 	}
-	newBuf = C.pbuf_coalesce(buf, C.PBUF_RAW)
-	if newBuf.next != nil {
-		log.Errorf("lwip Input() pbuf_coalesce failed")
-		return 0, errors.New("lwip Input() pbuf_coalesce failed")
+	b.refill(pktLen)
+	if b.b == nil {
+		stats.packetsUp.Add(1)
+		stats.bytesUp.Add(uint64(pktLen))
+		stats.dropPbufAlloc.Add(1)
+		log.Errorf("lwip Input() input buffer allocation failed")
+		return errors.New("lwip Input() input buffer allocation failed")
 	}
+	copy(b.data, pkt)
+	return nil
+}
+
+// inputBuffer passes the first n bytes of b to lwIP, the memory of b is
+// handed over in any case.
+func inputBuffer(b *InputBuffer, n int) (ret int, err error) {
+	lwipCall(func() {
+		ret, err = lwipInput(b, n)
+	})
+	return
+}
 
-	ierr = C.input(newBuf)
-	if ierr != C.ERR_OK {
+// lwipInput is inputBuffer on the lwIP thread.
+func lwipInput(b *InputBuffer, n int) (int, error) {
+	stats.packetsUp.Add(1)
+	stats.bytesUp.Add(uint64(n))
+	if !filterPacket(DirectionIn, b.data[:n]) || handleICMPEcho(b.data[:n]) || limitTCPSyn(b.data[:n]) || holdTCPSyn(b.data[:n]) {
+		b.Release()
+		return n, nil
+	}
+	return lwipDeliver(b, n)
+}
+
+// lwipDeliver hands the first n bytes of b to lwIP without looking at them,
+// it must be called on the lwIP thread.
+func lwipDeliver(b *InputBuffer, n int) (int, error) {
+	p := b.detach(n)
+	if p == nil {
+		stats.dropPbufAlloc.Add(1)
+		log.Errorf("lwip Input() pbuf_alloced_custom returns NULL")
+		return 0, errors.New("lwip Input() pbuf_alloced_custom returns NULL")
+	}
+	if ierr := C.input(p); ierr != C.ERR_OK {
+		C.pbuf_free(p)
+		stats.dropUnhandled.Add(1)
 		log.Errorf("lwip Input() fail to input packet, packet not handled")
 		return 0, errors.New("packet not handled")
 	}
-	return pktLen, nil
+	return n, nil
 }
@@ -0,0 +1,185 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/custom -I./c/include
+#include <stdlib.h>
+#include "lwip/pbuf.h"
+
+// input_buf is a packet buffer handed to lwIP as a custom PBUF_REF pbuf,
+// the payload follows the struct.
+struct input_buf {
+	struct pbuf_custom pc;
+	struct input_buf *next;
+	u16_t cap;
+};
+
+// The free list is shared by the readers filling buffers and the lwIP
+// thread freeing pbufs, it is guarded by a spinlock.
+static struct input_buf *input_buf_free_list;
+static int input_buf_free_count;
+static char input_buf_lock;
+
+// Buffers of input_buf_pool_cap bytes are pooled, up to input_buf_pool_max
+// of them.
+static u16_t input_buf_pool_cap = 1500;
+static int input_buf_pool_max = 1024;
+
+static void
+input_buf_lock_acquire(void)
+{
+	while (__atomic_test_and_set(&input_buf_lock, __ATOMIC_ACQUIRE)) {
+	}
+}
+
+static void
+input_buf_lock_release(void)
+{
+	__atomic_clear(&input_buf_lock, __ATOMIC_RELEASE);
+}
+
+static void *
+input_buf_data(struct input_buf *b)
+{
+	return (void *)(b + 1);
+}
+
+static struct input_buf *
+input_buf_get(u16_t cap)
+{
+	struct input_buf *b = NULL;
+	input_buf_lock_acquire();
+	if (cap <= input_buf_pool_cap) {
+		b = input_buf_free_list;
+		if (b != NULL) {
+			input_buf_free_list = b->next;
+			input_buf_free_count--;
+		}
+		cap = input_buf_pool_cap;
+	}
+	input_buf_lock_release();
+	if (b != NULL) {
+		return b;
+	}
+	b = (struct input_buf *)malloc(sizeof(struct input_buf) + cap);
+	if (b != NULL) {
+		b->cap = cap;
+	}
+	return b;
+}
+
+static void
+input_buf_put(struct input_buf *b)
+{
+	input_buf_lock_acquire();
+	if (b->cap == input_buf_pool_cap && input_buf_free_count < input_buf_pool_max) {
+		b->next = input_buf_free_list;
+		input_buf_free_list = b;
+		input_buf_free_count++;
+		b = NULL;
+	}
+	input_buf_lock_release();
+	free(b);
+}
+
+// input_buf_set_pool_cap changes the size of pooled buffers, buffers of the
+// previous size are freed.
+static void
+input_buf_set_pool_cap(u16_t cap)
+{
+	struct input_buf *list;
+	input_buf_lock_acquire();
+	input_buf_pool_cap = cap;
+	list = input_buf_free_list;
+	input_buf_free_list = NULL;
+	input_buf_free_count = 0;
+	input_buf_lock_release();
+	while (list != NULL) {
+		struct input_buf *next = list->next;
+		free(list);
+		list = next;
+	}
+}
+
+static void
+input_buf_pbuf_free(struct pbuf *p)
+{
+	input_buf_put((struct input_buf *)p);
+}
+
+static struct pbuf *
+input_buf_pbuf(struct input_buf *b, u16_t len)
+{
+	struct pbuf *p;
+	b->pc.custom_free_function = input_buf_pbuf_free;
+	p = pbuf_alloced_custom(PBUF_RAW, len, PBUF_REF, &b->pc, input_buf_data(b), b->cap);
+	if (p == NULL) {
+		input_buf_put(b);
+	}
+	return p;
+}
+*/
+import "C"
+import (
+	"errors"
+	"unsafe"
+)
+
+var errInvalidBufferLength = errors.New("invalid input buffer length")
+
+// InputBuffer is a packet buffer in C memory, packets read into it are
+// handed to lwIP without being copied. An InputBuffer is not safe for
+// concurrent use.
+type InputBuffer struct {
+	b    *C.struct_input_buf
+	data []byte
+}
+
+// NewInputBuffer returns a buffer holding packets of up to the MTU of the
+// stack.
+func NewInputBuffer() *InputBuffer {
+	return &InputBuffer{}
+}
+
+// Bytes returns the memory of the buffer, a new slice must be obtained
+// after the buffer has been passed to LWIPStack.WriteBuffer. It returns nil
+// if no memory can be allocated.
+func (b *InputBuffer) Bytes() []byte {
+	if b.b == nil {
+		b.refill(int(currentMTU.Load()))
+	}
+	return b.data
+}
+
+func (b *InputBuffer) refill(size int) {
+	b.b = C.input_buf_get(C.u16_t(size))
+	if b.b == nil {
+		b.data = nil
+		return
+	}
+	b.data = unsafe.Slice((*byte)(C.input_buf_data(b.b)), int(b.b.cap))
+}
+
+// setInputBufferSize sets the size of pooled input buffers.
+func setInputBufferSize(size int) {
+	C.input_buf_set_pool_cap(C.u16_t(size))
+}
+
+// Release returns the memory of the buffer to the pool.
+func (b *InputBuffer) Release() {
+	if b.b == nil {
+		return
+	}
+	C.input_buf_put(b.b)
+	b.b = nil
+	b.data = nil
+}
+
+// detach transfers the memory of the buffer to a pbuf holding its first n
+// bytes, the pbuf returns the memory to the pool once lwIP frees it. It
+// must be called on the lwIP thread.
+func (b *InputBuffer) detach(n int) *C.struct_pbuf {
+	p := C.input_buf_pbuf(b.b, C.u16_t(n))
+	b.b = nil
+	b.data = nil
+	return p
+}
@@ -0,0 +1,196 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/custom -I./c/include
+#include "lwip/tcp.h"
+#include "lwip/priv/tcp_priv.h"
+
+static void
+tcp_pcb_count(const ip_addr_t *remote_ip, int *total, int *from)
+{
+	struct tcp_pcb *pcb;
+	for (pcb = tcp_active_pcbs; pcb != NULL; pcb = pcb->next) {
+		(*total)++;
+		if (ip_addr_cmp(&pcb->remote_ip, remote_ip)) {
+			(*from)++;
+		}
+	}
+}
+*/
+import "C"
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// sessionLimits bounds the sessions the stack admits, zero values mean no
+// limit.
+type sessionLimits struct {
+	maxTCP       int
+	maxUDP       int
+	maxPerSource int
+
+	// connRate is the rate of new sessions per second and source address,
+	// connBurst the number of sessions it may open at once.
+	connRate  float64
+	connBurst int
+}
+
+func (l *sessionLimits) enabled() bool {
+	return l.maxTCP > 0 || l.maxUDP > 0 || l.maxPerSource > 0 || l.connRate > 0
+}
+
+// maxConnBuckets is the number of sources whose rate is tracked before the
+// idle ones are forgotten.
+const maxConnBuckets = 1024
+
+var errSessionLimit = errors.New("session limit exceeded")
+
+// tokenBucket limits the rate of new sessions of a source.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the last refill, up to burst.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, float64(burst))
+	b.last = now
+}
+
+// admission tracks the sessions of every source. TCP sessions are the
+// connections lwIP holds, they are counted when needed, UDP sessions are
+// counted as they are opened and closed.
+type admission struct {
+	mu      sync.Mutex
+	udp     map[string]int
+	udpAll  int
+	buckets map[string]*tokenBucket
+}
+
+// sessions holds the admission state, like the connections it is shared by
+// every stack.
+var sessions = &admission{
+	udp:     make(map[string]int),
+	buckets: make(map[string]*tokenBucket),
+}
+
+// allow reports whether src may open a new session, n sessions of the
+// protocol and other sources of src being open. It is called with a.mu
+// held.
+func (a *admission) allow(l *sessionLimits, src string, n, max, other int) bool {
+	if max > 0 && n >= max {
+		return false
+	}
+	if l.maxPerSource > 0 && other+a.udp[src] >= l.maxPerSource {
+		return false
+	}
+	if l.connRate <= 0 {
+		return true
+	}
+	now := time.Now()
+	b, ok := a.buckets[src]
+	if !ok {
+		if len(a.buckets) >= maxConnBuckets {
+			for s, b := range a.buckets {
+				if b.refill(now, l.connRate, l.connBurst); b.tokens >= float64(l.connBurst) {
+					delete(a.buckets, s)
+				}
+			}
+		}
+		b = &tokenBucket{tokens: float64(l.connBurst), last: now}
+		a.buckets[src] = b
+	}
+	b.refill(now, l.connRate, l.connBurst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// admitTCP reports whether a connection from src may be opened, it must be
+// called on the lwIP thread.
+func (a *admission) admitTCP(l *sessionLimits, src net.IP) bool {
+	n, from := tcpSessionCount(src)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allow(l, src.String(), n, l.maxTCP, from)
+}
+
+// admitUDP reports whether a session from src may be opened and counts it
+// if so, it must be called on the lwIP thread.
+func (a *admission) admitUDP(l *sessionLimits, src net.IP) bool {
+	key := src.String()
+	var from int
+	if l.maxPerSource > 0 {
+		_, from = tcpSessionCount(src)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.allow(l, key, a.udpAll, l.maxUDP, from) {
+		return false
+	}
+	a.udp[key]++
+	a.udpAll++
+	return true
+}
+
+// releaseUDP forgets a session from src counted by admitUDP.
+func (a *admission) releaseUDP(src net.IP) {
+	key := src.String()
+	a.mu.Lock()
+	if a.udp[key]--; a.udp[key] <= 0 {
+		delete(a.udp, key)
+	}
+	a.udpAll--
+	a.mu.Unlock()
+}
+
+// tcpSessionCount returns the number of TCP connections held by lwIP or
+// being dialed and those from src, it must be called on the lwIP thread.
+func tcpSessionCount(src net.IP) (n, from int) {
+	var ip C.ip_addr_t
+	if ipAddrATON(src.String(), &ip) != nil {
+		return 0, 0
+	}
+	var total, fromSrc C.int
+	C.tcp_pcb_count(&ip, &total, &fromSrc)
+	n, from = int(total), int(fromSrc)
+	for _, d := range tcpDials {
+		// Dialed connections are passed to lwIP once connected.
+		if d.upstream == nil {
+			n++
+			if d.syn.src.IP.Equal(src) {
+				from++
+			}
+		}
+	}
+	return n, from
+}
+
+// limitTCPSyn resets the connection if pkt is a SYN opening a connection
+// beyond the limits of the stack, it reports whether the packet was
+// consumed.
+func limitTCPSyn(pkt []byte) bool {
+	l := &activeStack.opts.limits
+	if !l.enabled() {
+		return false
+	}
+	syn, ok := parseTCPSyn(pkt)
+	if !ok {
+		return false
+	}
+	if _, ok := tcpDials[tcpDialId{src: syn.src.String(), dst: syn.dst.String()}]; ok || tcpPCBActive(syn.src, syn.dst) {
+		// A retransmission.
+		return false
+	}
+	if sessions.admitTCP(l, syn.src.IP) {
+		return false
+	}
+	stats.dropTCPLimited.Add(1)
+	outputPacket(tcpReset(syn.pkt, &syn.info))
+	return true
+}
@@ -0,0 +1,61 @@
+package core
+
+/*
+static __thread int on_lwip_thread;
+
+static void
+lwip_thread_enter(void)
+{
+	on_lwip_thread = 1;
+}
+
+static int
+lwip_thread_current(void)
+{
+	return on_lwip_thread;
+}
+*/
+import "C"
+import (
+	"runtime"
+	"sync"
+)
+
+// lwIP is not thread safe, it is owned by the lwIP thread, a goroutine
+// locked to an OS thread. Packet input, timers and connection operations
+// are posted to it with lwipCall, lwIP callbacks into Go run on it as
+// well.
+
+type lwipCallReq struct {
+	f    func()
+	done chan struct{}
+}
+
+var lwipCalls = make(chan lwipCallReq, 256)
+
+var lwipDonePool = sync.Pool{
+	New: func() interface{} { return make(chan struct{}, 1) },
+}
+
+func lwipLoop() {
+	runtime.LockOSThread()
+	C.lwip_thread_enter()
+	for call := range lwipCalls {
+		call.f()
+		call.done <- struct{}{}
+	}
+}
+
+// lwipCall runs f on the lwIP thread and returns once f has returned. On
+// the lwIP thread itself, e.g. when a handler writes from within a
+// callback, f is run right away.
+func lwipCall(f func()) {
+	if C.lwip_thread_current() != 0 {
+		f()
+		return
+	}
+	done := lwipDonePool.Get().(chan struct{})
+	lwipCalls <- lwipCallReq{f: f, done: done}
+	<-done
+	lwipDonePool.Put(done)
+}
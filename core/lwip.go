@@ -40,13 +40,14 @@ udp_bind_cgo(struct udp_pcb *pcb, _Bool enableIPv6, _Bool allowLan)
 */
 import "C"
 import (
+	"context"
 	"errors"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/ruilisi/go-tun2socks/common/log"
-	syncex "github.com/ruilisi/go-tun2socks/component/go-syncex"
 	"github.com/ruilisi/go-tun2socks/component/runner"
 )
 
@@ -62,14 +63,46 @@ const (
 
 type LWIPStack interface {
 	Write([]byte) (int, error)
+
+	// WriteBuffer inputs the first n bytes of b without copying them, the
+	// memory of b is handed over to the stack and b is refilled on its
+	// next use.
+	WriteBuffer(b *InputBuffer, n int) (int, error)
+
+	// WriteBatch inputs pkts under a single lock acquisition and returns
+	// the number of packets input. If some packets are rejected the error
+	// is a BatchError telling which.
+	WriteBatch(pkts [][]byte) (int, error)
+
+	// WriteBufferBatch is the batched form of WriteBuffer, the first
+	// sizes[i] bytes of bufs[i] are input.
+	WriteBufferBatch(bufs []*InputBuffer, sizes []int) (int, error)
+
 	Close(LWIPSysCheckTimeoutsClosingType) error
 	RestartTimeouts()
 	GetRunningStatus() bool
 	StartTimeouts()
 	StopTimeouts(LWIPSysCheckTimeoutsClosingType)
+
+	// Sessions returns a snapshot of all active TCP and UDP sessions.
+	Sessions() []SessionInfo
+
+	// CloseSession gracefully closes the session with the given ID.
+	CloseSession(id uint64) error
+
+	// AbortSession aborts the session with the given ID.
+	AbortSession(id uint64) error
+
+	// Stats returns a snapshot of the counters of the whole stack, the
+	// counters of each session are returned by Sessions.
+	Stats() Stats
+
+	// MTU returns the MTU of the TUN device the stack was created with,
+	// packets read from TUN fit in buffers of this size.
+	MTU() int
 }
 
-var lwipSysCheckTimeoutsLock = &syncex.RecursiveMutex{}
+var lwipSysCheckTimeoutsLock sync.Mutex
 
 type lwipStack struct {
 	IsRunning                     *int32
@@ -78,16 +111,35 @@ type lwipStack struct {
 	LWIPSysCheckTimeoutsTask      *runner.Task
 	LWIPSysStopCheckTimeoutsTimer *time.Timer
 	enableIPv6                    bool
+
+	opts stackOptions
+
+	// ctx is cancelled when the stack is closed, connection contexts are
+	// derived from it.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// activeStack is the most recently created stack. lwIP keeps its state in
+// globals, so connections accepted by lwIP always belong to it.
+var activeStack *lwipStack
+
 const (
 	STOP    int32 = 0
 	RUNNING int32 = 1
 )
 
-func lwipStackSetupInternal(enableIPv6 bool, allowLan bool) *lwipStack {
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
+func lwipStackSetupInternal(enableIPv6 bool, allowLan bool, opts stackOptions) *lwipStack {
+	var stack *lwipStack
+	lwipCall(func() {
+		stack = lwipStackSetup(enableIPv6, allowLan, opts)
+	})
+	return stack
+}
+
+// lwipStackSetup creates the listening pcbs of a stack, it must be called
+// on the lwIP thread.
+func lwipStackSetup(enableIPv6 bool, allowLan bool, opts stackOptions) *lwipStack {
 	var tcpPCB *C.struct_tcp_pcb
 	var udpPCB *C.struct_udp_pcb
 	var err C.err_t
@@ -140,29 +192,74 @@ func lwipStackSetupInternal(enableIPv6 bool, allowLan bool) *lwipStack {
 
 	setUDPRecvCallback(udpPCB, nil)
 	var run int32
+	ctx, cancel := context.WithCancel(context.Background())
+	setMTU(opts.mtu)
+	if opts.clock != nil {
+		useVirtualClock()
+	} else {
+		useSystemClock()
+	}
 	stack := &lwipStack{
 		tpcb:       tcpPCB,
 		upcb:       udpPCB,
 		enableIPv6: enableIPv6,
 		IsRunning:  &run,
+		opts:       opts,
+		ctx:        ctx,
+		cancel:     cancel,
 	}
+	activeStack = stack
+	packetFilters.Store(&stack.opts.filters)
 	return stack
 }
 
 func NewLWIPStack(enableIPv6 bool, allowLan bool) LWIPStack {
-	stack := lwipStackSetupInternal(enableIPv6, allowLan)
+	stack, _ := NewLWIPStackWithOptions(enableIPv6, allowLan)
+	return stack
+}
+
+// NewLWIPStackWithOptions is like NewLWIPStack but applies opts to the
+// stack, an error is returned if any option is invalid.
+func NewLWIPStackWithOptions(enableIPv6 bool, allowLan bool, opts ...StackOption) (LWIPStack, error) {
+	o := defaultStackOptions()
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	stack := lwipStackSetupInternal(enableIPv6, allowLan, o)
 	atomic.StoreInt32(stack.IsRunning, RUNNING)
 	stack.StartTimeouts()
-	return stack
+	go stack.expireUDPConns()
+	return stack, nil
+}
+
+// newConnContext returns a context for a new connection, it is cancelled
+// when the stack is closed.
+func (s *lwipStack) newConnContext() (context.Context, context.CancelCauseFunc) {
+	return context.WithCancelCause(s.ctx)
+}
+
+// guardDial cancels a connection context with context.DeadlineExceeded if
+// the returned stop function is not called within the dial timeout.
+func (s *lwipStack) guardDial(cancel context.CancelCauseFunc) (stop func()) {
+	if s.opts.dialTimeout <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(s.opts.dialTimeout, func() {
+		cancel(context.DeadlineExceeded)
+	})
+	return func() { t.Stop() }
 }
 
+// doStartTimeouts is called with lwipSysCheckTimeoutsLock held.
 func (s *lwipStack) doStartTimeouts() {
 	task := runner.Go(func(shouldStop runner.S) error {
 		zeroErr := errors.New("no error")
 		for {
-			lwipMutex.Lock()
-			C.sys_check_timeouts()
-			lwipMutex.Unlock()
+			lwipCall(func() {
+				C.sys_check_timeouts()
+			})
 
 			time.Sleep(CHECK_TIMEOUTS_INTERVAL * time.Millisecond)
 			if shouldStop() {
@@ -172,13 +269,15 @@ func (s *lwipStack) doStartTimeouts() {
 		log.Infof("got sys_check_timeouts stop signal")
 		return zeroErr
 	})
-	lwipSysCheckTimeoutsLock.Lock()
-	defer lwipSysCheckTimeoutsLock.Unlock()
 	s.LWIPSysCheckTimeoutsTask = task
 	log.Infof("sys_check_timeouts started")
 }
 
 func (s *lwipStack) StartTimeouts() {
+	if s.opts.clock != nil {
+		// Timers run when the clock is advanced.
+		return
+	}
 	if s.GetRunningStatus() {
 		lwipSysCheckTimeoutsLock.Lock()
 		defer lwipSysCheckTimeoutsLock.Unlock()
@@ -198,6 +297,9 @@ func (s *lwipStack) StartTimeouts() {
 }
 
 func (s *lwipStack) StopTimeouts(t LWIPSysCheckTimeoutsClosingType) {
+	if s.opts.clock != nil {
+		return
+	}
 	if t == DELAY {
 		if s.LWIPSysCheckTimeoutsTask != nil && s.LWIPSysCheckTimeoutsTask.Running() {
 			log.Infof("StopTimeouts: schedule stop timer at %v", time.Now())
@@ -234,6 +336,10 @@ func (s *lwipStack) StopTimeouts(t LWIPSysCheckTimeoutsClosingType) {
 	}
 }
 
+func (s *lwipStack) MTU() int {
+	return s.opts.mtu
+}
+
 func (s *lwipStack) GetRunningStatus() bool {
 	r := atomic.LoadInt32(s.IsRunning)
 	return r == RUNNING
@@ -250,23 +356,68 @@ func (s *lwipStack) Write(data []byte) (int, error) {
 	return 0, errors.New("stack closed")
 }
 
-func (s *lwipStack) RestartTimeouts() {
-	C.sys_restart_timeouts()
+func (s *lwipStack) WriteBuffer(b *InputBuffer, n int) (int, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if n < 0 || n > len(b.data) {
+		return 0, errInvalidBufferLength
+	}
+	if s.GetRunningStatus() {
+		n, err := inputBuffer(b, n)
+		if err != nil {
+			log.Errorf("lwip input err: %v", err)
+		}
+		return n, err
+	}
+	return 0, errors.New("stack closed")
 }
 
-func (s *lwipStack) closeInternal() {
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
+func (s *lwipStack) WriteBatch(pkts [][]byte) (int, error) {
+	if s.GetRunningStatus() {
+		n, err := inputBatch(pkts)
+		if err != nil {
+			log.Errorf("lwip input err: %v", err)
+		}
+		return n, err
+	}
+	return 0, errors.New("stack closed")
+}
 
-	err := C.tcp_close(s.tpcb)
-	if err != C.ERR_OK {
-		C.tcp_abort(s.tpcb)
+func (s *lwipStack) WriteBufferBatch(bufs []*InputBuffer, sizes []int) (int, error) {
+	if len(bufs) != len(sizes) {
+		return 0, errors.New("mismatched buffer and size count")
+	}
+	if s.GetRunningStatus() {
+		n, err := inputBufferBatch(bufs, sizes)
+		if err != nil {
+			log.Errorf("lwip input err: %v", err)
+		}
+		return n, err
 	}
-	C.udp_remove(s.upcb)
+	return 0, errors.New("stack closed")
+}
+
+func (s *lwipStack) RestartTimeouts() {
+	lwipCall(func() {
+		C.sys_restart_timeouts()
+	})
+}
+
+func (s *lwipStack) closeInternal() {
+	lwipCall(func() {
+		err := C.tcp_close(s.tpcb)
+		if err != C.ERR_OK {
+			C.tcp_abort(s.tpcb)
+		}
+		C.udp_remove(s.upcb)
+	})
 }
 
 func (s *lwipStack) Close(t LWIPSysCheckTimeoutsClosingType) error {
 	if s.GetRunningStatus() {
+		s.cancel()
+		lwipCall(closeTCPDials)
 		tcpConns.Range(func(c, _ interface{}) bool {
 			c.(*tcpConn).Abort()
 			return true
@@ -278,6 +429,13 @@ func (s *lwipStack) Close(t LWIPSysCheckTimeoutsClosingType) error {
 		})
 
 		s.closeInternal()
+		if s.opts.clock != nil {
+			lwipCall(func() {
+				if activeStack == s {
+					useSystemClock()
+				}
+			})
+		}
 		atomic.StoreInt32(s.IsRunning, STOP)
 	}
 
@@ -286,10 +444,31 @@ func (s *lwipStack) Close(t LWIPSysCheckTimeoutsClosingType) error {
 }
 
 const (
+	// MTU is the default MTU of the TUN device.
 	MTU = 1500
+
+	// MinMTU and MaxMTU bound the MTU of the TUN device, MinMTU is the
+	// minimum link MTU of IPv6.
+	MinMTU = 1280
+	MaxMTU = 65535
 )
 
+// currentMTU is the MTU of the active stack.
+var currentMTU atomic.Int32
+
+// setMTU sets the MTU of the netif and the size of input buffers, it must
+// be called on the lwIP thread.
+func setMTU(mtu int) {
+	C.netif_list.mtu = C.u16_t(mtu)
+	C.netif_list.mtu6 = C.u16_t(mtu)
+	setInputBufferSize(mtu)
+	currentMTU.Store(int32(mtu))
+}
+
 func init() {
-	lwipInit()
-	C.netif_list.mtu = MTU
+	go lwipLoop()
+	lwipCall(func() {
+		lwipInit()
+		setMTU(MTU)
+	})
 }
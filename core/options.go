@@ -0,0 +1,231 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type stackOptions struct {
+	// dialTimeout bounds the time a handler may spend in Handle or
+	// Connect, zero means no limit.
+	dialTimeout time.Duration
+
+	// mtu is the MTU of the TUN device.
+	mtu int
+
+	// udpIdleTimeout expires UDP sessions without traffic in either
+	// direction, udpPortIdleTimeouts overrides it by destination port.
+	// Zero disables the expiry.
+	udpIdleTimeout      time.Duration
+	udpPortIdleTimeouts map[int]time.Duration
+
+	// udpNATMode selects how UDP sessions are keyed and filtered.
+	udpNATMode UDPNATMode
+
+	// connectBeforeAccept holds SYNs until the TCP handler connected the
+	// remote host.
+	connectBeforeAccept bool
+
+	// limits bounds the sessions the stack admits.
+	limits sessionLimits
+
+	// filters inspect the packets entering and leaving the stack.
+	filters PacketFilterChain
+
+	// clock drives the lwIP timers in place of the system clock.
+	clock *VirtualClock
+}
+
+// DefaultUDPIdleTimeout is the time after which idle UDP sessions are
+// closed, unless a shorter default applies to their destination port.
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+// defaultUDPPortIdleTimeouts holds the idle timeouts of destination ports
+// usually seeing a single exchange.
+var defaultUDPPortIdleTimeouts = map[int]time.Duration{
+	53:  10 * time.Second, // DNS
+	123: 10 * time.Second, // NTP
+}
+
+func defaultStackOptions() stackOptions {
+	o := stackOptions{
+		mtu:                 MTU,
+		udpIdleTimeout:      DefaultUDPIdleTimeout,
+		udpPortIdleTimeouts: make(map[int]time.Duration, len(defaultUDPPortIdleTimeouts)),
+	}
+	for port, d := range defaultUDPPortIdleTimeouts {
+		o.udpPortIdleTimeouts[port] = d
+	}
+	return o
+}
+
+// StackOption configures a stack created by NewLWIPStackWithOptions.
+type StackOption func(*stackOptions) error
+
+// WithDialTimeout sets the maximum time TCP and UDP handlers may spend
+// connecting the remote host, the connection context is cancelled with
+// context.DeadlineExceeded as its cause once it exceeds. Zero disables the
+// timeout.
+func WithDialTimeout(d time.Duration) StackOption {
+	return func(o *stackOptions) error {
+		if d < 0 {
+			return errors.New("negative dial timeout")
+		}
+		o.dialTimeout = d
+		return nil
+	}
+}
+
+// WithMTU sets the MTU of the TUN device, it must be within MinMTU and
+// MaxMTU. The MSS advertised to local clients is derived from it, capped
+// to the MSS of 9000 bytes jumbo frames lwIP is built with.
+func WithMTU(mtu int) StackOption {
+	return func(o *stackOptions) error {
+		if mtu < MinMTU || mtu > MaxMTU {
+			return fmt.Errorf("MTU %d out of range [%d, %d]", mtu, MinMTU, MaxMTU)
+		}
+		o.mtu = mtu
+		return nil
+	}
+}
+
+// WithUDPIdleTimeout sets the time after which UDP sessions without traffic
+// are closed, the handler is notified through UDPConnCloser. Shorter
+// defaults apply to DNS and NTP, see WithUDPPortIdleTimeout. Zero disables
+// the expiry of sessions to other ports.
+func WithUDPIdleTimeout(d time.Duration) StackOption {
+	return func(o *stackOptions) error {
+		if d < 0 {
+			return errors.New("negative UDP idle timeout")
+		}
+		o.udpIdleTimeout = d
+		return nil
+	}
+}
+
+// WithUDPPortIdleTimeout sets the idle timeout of UDP sessions to the given
+// destination port, overriding WithUDPIdleTimeout. Zero disables their
+// expiry.
+func WithUDPPortIdleTimeout(port int, d time.Duration) StackOption {
+	return func(o *stackOptions) error {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		if d < 0 {
+			return errors.New("negative UDP idle timeout")
+		}
+		o.udpPortIdleTimeouts[port] = d
+		return nil
+	}
+}
+
+// WithUDPNATMode sets how UDP datagrams are grouped into sessions and which
+// replies are let through, UDPNATFullCone by default. With the restricted
+// modes handlers must write replies from the address the client sent to.
+func WithUDPNATMode(mode UDPNATMode) StackOption {
+	return func(o *stackOptions) error {
+		if mode < UDPNATFullCone || mode > UDPNATSymmetric {
+			return fmt.Errorf("invalid UDP NAT mode %d", int(mode))
+		}
+		o.udpNATMode = mode
+		return nil
+	}
+}
+
+// WithConnectBeforeAccept makes the stack answer the SYN of a client only
+// once the TCP handler connected the remote host, so that clients see
+// whether it is reachable. It requires a handler implementing
+// TCPConnDialer, other handlers keep accepting connections first. When
+// DialContext fails the client receives a RST if the error is
+// syscall.ECONNREFUSED, an ICMP network or host unreachable for
+// syscall.ENETUNREACH, syscall.EHOSTUNREACH and timeouts, an ICMP
+// administratively prohibited for syscall.EACCES and syscall.EPERM and a
+// RST otherwise.
+func WithConnectBeforeAccept() StackOption {
+	return func(o *stackOptions) error {
+		o.connectBeforeAccept = true
+		return nil
+	}
+}
+
+// WithMaxTCPSessions limits the number of TCP connections, half-open ones
+// included, the SYNs of further connections are answered with a RST. Zero
+// means no limit.
+func WithMaxTCPSessions(n int) StackOption {
+	return func(o *stackOptions) error {
+		if n < 0 {
+			return errors.New("negative TCP session limit")
+		}
+		o.limits.maxTCP = n
+		return nil
+	}
+}
+
+// WithMaxUDPSessions limits the number of UDP sessions, the datagrams of
+// further sessions are dropped. Zero means no limit.
+func WithMaxUDPSessions(n int) StackOption {
+	return func(o *stackOptions) error {
+		if n < 0 {
+			return errors.New("negative UDP session limit")
+		}
+		o.limits.maxUDP = n
+		return nil
+	}
+}
+
+// WithMaxSessionsPerSource limits the number of TCP and UDP sessions of
+// each source address. Zero means no limit.
+func WithMaxSessionsPerSource(n int) StackOption {
+	return func(o *stackOptions) error {
+		if n < 0 {
+			return errors.New("negative per-source session limit")
+		}
+		o.limits.maxPerSource = n
+		return nil
+	}
+}
+
+// WithConnRateLimit limits the rate at which each source address opens
+// TCP connections and UDP sessions to rate per second, with bursts of up
+// to burst sessions. Zero rate means no limit.
+func WithConnRateLimit(rate float64, burst int) StackOption {
+	return func(o *stackOptions) error {
+		if rate < 0 {
+			return errors.New("negative connection rate")
+		}
+		if rate > 0 && burst < 1 {
+			return fmt.Errorf("connection burst %d less than 1", burst)
+		}
+		o.limits.connRate = rate
+		o.limits.connBurst = burst
+		return nil
+	}
+}
+
+// WithPacketFilter adds f to the filters seeing the packets read from TUN
+// before lwIP and the packets written to TUN, including those built by the
+// stack itself. Filters run in the order they are added.
+func WithPacketFilter(f PacketFilter) StackOption {
+	return func(o *stackOptions) error {
+		if f == nil {
+			return errors.New("nil packet filter")
+		}
+		o.filters = append(o.filters, f)
+		return nil
+	}
+}
+
+// WithVirtualClock drives the lwIP timers of the stack with c instead of
+// the system clock, they only run when c is advanced. lwIP time is global,
+// so the clock applies until the stack is closed or another stack is
+// created.
+func WithVirtualClock(c *VirtualClock) StackOption {
+	return func(o *stackOptions) error {
+		if c == nil {
+			return errors.New("nil clock")
+		}
+		o.clock = c
+		return nil
+	}
+}
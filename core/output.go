@@ -30,17 +30,94 @@ set_output()
 import "C"
 import (
 	"errors"
-)
+	"sync/atomic"
 
-var OutputFn func([]byte) (int, error)
+	"github.com/ruilisi/go-tun2socks/component/pool"
+)
 
+// RegisterOutputFn registers fn to write the packets output by the stack
+// to TUN.
 func RegisterOutputFn(fn func([]byte) (int, error)) {
-	OutputFn = fn
+	outputFn.Store(&fn)
+	C.set_output()
+}
+
+// RegisterOutputBatchFn registers fn to write output packets in batches, it
+// is called instead of the function registered with RegisterOutputFn with
+// the packets pending at once, letting the TUN device write them together.
+// A nil fn goes back to writing packets one by one.
+func RegisterOutputBatchFn(fn func([][]byte) (int, error)) {
+	if fn == nil {
+		outputBatchFn.Store(nil)
+	} else {
+		outputBatchFn.Store(&fn)
+	}
 	C.set_output()
 }
 
+// outputFn and outputBatchFn hold the registered output functions, they
+// are read by outputLoop while new ones may be registered. They replace the
+// exported OutputFn variable, assigning which would race with outputLoop.
+var (
+	outputFn      atomic.Pointer[func([]byte) (int, error)]
+	outputBatchFn atomic.Pointer[func([][]byte) (int, error)]
+)
+
+// Maximum number of packets passed to the batch output function at once.
+const maxOutputBatch = 64
+
+// outputQueue holds packets output by lwIP, and those built outside of it,
+// until they are written to TUN, in order, by outputLoop.
+var outputQueue = make(chan []byte, 512)
+
+func outputLoop() {
+	batch := make([][]byte, 0, maxOutputBatch)
+	for buf := range outputQueue {
+		if !filterPacket(DirectionOut, buf) {
+			pool.FreeBytes(buf)
+			continue
+		}
+		batchFn := outputBatchFn.Load()
+		if batchFn == nil {
+			if _, err := (*outputFn.Load())(buf); err == nil {
+				stats.packetsDown.Add(1)
+				stats.bytesDown.Add(uint64(len(buf)))
+			}
+
+			// Return buffer to pool
+			pool.FreeBytes(buf)
+			continue
+		}
+
+		batch = append(batch[:0], buf)
+	drain:
+		for len(batch) < maxOutputBatch {
+			select {
+			case buf = <-outputQueue:
+				if !filterPacket(DirectionOut, buf) {
+					pool.FreeBytes(buf)
+					continue
+				}
+				batch = append(batch, buf)
+			default:
+				break drain
+			}
+		}
+		// The packets before n were written.
+		n, _ := (*batchFn)(batch)
+		for i, buf := range batch {
+			if i < n {
+				stats.packetsDown.Add(1)
+				stats.bytesDown.Add(uint64(len(buf)))
+			}
+			pool.FreeBytes(buf)
+		}
+	}
+}
+
 func init() {
-	OutputFn = func(data []byte) (int, error) {
+	RegisterOutputFn(func(data []byte) (int, error) {
 		return 0, errors.New("output function not set")
-	}
+	})
+	go outputLoop()
 }
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Helpers building IP packets that are written to TUN directly, bypassing
+// lwIP.
+
+const defaultTTL = 64
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+
+	icmpv4DestUnreachable = 3
+	icmpv6DestUnreachable = 1
+)
+
+func checksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeaderSum(src, dst net.IP, proto byte, length int) uint32 {
+	sum := checksum(0, src)
+	sum = checksum(sum, dst)
+	return sum + uint32(proto) + uint32(length)
+}
+
+// buildIPPacket wraps payload into an IPv4 or IPv6 packet depending on the
+// address family of src and dst.
+func buildIPPacket(src, dst net.IP, proto byte, payload []byte) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pkt := make([]byte, 20+len(payload))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[8] = defaultTTL
+		pkt[9] = proto
+		copy(pkt[12:16], src4)
+		copy(pkt[16:20], dst4)
+		binary.BigEndian.PutUint16(pkt[10:], foldChecksum(checksum(0, pkt[:20])))
+		copy(pkt[20:], payload)
+		return pkt
+	}
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(payload)))
+	pkt[6] = proto
+	pkt[7] = defaultTTL
+	copy(pkt[8:24], src.To16())
+	copy(pkt[24:40], dst.To16())
+	copy(pkt[40:], payload)
+	return pkt
+}
+
+// tcpReset builds a RST answering the TCP segment pkt, as if it was sent by
+// its destination.
+func tcpReset(pkt []byte, info *PacketInfo) []byte {
+	tcp := pkt[info.hdrLen:info.length]
+	seg := make([]byte, 20)
+	copy(seg[0:], tcp[2:4])
+	copy(seg[2:], tcp[0:2])
+	if info.TCPFlags&tcpFlagACK != 0 {
+		copy(seg[4:], tcp[8:12])
+		seg[13] = tcpFlagRST
+	} else {
+		n := max(len(tcp)-int(tcp[12]>>4)*4, 0)
+		if info.TCPFlags&tcpFlagSYN != 0 {
+			n++
+		}
+		if info.TCPFlags&tcpFlagFIN != 0 {
+			n++
+		}
+		binary.BigEndian.PutUint32(seg[8:], binary.BigEndian.Uint32(tcp[4:])+uint32(n))
+		seg[13] = tcpFlagRST | tcpFlagACK
+	}
+	seg[12] = 5 << 4
+	sum := pseudoHeaderSum(info.Dst, info.Src, proto_tcp, len(seg))
+	binary.BigEndian.PutUint16(seg[16:], foldChecksum(checksum(sum, seg)))
+	return buildIPPacket(info.Dst, info.Src, proto_tcp, seg)
+}
+
+// icmpUnreachable builds an ICMP or ICMPv6 destination unreachable with
+// code answering pkt, as if it was sent by its destination.
+func icmpUnreachable(pkt []byte, info *PacketInfo, code byte) []byte {
+	if info.Version == ipv6 {
+		// As much of the packet as fits in the minimum MTU.
+		quote := pkt[:min(info.length, MinMTU-40-8)]
+		msg := make([]byte, 8+len(quote))
+		msg[0] = icmpv6DestUnreachable
+		msg[1] = code
+		copy(msg[8:], quote)
+		sum := pseudoHeaderSum(info.Dst, info.Src, proto_icmpv6, len(msg))
+		binary.BigEndian.PutUint16(msg[2:], foldChecksum(checksum(sum, msg)))
+		return buildIPPacket(info.Dst, info.Src, proto_icmpv6, msg)
+	}
+	// The IP header and the first 8 bytes of the payload.
+	quote := pkt[:min(info.hdrLen+8, info.length)]
+	msg := make([]byte, 8+len(quote))
+	msg[0] = icmpv4DestUnreachable
+	msg[1] = code
+	copy(msg[8:], quote)
+	binary.BigEndian.PutUint16(msg[2:], foldChecksum(checksum(0, msg)))
+	return buildIPPacket(info.Dst, info.Src, proto_icmp, msg)
+}
+
+// outputPacket queues a packet built outside of lwIP behind those output by
+// lwIP, it must not be modified afterwards.
+func outputPacket(pkt []byte) {
+	outputQueue <- pkt
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/djherbis/buffer"
+)
+
+// pipeDeadline is an abstraction for handling timeouts, it's the same
+// mechanism net.Pipe uses in the standard library.
+type pipeDeadline struct {
+	mu     sync.Mutex // Guards timer and cancel
+	timer  *time.Timer
+	cancel chan struct{} // Must be non-nil
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out.
+// A timeout event is signaled by closing the channel returned by wait.
+// Once a timeout has occurred, the deadline can be refreshed by specifying a
+// t value in the future.
+//
+// A zero value for t prevents timeout.
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	// Time is zero, then there is no deadline.
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// Time in the future, setup a timer to cancel in the future.
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	// Time in the past, so close immediately.
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// pipe is a buffered pipe connecting lwIP (writer) to the handler (reader).
+// Writes block until all data is buffered, reads block until there is data
+// to read, the writing side is closed or the read deadline exceeds.
+type pipe struct {
+	mu  sync.Mutex
+	buf buffer.Buffer
+
+	// rdReady is signaled when data is written or any side is closed,
+	// wrReady is signaled when data is consumed.
+	rdReady chan struct{}
+	wrReady chan struct{}
+
+	rclosed bool
+	wclosed bool
+
+	readDeadline pipeDeadline
+}
+
+func newPipe(size int64) *pipe {
+	return &pipe{
+		buf:          buffer.New(size),
+		rdReady:      make(chan struct{}, 1),
+		wrReady:      make(chan struct{}, 1),
+		readDeadline: makePipeDeadline(),
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	for {
+		if isClosedChan(p.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		p.mu.Lock()
+		if p.rclosed {
+			p.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if p.buf.Len() > 0 {
+			n, err := p.buf.Read(b)
+			p.mu.Unlock()
+			notify(p.wrReady)
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if p.wclosed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.rdReady:
+		case <-p.readDeadline.wait():
+		}
+	}
+}
+
+func (p *pipe) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		p.mu.Lock()
+		if p.rclosed || p.wclosed {
+			p.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if gap := buffer.Gap(p.buf); gap > 0 {
+			end := len(b)
+			if int64(end-written) > gap {
+				end = written + int(gap)
+			}
+			n, err := p.buf.Write(b[written:end])
+			written += n
+			p.mu.Unlock()
+			notify(p.rdReady)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		p.mu.Unlock()
+		<-p.wrReady
+	}
+	return written, nil
+}
+
+// CloseRead closes the reading side, blocked and subsequent writes return
+// io.ErrClosedPipe.
+func (p *pipe) CloseRead() error {
+	p.mu.Lock()
+	p.rclosed = true
+	p.mu.Unlock()
+	notify(p.rdReady)
+	notify(p.wrReady)
+	return nil
+}
+
+// CloseWrite closes the writing side, reads return io.EOF after all
+// buffered data is consumed.
+func (p *pipe) CloseWrite() error {
+	p.mu.Lock()
+	p.wclosed = true
+	p.mu.Unlock()
+	notify(p.rdReady)
+	notify(p.wrReady)
+	return nil
+}
+
+func (p *pipe) SetReadDeadline(t time.Time) {
+	p.readDeadline.set(t)
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo is a snapshot of an active TCP or UDP session.
+type SessionInfo struct {
+	// ID identifies the session, it is unique during the lifetime of the
+	// process.
+	ID uint64
+
+	// Network is either "tcp" or "udp".
+	Network string
+
+	// LocalAddr is the address of the local client, RemoteAddr is the
+	// destination the client is talking to.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// State is the state of the session, e.g. "connected".
+	State string
+
+	StartTime    time.Time
+	LastActivity time.Time
+
+	// BytesUp counts bytes received from TUN, BytesDown counts bytes
+	// written to TUN.
+	BytesUp   uint64
+	BytesDown uint64
+
+	// PacketsUp and PacketsDown count datagrams for UDP sessions, for TCP
+	// sessions they count received segments and writes.
+	PacketsUp   uint64
+	PacketsDown uint64
+
+	// TCP holds the lwIP state of TCP sessions, it is nil for UDP
+	// sessions and TCP sessions lwIP is done with.
+	TCP *TCPInfo
+}
+
+var ErrSessionNotFound = errors.New("session not found")
+
+var lastSessionID atomic.Uint64
+
+// sessionCounters keeps the identity and traffic accounting of a session.
+type sessionCounters struct {
+	id           uint64
+	startTime    time.Time
+	lastActivity atomic.Int64 // in UnixNano
+	bytesUp      atomic.Uint64
+	bytesDown    atomic.Uint64
+	packetsUp    atomic.Uint64
+	packetsDown  atomic.Uint64
+}
+
+func (c *sessionCounters) init() {
+	now := time.Now()
+	c.id = lastSessionID.Add(1)
+	c.startTime = now
+	c.lastActivity.Store(now.UnixNano())
+}
+
+func (c *sessionCounters) up(n int) {
+	c.bytesUp.Add(uint64(n))
+	c.packetsUp.Add(1)
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *sessionCounters) down(n int) {
+	c.bytesDown.Add(uint64(n))
+	c.packetsDown.Add(1)
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *sessionCounters) fill(info *SessionInfo) {
+	info.ID = c.id
+	info.StartTime = c.startTime
+	info.LastActivity = time.Unix(0, c.lastActivity.Load())
+	info.BytesUp = c.bytesUp.Load()
+	info.BytesDown = c.bytesDown.Load()
+	info.PacketsUp = c.packetsUp.Load()
+	info.PacketsDown = c.packetsDown.Load()
+}
+
+// UDPConnCloser is implemented by UDP handlers keeping resources per
+// connection, Close is called when the stack closes a session on its own
+// so that the handler can release them.
+type UDPConnCloser interface {
+	Close(conn UDPConn)
+}
+
+// closeUDPConn closes conn and notifies its handler.
+func closeUDPConn(conn *udpConn) {
+	var h interface{} = conn.handler
+	if a, ok := h.(udpConnHandlerAdapter); ok {
+		h = a.UDPConnHandler
+	}
+	if closer, ok := h.(UDPConnCloser); ok {
+		// Handlers are expected to close conn on their side.
+		closer.Close(conn)
+	}
+	conn.Close()
+}
+
+func (s *lwipStack) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	lwipCall(func() {
+		tcpConns.Range(func(c, _ interface{}) bool {
+			sessions = append(sessions, c.(*tcpConn).sessionInfo())
+			return true
+		})
+	})
+	udpConns.Range(func(_ udpConnId, c UDPConn) bool {
+		sessions = append(sessions, c.(*udpConn).sessionInfo())
+		return true
+	})
+	return sessions
+}
+
+func findTCPConn(id uint64) *tcpConn {
+	var found *tcpConn
+	tcpConns.Range(func(c, _ interface{}) bool {
+		if c.(*tcpConn).id == id {
+			found = c.(*tcpConn)
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func findUDPConn(id uint64) *udpConn {
+	var found *udpConn
+	udpConns.Range(func(_ udpConnId, c UDPConn) bool {
+		if c.(*udpConn).id == id {
+			found = c.(*udpConn)
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// CloseSession gracefully closes the session with the given ID, TCP
+// sessions are closed with FIN segments.
+func (s *lwipStack) CloseSession(id uint64) error {
+	if c := findTCPConn(id); c != nil {
+		return c.Close()
+	}
+	if c := findUDPConn(id); c != nil {
+		closeUDPConn(c)
+		return nil
+	}
+	return ErrSessionNotFound
+}
+
+// AbortSession aborts the session with the given ID, TCP sessions are
+// reset with a RST segment, UDP sessions are closed.
+func (s *lwipStack) AbortSession(id uint64) error {
+	if c := findTCPConn(id); c != nil {
+		c.Abort()
+		return nil
+	}
+	if c := findUDPConn(id); c != nil {
+		closeUDPConn(c)
+		return nil
+	}
+	return ErrSessionNotFound
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the traffic counters of the stack.
+type Stats struct {
+	// BytesUp and PacketsUp count IP packets read from TUN, BytesDown and
+	// PacketsDown count IP packets written to TUN.
+	BytesUp     uint64
+	BytesDown   uint64
+	PacketsUp   uint64
+	PacketsDown uint64
+
+	Dropped DropStats
+
+	// ConnsAccepted counts connections the handler connected successfully,
+	// ConnsRefused those it failed to connect and ConnsAborted the
+	// established connections that were reset or aborted.
+	ConnsAccepted uint64
+	ConnsRefused  uint64
+	ConnsAborted  uint64
+
+	// UDPSessionsExpired counts UDP sessions closed after being idle for
+	// longer than their timeout.
+	UDPSessionsExpired uint64
+
+	// TCPSessions and UDPSessions count the active sessions, their own
+	// counters are listed by Sessions.
+	TCPSessions uint64
+	UDPSessions uint64
+}
+
+// DropStats counts dropped packets by reason.
+type DropStats struct {
+	// PbufAlloc counts packets dropped because no pbuf could be allocated.
+	PbufAlloc uint64
+
+	// UDPPendingFull counts UDP packets dropped because the queue of a
+	// connecting session was full.
+	UDPPendingFull uint64
+
+	// Unhandled counts packets lwIP refused to process.
+	Unhandled uint64
+
+	// UDPFiltered counts UDP datagrams written by handlers that the NAT
+	// filter of their session dropped.
+	UDPFiltered uint64
+
+	// TCPLimited counts SYNs reset and UDPLimited UDP datagrams dropped
+	// because they would have opened a session beyond the limits of the
+	// stack.
+	TCPLimited uint64
+	UDPLimited uint64
+
+	// Filtered counts packets dropped or rejected by packet filters, in
+	// either direction.
+	Filtered uint64
+
+	// ICMPLimited counts echo requests dropped because the ICMP handler
+	// was busy with too many of them.
+	ICMPLimited uint64
+}
+
+type stackCounters struct {
+	bytesUp     atomic.Uint64
+	bytesDown   atomic.Uint64
+	packetsUp   atomic.Uint64
+	packetsDown atomic.Uint64
+
+	dropPbufAlloc      atomic.Uint64
+	dropUDPPendingFull atomic.Uint64
+	dropUnhandled      atomic.Uint64
+	dropUDPFiltered    atomic.Uint64
+	dropTCPLimited     atomic.Uint64
+	dropUDPLimited     atomic.Uint64
+	dropFiltered       atomic.Uint64
+	dropICMPLimited    atomic.Uint64
+
+	connsAccepted atomic.Uint64
+	connsRefused  atomic.Uint64
+	connsAborted  atomic.Uint64
+
+	udpExpired atomic.Uint64
+
+	tcpSessions atomic.Int64
+}
+
+// stats holds the counters of the stack, lwIP keeps its state in globals
+// so there is only one set of them.
+var stats stackCounters
+
+func (s *lwipStack) Stats() Stats {
+	return Stats{
+		BytesUp:     stats.bytesUp.Load(),
+		BytesDown:   stats.bytesDown.Load(),
+		PacketsUp:   stats.packetsUp.Load(),
+		PacketsDown: stats.packetsDown.Load(),
+		Dropped: DropStats{
+			PbufAlloc:      stats.dropPbufAlloc.Load(),
+			UDPPendingFull: stats.dropUDPPendingFull.Load(),
+			Unhandled:      stats.dropUnhandled.Load(),
+			UDPFiltered:    stats.dropUDPFiltered.Load(),
+			TCPLimited:     stats.dropTCPLimited.Load(),
+			UDPLimited:     stats.dropUDPLimited.Load(),
+			Filtered:       stats.dropFiltered.Load(),
+			ICMPLimited:    stats.dropICMPLimited.Load(),
+		},
+		ConnsAccepted: stats.connsAccepted.Load(),
+		ConnsRefused:  stats.connsRefused.Load(),
+		ConnsAborted:  stats.connsAborted.Load(),
+
+		UDPSessionsExpired: stats.udpExpired.Load(),
+
+		TCPSessions: uint64(stats.tcpSessions.Load()),
+		UDPSessions: uint64(udpConns.Len()),
+	}
+}
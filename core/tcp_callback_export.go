@@ -28,11 +28,17 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 
 	if tcpConnHandler == nil {
 		log.Printf("must register a TCP connection handler")
+		stats.connsRefused.Add(1)
 		C.tcp_abort(newpcb)
 		return C.ERR_ABRT
 	}
 
-	if _, nerr := newTCPConn(newpcb, tcpConnHandler); nerr != nil {
+	var handler TCPConnContextHandler = tcpConnHandler
+	if d := takeTCPDial(newpcb); d != nil {
+		handler = dialedHandler{dialer: tcpConnDialer, upstream: d.upstream}
+	}
+
+	if _, nerr := newTCPConn(newpcb, handler); nerr != nil {
 		switch nerr.(*lwipError).Code {
 		case LWIP_ERR_ABRT:
 			return C.ERR_ABRT
@@ -50,12 +56,8 @@ func tcpAcceptFn(arg unsafe.Pointer, newpcb *C.struct_tcp_pcb, err C.err_t) C.er
 func tcpRecvFn(arg unsafe.Pointer, tpcb *C.struct_tcp_pcb, p *C.struct_pbuf, passedInErr C.err_t) C.err_t {
 	// Only free the pbuf when returning ERR_OK or ERR_ABRT,
 	// otherwise must not free the pbuf.
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
 	shouldFreePbuf := false
 	defer func(pb *C.struct_pbuf, shouldFreePbuf *bool) {
-		lwipMutex.Lock()
-		defer lwipMutex.Unlock()
 		if pb != nil && *shouldFreePbuf {
 			C.pbuf_free(pb)
 			pb = nil
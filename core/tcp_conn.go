@@ -30,16 +30,15 @@ void tcp_arg_cgo(struct tcp_pcb *pcb, uintptr_t ptr) {
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 	"unsafe"
-
-	"github.com/djherbis/buffer"
-	"github.com/djherbis/nio"
 )
 
 type tcpConnState uint
@@ -81,23 +80,57 @@ const (
 	tcpErrored
 )
 
+var tcpConnStateNames = [...]string{
+	tcpNewConn:       "new",
+	tcpConnecting:    "connecting",
+	tcpConnected:     "connected",
+	tcpWriteClosed:   "write_closed",
+	tcpReceiveClosed: "receive_closed",
+	tcpClosing:       "closing",
+	tcpAborting:      "aborting",
+	tcpClosed:        "closed",
+	tcpErrored:       "errored",
+}
+
+func (s tcpConnState) String() string {
+	if int(s) < len(tcpConnStateNames) {
+		return tcpConnStateNames[s]
+	}
+	return fmt.Sprintf("unknown(%d)", uint(s))
+}
+
 type tcpConn struct {
 	sync.Mutex
+	sessionCounters
+
+	pcb        *C.struct_tcp_pcb
+	handler    TCPConnContextHandler
+	remoteAddr *net.TCPAddr
+	localAddr  *net.TCPAddr
+	state      tcpConnState
+	sndPipe    *pipe
+	closeOnce  sync.Once
+	closeErr   error
+
+	// ctx is passed to the handler, it is cancelled once the connection
+	// is gone.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// sndReady is signaled when the send buffer may have room again or
+	// the connection state changes, it wakes up a blocked Write.
+	sndReady chan struct{}
 
-	pcb           *C.struct_tcp_pcb
-	handler       TCPConnHandler
-	remoteAddr    *net.TCPAddr
-	localAddr     *net.TCPAddr
-	state         tcpConnState
-	sndPipeReader *nio.PipeReader
-	sndPipeWriter *nio.PipeWriter
-	closeOnce     sync.Once
-	closeErr      error
+	writeDeadline pipeDeadline
+
+	// rcvWithheld is the part of the receive window SetReceiveWindow
+	// keeps closed, rcvDebt the part it still has to close as data is
+	// read. They are only accessed on the lwIP thread.
+	rcvWithheld int
+	rcvDebt     int
 }
 
-func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error) {
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
+func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnContextHandler) (TCPConn, error) {
 	// From badvpn-tun2socks
 	C.tcp_nagle_disable_cgo(pcb)
 	C.tcp_keepalive_settings_cgo(pcb)
@@ -107,20 +140,23 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	setTCPSentCallback(pcb)
 	setTCPErrCallback(pcb)
 
-	buf := buffer.New(0xffff)
-	pipeReader, pipeWriter := nio.Pipe(buf)
 	conn := &tcpConn{
 		pcb:           pcb,
 		handler:       handler,
 		localAddr:     ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)),
 		remoteAddr:    ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port)),
 		state:         tcpNewConn,
-		sndPipeReader: pipeReader,
-		sndPipeWriter: pipeWriter,
+		sndPipe:       newPipe(0xffff),
+		sndReady:      make(chan struct{}, 1),
+		writeDeadline: makePipeDeadline(),
 	}
+	conn.sessionCounters.init()
+	conn.ctx, conn.cancel = activeStack.newConnContext()
+	stopDialGuard := activeStack.guardDial(conn.cancel)
 
 	C.tcp_arg_cgo(pcb, C.uintptr_t(uintptr(unsafe.Pointer(conn))))
 	tcpConns.Store(conn, true)
+	stats.tcpSessions.Add(1)
 
 	// Connecting remote host could take some time, do it in another goroutine
 	// to prevent blocking the lwip thread.
@@ -128,8 +164,14 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 	conn.state = tcpConnecting
 	conn.Unlock()
 	go func() {
-		err := handler.Handle(TCPConn(conn), conn.remoteAddr)
+		err := handler.HandleContext(conn.ctx, TCPConn(conn), conn.remoteAddr)
+		stopDialGuard()
+		if err == nil && conn.ctx.Err() != nil {
+			// Aborted or timed out while the handler was connecting.
+			err = context.Cause(conn.ctx)
+		}
 		if err != nil {
+			stats.connsRefused.Add(1)
 			conn.Abort()
 		} else {
 			conn.Lock()
@@ -139,12 +181,28 @@ func newTCPConn(pcb *C.struct_tcp_pcb, handler TCPConnHandler) (TCPConn, error)
 			}
 			conn.state = tcpConnected
 			conn.Unlock()
+			stats.connsAccepted.Add(1)
 		}
 	}()
 
 	return conn, NewLWIPError(LWIP_ERR_OK)
 }
 
+// sessionInfo must be called on the lwIP thread.
+func (conn *tcpConn) sessionInfo() SessionInfo {
+	info := SessionInfo{
+		Network:    "tcp",
+		LocalAddr:  conn.localAddr,
+		RemoteAddr: conn.remoteAddr,
+		TCP:        conn.tcpInfo(),
+	}
+	conn.Lock()
+	info.State = conn.state.String()
+	conn.Unlock()
+	conn.fill(&info)
+	return info
+}
+
 func (conn *tcpConn) RemoteAddr() net.Addr {
 	return conn.remoteAddr
 }
@@ -153,13 +211,25 @@ func (conn *tcpConn) LocalAddr() net.Addr {
 	return conn.localAddr
 }
 
+// SetDeadline sets both the read and write deadlines.
 func (conn *tcpConn) SetDeadline(t time.Time) error {
+	conn.sndPipe.SetReadDeadline(t)
+	conn.writeDeadline.set(t)
 	return nil
 }
+
+// SetReadDeadline sets the deadline for Read calls, a blocked Read returns
+// os.ErrDeadlineExceeded once the deadline passes.
 func (conn *tcpConn) SetReadDeadline(t time.Time) error {
+	conn.sndPipe.SetReadDeadline(t)
 	return nil
 }
+
+// SetWriteDeadline sets the deadline for Write calls, a Write waiting for
+// room in the lwIP send buffer returns os.ErrDeadlineExceeded once the
+// deadline passes.
 func (conn *tcpConn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
 	return nil
 }
 
@@ -190,73 +260,91 @@ func (conn *tcpConn) receiveCheck() error {
 	default:
 		panic("unexpected error")
 	}
-	return nil
 }
 
 func (conn *tcpConn) Receive(data []byte) error {
 	if err := conn.receiveCheck(); err != nil {
 		return err
 	}
-	_, err := conn.sndPipeWriter.Write(data)
+	_, err := conn.sndPipe.Write(data)
 	if err != nil {
 		return NewLWIPError(LWIP_ERR_CLSD)
 	}
+	conn.up(len(data))
 	return NewLWIPError(LWIP_ERR_OK)
 }
 
 func (conn *tcpConn) Read(data []byte) (int, error) {
 	conn.Lock()
-	if conn.state == tcpReceiveClosed {
-		conn.Unlock()
-		return 0, io.EOF
-	}
-	if conn.state >= tcpClosing {
+	if conn.state >= tcpAborting {
 		conn.Unlock()
 		return 0, io.ErrClosedPipe
 	}
 	conn.Unlock()
 
-	// Handler should get EOF.
-	n, err := conn.sndPipeReader.Read(data)
+	// Data received before the FIN segment is still buffered in the pipe,
+	// the handler gets EOF once it is drained.
+	n, err := conn.sndPipe.Read(data)
 	if err == io.ErrClosedPipe {
 		err = io.EOF
 	}
 
-	lwipMutex.Lock()
-	C.tcp_recved(conn.pcb, C.u16_t(n))
-	lwipMutex.Unlock()
+	lwipCall(func() {
+		if !conn.isClosed() {
+			conn.recved(n)
+		}
+	})
 
 	return n, err
 }
 
 // writeInternal enqueues data to snd_buf, and treats ERR_MEM returned by tcp_write not an error,
 // but instead tells the caller that data is not successfully enqueued, and should try
-// again another time. By calling this function, the lwIP thread is assumed to be already
-// locked by the caller.
+// again another time. This function must be called on the lwIP thread.
 func (conn *tcpConn) writeInternal(data []byte) (int, error) {
-	lwipMutex.Lock()
 	err := C.tcp_write(conn.pcb, unsafe.Pointer(&data[0]), C.u16_t(len(data)), C.TCP_WRITE_FLAG_COPY)
 	if err == C.ERR_OK {
-		lwipMutex.Unlock()
 		return len(data), nil
 	} else if err == C.ERR_MEM {
-		lwipMutex.Unlock()
 		return 0, nil
 	}
-	lwipMutex.Unlock()
 	return 0, fmt.Errorf("tcp_write failed (%v)", int(err))
 }
 
 func (conn *tcpConn) tcpOutputInternal() error {
-	lwipMutex.Lock()
 	err := C.tcp_output(conn.pcb)
 	if err != C.ERR_OK {
-		lwipMutex.Unlock()
 		return fmt.Errorf("tcp_output failed (%v)", int(err))
 	}
-	lwipMutex.Unlock()
 	return nil
+}
 
+// enqueue enqueues as much of data as fits in snd_buf, queued segments are
+// pushed out once all of data is enqueued or nothing could be. This function
+// must be called on the lwIP thread.
+func (conn *tcpConn) enqueue(data []byte) (int, error) {
+	if conn.isClosed() {
+		return 0, io.ErrClosedPipe
+	}
+	toWrite := len(data)
+	if sendBufLen := int(C.tcp_sndbuf_cgo(conn.pcb)); toWrite > sendBufLen {
+		// Write at most the size of the LWIP buffer.
+		toWrite = sendBufLen
+	}
+	written := 0
+	if toWrite > 0 {
+		var err error
+		written, err = conn.writeInternal(data[:toWrite])
+		if err != nil {
+			return 0, err
+		}
+	}
+	if written == 0 || written == len(data) {
+		if err := conn.tcpOutputInternal(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
 }
 
 func (conn *tcpConn) writeCheck() error {
@@ -283,42 +371,49 @@ func (conn *tcpConn) writeCheck() error {
 	default:
 		panic("unexpected error")
 	}
-	return nil
 }
 
+// Write enqueues data to the lwIP send buffer. When the send buffer is
+// full, queued segments are flushed and the writer parks until the local
+// peer acknowledges some data (see Sent), the connection goes away or the
+// write deadline exceeds.
 func (conn *tcpConn) Write(data []byte) (int, error) {
 	totalWritten := 0
 
-	for len(data) > 0 {
+	for {
 		if err := conn.writeCheck(); err != nil {
 			return totalWritten, err
 		}
+		if isClosedChan(conn.writeDeadline.wait()) {
+			return totalWritten, os.ErrDeadlineExceeded
+		}
 
-		toWrite := len(data)
-
-		lwipMutex.Lock()
-		sendBufLen := C.tcp_sndbuf_cgo(conn.pcb)
-		lwipMutex.Unlock()
-
-		if toWrite > int(sendBufLen) {
-			// Write at most the size of the LWIP buffer.
-			toWrite = int(sendBufLen)
+		var written int
+		var err error
+		lwipCall(func() {
+			written, err = conn.enqueue(data)
+		})
+		totalWritten += written
+		data = data[written:]
+		if written > 0 {
+			conn.down(written)
 		}
-		if toWrite > 0 {
-			written, err := conn.writeInternal(data[0:toWrite])
-			if err != nil {
-				return totalWritten, err
-			}
-			totalWritten += written
-			data = data[written:len(data)]
+		if err != nil {
+			return totalWritten, err
+		}
+		if len(data) == 0 {
+			return totalWritten, nil
 		}
-	}
 
-	err := conn.tcpOutputInternal()
-	if err != nil {
-		return totalWritten, err
+		if written == 0 {
+			// Nothing could be enqueued, wait for acknowledgements to free
+			// up the send buffer.
+			select {
+			case <-conn.sndReady:
+			case <-conn.writeDeadline.wait():
+			}
+		}
 	}
-	return totalWritten, nil
 }
 
 func (conn *tcpConn) CloseWrite() error {
@@ -333,21 +428,26 @@ func (conn *tcpConn) CloseWrite() error {
 		conn.state = tcpWriteClosed
 	}
 	conn.Unlock()
+	notify(conn.sndReady)
 
-	lwipMutex.Lock()
-	// FIXME Handle tcp_shutdown error.
-	C.tcp_shutdown(conn.pcb, 0, 1)
-	lwipMutex.Unlock()
+	lwipCall(func() {
+		if !conn.isClosed() {
+			// FIXME Handle tcp_shutdown error.
+			C.tcp_shutdown(conn.pcb, 0, 1)
+		}
+	})
 
 	return nil
 }
 
 func (conn *tcpConn) CloseRead() error {
-	return conn.sndPipeReader.Close()
+	return conn.sndPipe.CloseRead()
 }
 
 func (conn *tcpConn) Sent(len uint16) error {
-	// Some packets are acknowledged by local client, check if any pending data to send.
+	// Some packets are acknowledged by local client, wake up the writer
+	// and check if any pending data to send.
+	notify(conn.sndReady)
 	return conn.checkState()
 }
 
@@ -429,7 +529,7 @@ func (conn *tcpConn) setLocalClosed() error {
 	}
 
 	// Causes the read half of the pipe returns.
-	conn.sndPipeWriter.Close()
+	conn.sndPipe.CloseWrite()
 
 	if conn.state == tcpWriteClosed {
 		conn.state = tcpClosing
@@ -441,8 +541,6 @@ func (conn *tcpConn) setLocalClosed() error {
 
 // Never call this function outside of the lwIP thread.
 func (conn *tcpConn) closeInternal() error {
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
 	C.tcp_arg(conn.pcb, nil)
 	C.tcp_recv(conn.pcb, nil)
 	C.tcp_sent(conn.pcb, nil)
@@ -472,8 +570,6 @@ func (conn *tcpConn) closeInternal() error {
 // Never call this function outside of the lwIP thread since it calls
 // tcp_abort() and in that case we must return ERR_ABRT to lwIP.
 func (conn *tcpConn) abortInternal() {
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
 	C.tcp_abort(conn.pcb)
 }
 
@@ -481,19 +577,29 @@ func (conn *tcpConn) Abort() {
 	conn.Lock()
 	// If it's in tcpErrored state, the pcb was already freed.
 	if conn.state < tcpAborting {
+		if conn.state != tcpConnecting {
+			// Refused connections are counted on their own.
+			stats.connsAborted.Add(1)
+		}
 		conn.state = tcpAborting
 	}
 	conn.Unlock()
+	notify(conn.sndReady)
+	conn.cancel(errors.New("connection aborted"))
 
-	lwipMutex.Lock()
-	conn.checkState()
-	lwipMutex.Unlock()
+	lwipCall(func() {
+		conn.checkState()
+	})
 }
 
 func (conn *tcpConn) Err(err error) {
 	conn.Lock()
+	if conn.state < tcpAborting {
+		stats.connsAborted.Add(1)
+	}
 	conn.state = tcpErrored
 	conn.Unlock()
+	conn.cancel(err)
 
 	conn.release()
 
@@ -504,15 +610,19 @@ func (conn *tcpConn) LocalClosed() error {
 	return conn.checkState()
 }
 
+// Never call this function outside of the lwIP thread.
 func (conn *tcpConn) release() {
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
-
-	tcpConns.Delete(conn)
+	if _, ok := tcpConns.LoadAndDelete(conn); ok {
+		stats.tcpSessions.Add(-1)
+	}
 
-	conn.sndPipeWriter.Close()
-	conn.sndPipeReader.Close()
+	conn.sndPipe.CloseWrite()
+	conn.sndPipe.CloseRead()
+	conn.Lock()
 	conn.state = tcpClosed
+	conn.Unlock()
+	notify(conn.sndReady)
+	conn.cancel(net.ErrClosed)
 
 }
 
@@ -0,0 +1,228 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/custom -I./c/include
+#include "lwip/tcp.h"
+#include "lwip/priv/tcp_priv.h"
+
+static int
+tcp_pcb_active(const ip_addr_t *local_ip, u16_t local_port, const ip_addr_t *remote_ip, u16_t remote_port)
+{
+	struct tcp_pcb *pcb;
+	for (pcb = tcp_active_pcbs; pcb != NULL; pcb = pcb->next) {
+		if (pcb->local_port == local_port && pcb->remote_port == remote_port &&
+		    ip_addr_cmp(&pcb->local_ip, local_ip) && ip_addr_cmp(&pcb->remote_ip, remote_ip)) {
+			return 1;
+		}
+	}
+	return 0;
+}
+*/
+import "C"
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ruilisi/go-tun2socks/common/log"
+)
+
+// tcpDialAcceptTimeout bounds the time the client has to complete the
+// handshake once the remote host is connected, it matches the SYN_RCVD
+// timeout of lwIP.
+const tcpDialAcceptTimeout = 20 * time.Second
+
+// tcpSyn is a SYN from TUN opening a new connection.
+type tcpSyn struct {
+	src, dst *net.TCPAddr
+
+	// pkt is a copy of the packet and info its headers.
+	pkt  []byte
+	info PacketInfo
+}
+
+// parseTCPSyn parses pkt as a SYN without ACK, fragmented packets are not
+// recognized.
+func parseTCPSyn(pkt []byte) (*tcpSyn, bool) {
+	var info PacketInfo
+	if !info.parse(pkt) || info.Protocol != proto_tcp || info.Fragment || info.length-info.hdrLen < 20 {
+		return nil, false
+	}
+	if info.TCPFlags&(tcpFlagSYN|tcpFlagACK|tcpFlagRST) != tcpFlagSYN {
+		return nil, false
+	}
+	syn := &tcpSyn{pkt: append([]byte(nil), pkt[:info.length]...)}
+	syn.info.parse(syn.pkt)
+	syn.src = &net.TCPAddr{IP: append(net.IP(nil), info.Src...), Port: int(info.SrcPort)}
+	syn.dst = &net.TCPAddr{IP: append(net.IP(nil), info.Dst...), Port: int(info.DstPort)}
+	return syn, true
+}
+
+// tcpDialId identifies a connection being dialed by its client and target
+// addresses.
+type tcpDialId struct {
+	src, dst string
+}
+
+// tcpDial is a connection whose SYN is held while the handler connects the
+// remote host, upstream is set once it is connected and the SYN passed on
+// to lwIP.
+type tcpDial struct {
+	syn      *tcpSyn
+	upstream net.Conn
+	expiry   *time.Timer
+}
+
+// tcpDials holds the connections being dialed, it is only accessed on the
+// lwIP thread.
+var tcpDials = make(map[tcpDialId]*tcpDial)
+
+// holdTCPSyn starts dialing the target of pkt if it is a SYN opening a new
+// connection and the stack connects before accepting, it reports whether
+// the packet was consumed.
+func holdTCPSyn(pkt []byte) bool {
+	h := tcpConnDialer
+	if h == nil || !activeStack.opts.connectBeforeAccept {
+		return false
+	}
+	syn, ok := parseTCPSyn(pkt)
+	if !ok {
+		return false
+	}
+	id := tcpDialId{src: syn.src.String(), dst: syn.dst.String()}
+	if d, ok := tcpDials[id]; ok {
+		// Retransmissions are dropped until the remote host is
+		// connected, lwIP answers them afterwards.
+		return d.upstream == nil
+	}
+	if tcpPCBActive(syn.src, syn.dst) {
+		return false
+	}
+	d := &tcpDial{syn: syn}
+	tcpDials[id] = d
+	go activeStack.dialTCP(h, id, d)
+	return true
+}
+
+// tcpPCBActive reports whether lwIP has a connection from src to dst, it
+// must be called on the lwIP thread.
+func tcpPCBActive(src, dst *net.TCPAddr) bool {
+	var srcIP, dstIP C.ip_addr_t
+	if ipAddrATON(src.IP.String(), &srcIP) != nil || ipAddrATON(dst.IP.String(), &dstIP) != nil {
+		return false
+	}
+	return C.tcp_pcb_active(&dstIP, C.u16_t(dst.Port), &srcIP, C.u16_t(src.Port)) != 0
+}
+
+// dialTCP connects the target of d with h, then passes the held SYN to lwIP
+// or rejects it.
+func (s *lwipStack) dialTCP(h TCPConnDialer, id tcpDialId, d *tcpDial) {
+	ctx, cancel := s.newConnContext()
+	stopDialGuard := s.guardDial(cancel)
+	upstream, err := h.DialContext(ctx, d.syn.dst)
+	stopDialGuard()
+	if err == nil && ctx.Err() != nil {
+		// Stack closed or timed out while the handler was connecting.
+		upstream.Close()
+		err = context.Cause(ctx)
+	}
+	cancel(nil)
+
+	var b InputBuffer
+	if err == nil {
+		if err = b.load(d.syn.pkt); err != nil {
+			upstream.Close()
+		}
+	}
+	if err != nil {
+		stats.connsRefused.Add(1)
+		lwipCall(func() {
+			delete(tcpDials, id)
+		})
+		log.Debugf("TCP %v -> %v refused: %v", d.syn.src, d.syn.dst, err)
+		outputPacket(rejectTCPSyn(d.syn, err))
+		return
+	}
+
+	lwipCall(func() {
+		d.upstream = upstream
+		d.expiry = time.AfterFunc(tcpDialAcceptTimeout, func() {
+			lwipCall(func() {
+				if tcpDials[id] == d {
+					delete(tcpDials, id)
+					upstream.Close()
+				}
+			})
+		})
+		lwipDeliver(&b, len(d.syn.pkt))
+	})
+}
+
+// takeTCPDial removes and returns the dialed connection pcb was accepted
+// for, it must be called on the lwIP thread.
+func takeTCPDial(pcb *C.struct_tcp_pcb) *tcpDial {
+	if len(tcpDials) == 0 {
+		return nil
+	}
+	id := tcpDialId{
+		src: ParseTCPAddr(ipAddrNTOA(pcb.remote_ip), uint16(pcb.remote_port)).String(),
+		dst: ParseTCPAddr(ipAddrNTOA(pcb.local_ip), uint16(pcb.local_port)).String(),
+	}
+	d, ok := tcpDials[id]
+	if !ok || d.upstream == nil {
+		return nil
+	}
+	delete(tcpDials, id)
+	d.expiry.Stop()
+	return d
+}
+
+// closeTCPDials closes the connections dialed for clients that have not
+// completed the handshake, it must be called on the lwIP thread.
+func closeTCPDials() {
+	for id, d := range tcpDials {
+		if d.upstream != nil {
+			d.expiry.Stop()
+			d.upstream.Close()
+			delete(tcpDials, id)
+		}
+	}
+}
+
+// dialedHandler hands a connection accepted after connecting the remote
+// host to HandleDialed.
+type dialedHandler struct {
+	dialer   TCPConnDialer
+	upstream net.Conn
+}
+
+func (h dialedHandler) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	return h.dialer.HandleDialed(ctx, conn, h.upstream, target)
+}
+
+// rejectTCPSyn builds the answer to syn after the handler failed to connect
+// its target with err.
+func rejectTCPSyn(syn *tcpSyn, err error) []byte {
+	v6 := syn.src.IP.To4() == nil
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+	case errors.Is(err, syscall.ENETUNREACH):
+		// Net unreachable, no route to destination for ICMPv6.
+		return icmpUnreachable(syn.pkt, &syn.info, 0)
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		if v6 {
+			return icmpUnreachable(syn.pkt, &syn.info, 3) // Address unreachable
+		}
+		return icmpUnreachable(syn.pkt, &syn.info, 1) // Host unreachable
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		if v6 {
+			return icmpUnreachable(syn.pkt, &syn.info, 1) // Administratively prohibited
+		}
+		return icmpUnreachable(syn.pkt, &syn.info, 13) // Communication administratively prohibited
+	}
+	return tcpReset(syn.pkt, &syn.info)
+}
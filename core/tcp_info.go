@@ -0,0 +1,143 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/custom -I./c/include
+#include "lwip/tcp.h"
+#include "lwip/priv/tcp_priv.h"
+
+struct tcp_info_cgo {
+	int state;
+	s16_t sa;
+	s16_t rto;
+	u8_t nrtx;
+	u32_t rtx_total;
+	u16_t mss;
+	u32_t cwnd;
+	u32_t ssthresh;
+	u32_t snd_wnd;
+	u32_t rcv_wnd;
+	u32_t snd_queued;
+	u32_t unacked;
+};
+
+static void
+tcp_info_cgo(struct tcp_pcb *pcb, struct tcp_info_cgo *info)
+{
+	struct tcp_seg *seg;
+
+	info->state = pcb->state;
+	info->sa = pcb->sa;
+	info->rto = pcb->rto;
+	info->nrtx = pcb->nrtx;
+	info->rtx_total = pcb->rtx_total;
+	info->mss = pcb->mss;
+	info->cwnd = pcb->cwnd;
+	info->ssthresh = pcb->ssthresh;
+	info->snd_wnd = pcb->snd_wnd;
+	info->rcv_wnd = pcb->rcv_wnd;
+	info->snd_queued = TCP_SND_BUF - pcb->snd_buf;
+	info->unacked = 0;
+	for (seg = pcb->unacked; seg != NULL; seg = seg->next) {
+		info->unacked++;
+	}
+}
+*/
+import "C"
+import (
+	"net"
+	"time"
+)
+
+// TCPInfo is a snapshot of the lwIP state of a TCP connection.
+type TCPInfo struct {
+	// State is the TCP state of the pcb, e.g. "ESTABLISHED".
+	State string
+
+	// SmoothedRTT and RTO are the smoothed round-trip time to the local
+	// client and the retransmission timeout, lwIP measures them in ticks
+	// of 500 milliseconds.
+	SmoothedRTT time.Duration
+	RTO         time.Duration
+
+	// MSS is the maximum segment size sent to the local client.
+	MSS uint16
+
+	// CongestionWindow and SlowStartThreshold are in bytes.
+	CongestionWindow   uint32
+	SlowStartThreshold uint32
+
+	// SendWindow is the window advertised by the local client,
+	// ReceiveWindow the window available to it.
+	SendWindow    uint32
+	ReceiveWindow uint32
+
+	// SendQueued counts bytes in the send buffer, written but not yet
+	// acknowledged, and UnackedSegments the segments sent but not yet
+	// acknowledged.
+	SendQueued      uint32
+	UnackedSegments uint32
+
+	// Retransmissions counts the retransmissions of the connection since
+	// it was opened. CurrentRetransmits counts those of the oldest
+	// unacknowledged segment only, it is reset when new data is
+	// acknowledged.
+	Retransmissions    uint32
+	CurrentRetransmits uint8
+}
+
+var tcpStateNames = [...]string{
+	C.CLOSED:      "CLOSED",
+	C.LISTEN:      "LISTEN",
+	C.SYN_SENT:    "SYN_SENT",
+	C.SYN_RCVD:    "SYN_RCVD",
+	C.ESTABLISHED: "ESTABLISHED",
+	C.FIN_WAIT_1:  "FIN_WAIT_1",
+	C.FIN_WAIT_2:  "FIN_WAIT_2",
+	C.CLOSE_WAIT:  "CLOSE_WAIT",
+	C.CLOSING:     "CLOSING",
+	C.LAST_ACK:    "LAST_ACK",
+	C.TIME_WAIT:   "TIME_WAIT",
+}
+
+// slowTicks converts a duration in ticks of the slow TCP timer.
+func slowTicks(n C.s16_t) time.Duration {
+	return time.Duration(n) * C.TCP_SLOW_INTERVAL * time.Millisecond
+}
+
+// tcpInfo returns the lwIP state of conn, or nil if its pcb is gone. It
+// must be called on the lwIP thread.
+func (conn *tcpConn) tcpInfo() *TCPInfo {
+	if conn.isClosed() {
+		return nil
+	}
+	var ci C.struct_tcp_info_cgo
+	C.tcp_info_cgo(conn.pcb, &ci)
+	info := &TCPInfo{
+		SmoothedRTT:        slowTicks(ci.sa >> 3),
+		RTO:                slowTicks(ci.rto),
+		MSS:                uint16(ci.mss),
+		CongestionWindow:   uint32(ci.cwnd),
+		SlowStartThreshold: uint32(ci.ssthresh),
+		SendWindow:         uint32(ci.snd_wnd),
+		ReceiveWindow:      uint32(ci.rcv_wnd),
+		SendQueued:         uint32(ci.snd_queued),
+		UnackedSegments:    uint32(ci.unacked),
+		Retransmissions:    uint32(ci.rtx_total),
+		CurrentRetransmits: uint8(ci.nrtx),
+	}
+	if int(ci.state) < len(tcpStateNames) {
+		info.State = tcpStateNames[ci.state]
+	}
+	return info
+}
+
+func (conn *tcpConn) Info() (TCPInfo, error) {
+	var info *TCPInfo
+	lwipCall(func() {
+		info = conn.tcpInfo()
+	})
+	if info == nil {
+		return TCPInfo{}, net.ErrClosed
+	}
+	return *info, nil
+}
@@ -0,0 +1,150 @@
+package core
+
+/*
+#cgo CFLAGS: -I./c/custom -I./c/include
+#include "lwip/tcp.h"
+
+static void
+tcp_set_nodelay_cgo(struct tcp_pcb *pcb, int nodelay)
+{
+	if (nodelay) {
+		tcp_nagle_disable(pcb);
+	} else {
+		tcp_nagle_enable(pcb);
+	}
+}
+
+static void
+tcp_set_keepalive_cgo(struct tcp_pcb *pcb, int enable, u32_t idle, u32_t intvl, u32_t cnt)
+{
+	if (!enable) {
+		pcb->so_options &= ~SOF_KEEPALIVE;
+		return;
+	}
+	pcb->so_options |= SOF_KEEPALIVE;
+	if (idle > 0) {
+		pcb->keep_idle = idle;
+	}
+	if (intvl > 0) {
+		pcb->keep_intvl = intvl;
+	}
+	if (cnt > 0) {
+		pcb->keep_cnt = cnt;
+	}
+}
+
+static u32_t
+tcp_wnd_max_cgo(struct tcp_pcb *pcb)
+{
+	return TCP_WND_MAX(pcb);
+}
+*/
+import "C"
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Keep-alive defaults of lwIP, used for the zero fields of a
+// net.KeepAliveConfig.
+const (
+	defaultKeepAliveIdle     = 2 * time.Hour
+	defaultKeepAliveInterval = 75 * time.Second
+	defaultKeepAliveCount    = 9
+)
+
+// tune runs f on the lwIP thread if the pcb of conn still exists.
+func (conn *tcpConn) tune(f func()) error {
+	var err error
+	lwipCall(func() {
+		if conn.isClosed() {
+			err = net.ErrClosed
+			return
+		}
+		f()
+	})
+	return err
+}
+
+func (conn *tcpConn) SetNoDelay(noDelay bool) error {
+	return conn.tune(func() {
+		var v C.int
+		if noDelay {
+			v = 1
+		}
+		C.tcp_set_nodelay_cgo(conn.pcb, v)
+	})
+}
+
+// keepAliveMillis converts a field of net.KeepAliveConfig to milliseconds,
+// zero meaning unchanged.
+func keepAliveMillis(d, def time.Duration) C.u32_t {
+	if d < 0 {
+		return 0
+	}
+	if d == 0 {
+		d = def
+	}
+	return C.u32_t(max(d.Milliseconds(), 1))
+}
+
+func (conn *tcpConn) SetKeepAliveConfig(config net.KeepAliveConfig) error {
+	var enable C.int
+	if config.Enable {
+		enable = 1
+	}
+	idle := keepAliveMillis(config.Idle, defaultKeepAliveIdle)
+	intvl := keepAliveMillis(config.Interval, defaultKeepAliveInterval)
+	var cnt C.u32_t
+	switch {
+	case config.Count == 0:
+		cnt = defaultKeepAliveCount
+	case config.Count > 0:
+		cnt = C.u32_t(config.Count)
+	}
+	return conn.tune(func() {
+		C.tcp_set_keepalive_cgo(conn.pcb, enable, idle, intvl, cnt)
+	})
+}
+
+func (conn *tcpConn) SetReceiveWindow(size int) error {
+	var err error
+	terr := conn.tune(func() {
+		wndMax := int(C.tcp_wnd_max_cgo(conn.pcb))
+		if size < 1 || size > wndMax {
+			err = fmt.Errorf("receive window %d out of range [1, %d]", size, wndMax)
+			return
+		}
+		withhold := wndMax - size
+		if cur := conn.rcvWithheld + conn.rcvDebt; withhold >= cur {
+			conn.rcvDebt += withhold - cur
+		} else {
+			// Cancel what is not withheld yet, then give back the
+			// window withheld already.
+			release := cur - withhold
+			d := min(release, conn.rcvDebt)
+			conn.rcvDebt -= d
+			release -= d
+			conn.rcvWithheld -= release
+			if release > 0 {
+				C.tcp_recved(conn.pcb, C.u16_t(release))
+			}
+		}
+	})
+	if terr != nil {
+		return terr
+	}
+	return err
+}
+
+// recved reopens the window by n bytes read by the handler, minus what
+// SetReceiveWindow withholds. It must be called on the lwIP thread.
+func (conn *tcpConn) recved(n int) {
+	d := min(n, conn.rcvDebt)
+	conn.rcvDebt -= d
+	conn.rcvWithheld += d
+	if n -= d; n > 0 {
+		C.tcp_recved(conn.pcb, C.u16_t(n))
+	}
+}
@@ -14,11 +14,7 @@ import (
 //export udpRecvFn
 func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr *C.ip_addr_t, port C.u16_t, destAddr *C.ip_addr_t, destPort C.u16_t) {
 	// NOTE: addr may point into pbuf p, so copy before freeing.
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
 	defer func(pb *C.struct_pbuf) {
-		lwipMutex.Lock()
-		defer lwipMutex.Unlock()
 		if pb != nil {
 			C.pbuf_free(pb)
 			pb = nil
@@ -40,12 +36,16 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 		panic("invalid UDP address")
 	}
 
-	connId := udpConnId{src: srcAddr.String()}
+	connId := newUDPConnId(activeStack.opts.udpNATMode, srcAddr, dstAddr)
 
 	conn, _, err := udpConns.GetOrCreate(connId, func() (UDPConn, error) {
 		if udpConnHandler == nil {
 			panic("must register a UDP connection handler")
 		}
+		if !sessions.admitUDP(&activeStack.opts.limits, srcAddr.IP) {
+			stats.dropUDPLimited.Add(1)
+			return nil, errSessionLimit
+		}
 		return newUDPConn(
 			pcb,
 			udpConnHandler,
@@ -53,6 +53,7 @@ func udpRecvFn(arg unsafe.Pointer, pcb *C.struct_udp_pcb, p *C.struct_pbuf, addr
 			port,
 			srcAddr,
 			dstAddr,
+			connId,
 		)
 	})
 	if err != nil {
@@ -6,10 +6,13 @@ package core
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/ruilisi/stellar-proxy/log"
@@ -23,17 +26,33 @@ const (
 	udpClosed
 )
 
+var udpConnStateNames = [...]string{
+	udpConnecting: "connecting",
+	udpConnected:  "connected",
+	udpClosed:     "closed",
+}
+
+func (s udpConnState) String() string {
+	if int(s) < len(udpConnStateNames) {
+		return udpConnStateNames[s]
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(s))
+}
+
 type udpPacket struct {
 	data []byte
 	addr *net.UDPAddr
 }
 
 type udpConn struct {
-	pcb       *C.struct_udp_pcb
-	handler   UDPConnHandler
-	localAddr *net.UDPAddr
-	localIP   C.ip_addr_t
-	localPort C.u16_t
+	sessionCounters
+
+	pcb        *C.struct_udp_pcb
+	handler    UDPConnContextHandler
+	localAddr  *net.UDPAddr
+	remoteAddr *net.UDPAddr
+	localIP    C.ip_addr_t
+	localPort  C.u16_t
 
 	// state is stored atomically:
 	// udpConnecting -> udpConnected (CAS)
@@ -41,23 +60,54 @@ type udpConn struct {
 	state atomic.Uint32
 
 	pending chan *udpPacket
+
+	// idleTimeout is the time without traffic after which the session is
+	// closed, zero means never.
+	idleTimeout time.Duration
+
+	connId  udpConnId
+	natMode UDPNATMode
+
+	// peerPorts holds the destination ports the client has sent to in
+	// UDPNATPortRestricted mode.
+	peersMu   sync.Mutex
+	peerPorts map[int]struct{}
+
+	// ctx is passed to the handler, it is cancelled once the connection
+	// is closed.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 }
 
-func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr) (UDPConn, error) {
+func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnContextHandler, localIP C.ip_addr_t, localPort C.u16_t, localAddr, remoteAddr *net.UDPAddr, connId udpConnId) (UDPConn, error) {
 	conn := &udpConn{
-		handler:   handler,
-		pcb:       pcb,
-		localAddr: localAddr,
-		localIP:   localIP,
-		localPort: localPort,
-		pending:   make(chan *udpPacket, 128),
+		remoteAddr: remoteAddr,
+		handler:    handler,
+		pcb:        pcb,
+		localAddr:  localAddr,
+		localIP:    localIP,
+		localPort:  localPort,
+		pending:    make(chan *udpPacket, 128),
+		connId:     connId,
+		natMode:    activeStack.opts.udpNATMode,
+		peerPorts:  make(map[int]struct{}),
 	}
 	conn.state.Store(uint32(udpConnecting))
+	conn.sessionCounters.init()
+	conn.ctx, conn.cancel = activeStack.newConnContext()
+	conn.idleTimeout = activeStack.udpIdleTimeout(remoteAddr.Port)
+	stopDialGuard := activeStack.guardDial(conn.cancel)
 
 	go func() {
-		err := handler.Connect(conn, remoteAddr)
+		err := handler.ConnectContext(conn.ctx, conn, remoteAddr)
+		stopDialGuard()
+		if err == nil && conn.ctx.Err() != nil {
+			// Closed or timed out while the handler was connecting.
+			err = context.Cause(conn.ctx)
+		}
 		if err != nil {
 			log.E("[tun2socks/Connect] %s err: %v ", remoteAddr, err)
+			stats.connsRefused.Add(1)
 			conn.Close()
 			return
 		}
@@ -67,6 +117,7 @@ func newUDPConn(pcb *C.struct_udp_pcb, handler UDPConnHandler, localIP C.ip_addr
 			// Connection was closed while dialing; do not proceed.
 			return
 		}
+		stats.connsAccepted.Add(1)
 
 		// Drain any pending early packets now that we are connected.
 	DrainPending:
@@ -92,6 +143,17 @@ func (conn *udpConn) LocalAddr() *net.UDPAddr {
 	return conn.localAddr
 }
 
+func (conn *udpConn) sessionInfo() SessionInfo {
+	info := SessionInfo{
+		Network:    "udp",
+		LocalAddr:  conn.localAddr,
+		RemoteAddr: conn.remoteAddr,
+		State:      udpConnState(conn.state.Load()).String(),
+	}
+	conn.fill(&info)
+	return info
+}
+
 func (conn *udpConn) ensureStateConnected() error {
 	switch udpConnState(conn.state.Load()) {
 	case udpClosed:
@@ -106,12 +168,15 @@ func (conn *udpConn) ensureStateConnected() error {
 }
 
 func (conn *udpConn) ReceiveTo(data []byte, addr *net.UDPAddr) error {
+	conn.up(len(data))
+	conn.addPeer(addr)
 	if udpConnState(conn.state.Load()) == udpConnecting {
 		pkt := &udpPacket{data: append([]byte(nil), data...), addr: addr}
 		select {
 		case conn.pending <- pkt:
 			return nil
 		default:
+			stats.dropUDPPendingFull.Add(1)
 			return errors.New("failed to pend packet when udp is connecting")
 		}
 	}
@@ -131,10 +196,22 @@ func (conn *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
 	if err := conn.ensureStateConnected(); err != nil {
 		return 0, err
 	}
+	if !conn.allowed(addr) {
+		// Dropped by the NAT filter, as if it had been sent.
+		stats.dropUDPFiltered.Add(1)
+		return len(data), nil
+	}
 
-	lwipMutex.Lock()
-	defer lwipMutex.Unlock()
+	var n int
+	var err error
+	lwipCall(func() {
+		n, err = conn.sendTo(data, addr)
+	})
+	return n, err
+}
 
+// sendTo sends data to TUN from addr, it must be called on the lwIP thread.
+func (conn *udpConn) sendTo(data []byte, addr *net.UDPAddr) (int, error) {
 	cremoteIP := C.struct_ip_addr{}
 	if err := ipAddrATON(addr.IP.String(), &cremoteIP); err != nil {
 		return 0, err
@@ -145,8 +222,6 @@ func (conn *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
 
 	buf := C.pbuf_alloc(C.PBUF_TRANSPORT, C.u16_t(dataLen), C.PBUF_RAM)
 	defer func(pb *C.struct_pbuf) {
-		lwipMutex.Lock()
-		defer lwipMutex.Unlock()
 		if pb != nil {
 			C.pbuf_free(pb)
 			pb = nil
@@ -170,15 +245,17 @@ func (conn *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
 	if ret != 0 {
 		return 0, fmt.Errorf("[tun2socks] udp_sendto error %d", ret)
 	}
+	conn.down(dataLen)
 	return dataLen, nil
 }
 
 func (conn *udpConn) Close() error {
 	// Set closed regardless of prior state.
 	conn.state.Store(uint32(udpClosed))
-	connId := udpConnId{
-		src: conn.LocalAddr().String(),
+	conn.cancel(net.ErrClosed)
+	// A new session of the same client may have replaced this one.
+	if udpConns.CompareAndDelete(conn.connId, conn) {
+		sessions.releaseUDP(conn.localAddr.IP)
 	}
-	udpConns.Delete(connId)
 	return nil
 }
@@ -2,17 +2,21 @@ package core
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
-// udpConnId identifies a UDP "connection".
+// udpConnId identifies a UDP "connection", dst is set depending on the
+// UDPNATMode of the stack.
 type udpConnId struct {
 	src string
+	dst string
 }
 
 // udpConnRegistry is a typed, lock-protected map.
 type udpConnRegistry struct {
 	mu sync.RWMutex
 	m  map[udpConnId]UDPConn
+	n  atomic.Int64
 }
 
 func newUDPConnRegistry() *udpConnRegistry {
@@ -56,14 +60,27 @@ func (r *udpConnRegistry) GetOrCreate(id udpConnId, factory func() (UDPConn, err
 		return nil, false, err
 	}
 	r.m[id] = newConn
+	r.n.Add(1)
 	r.mu.Unlock()
 	return newConn, true, nil
 }
 
-func (r *udpConnRegistry) Delete(id udpConnId) {
+// CompareAndDelete deletes the entry of id only if it is c, it reports
+// whether it did.
+func (r *udpConnRegistry) CompareAndDelete(id udpConnId, c UDPConn) bool {
 	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m[id] != c {
+		return false
+	}
 	delete(r.m, id)
-	r.mu.Unlock()
+	r.n.Add(-1)
+	return true
+}
+
+// Len returns the number of entries without taking the lock.
+func (r *udpConnRegistry) Len() int {
+	return int(r.n.Load())
 }
 
 func (r *udpConnRegistry) Range(fn func(id udpConnId, c UDPConn) bool) {
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"time"
+)
+
+// Bounds of the interval at which idle UDP sessions are looked for.
+const (
+	minUDPExpiryInterval = 10 * time.Millisecond
+	maxUDPExpiryInterval = 5 * time.Second
+)
+
+// udpIdleTimeout returns the idle timeout of UDP sessions to port.
+func (s *lwipStack) udpIdleTimeout(port int) time.Duration {
+	if d, ok := s.opts.udpPortIdleTimeouts[port]; ok {
+		return d
+	}
+	return s.opts.udpIdleTimeout
+}
+
+// udpExpiryInterval returns a quarter of the shortest idle timeout within
+// bounds, or zero if no session expires.
+func (s *lwipStack) udpExpiryInterval() time.Duration {
+	shortest := s.opts.udpIdleTimeout
+	for _, d := range s.opts.udpPortIdleTimeouts {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	if shortest == 0 {
+		return 0
+	}
+	return min(max(shortest/4, minUDPExpiryInterval), maxUDPExpiryInterval)
+}
+
+// expireUDPConns closes the UDP sessions that have been idle for longer
+// than their timeout until the stack is closed.
+func (s *lwipStack) expireUDPConns() {
+	interval := s.udpExpiryInterval()
+	if interval == 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-t.C:
+			udpConns.Range(func(_ udpConnId, c UDPConn) bool {
+				conn := c.(*udpConn)
+				if conn.idleTimeout > 0 && now.Sub(time.Unix(0, conn.lastActivity.Load())) >= conn.idleTimeout {
+					stats.udpExpired.Add(1)
+					closeUDPConn(conn)
+				}
+				return true
+			})
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"fmt"
+	"net"
+)
+
+// UDPNATMode selects how UDP datagrams from TUN are grouped into sessions,
+// each session being a connection of the UDP handler, and which sources
+// the datagrams written back with WriteFrom may have. The other datagrams
+// are dropped as a NAT of that type would.
+type UDPNATMode int
+
+const (
+	// UDPNATFullCone keys sessions by source address, a session serves
+	// every destination of a client port and datagrams from any address
+	// are let through.
+	UDPNATFullCone UDPNATMode = iota
+
+	// UDPNATPortRestricted keys sessions by source address and destination
+	// IP, datagrams are let through only from the ports of that IP the
+	// client has sent to.
+	UDPNATPortRestricted
+
+	// UDPNATSymmetric keys sessions by source and destination address,
+	// datagrams are let through only from the destination.
+	UDPNATSymmetric
+)
+
+var udpNATModeNames = [...]string{
+	UDPNATFullCone:       "full-cone",
+	UDPNATPortRestricted: "port-restricted",
+	UDPNATSymmetric:      "symmetric",
+}
+
+func (m UDPNATMode) String() string {
+	if m >= 0 && int(m) < len(udpNATModeNames) {
+		return udpNATModeNames[m]
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// ParseUDPNATMode returns the mode named s, as returned by String.
+func ParseUDPNATMode(s string) (UDPNATMode, error) {
+	for m, name := range udpNATModeNames {
+		if name == s {
+			return UDPNATMode(m), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown UDP NAT mode %q", s)
+}
+
+// newUDPConnId returns the id of the session of a datagram from src to dst.
+func newUDPConnId(mode UDPNATMode, src, dst *net.UDPAddr) udpConnId {
+	id := udpConnId{src: src.String()}
+	switch mode {
+	case UDPNATPortRestricted:
+		id.dst = dst.IP.String()
+	case UDPNATSymmetric:
+		id.dst = dst.String()
+	}
+	return id
+}
+
+// addPeer records that the client has sent to addr.
+func (conn *udpConn) addPeer(addr *net.UDPAddr) {
+	if conn.natMode != UDPNATPortRestricted {
+		return
+	}
+	conn.peersMu.Lock()
+	conn.peerPorts[addr.Port] = struct{}{}
+	conn.peersMu.Unlock()
+}
+
+// allowed reports whether a datagram from addr passes the NAT filter of the
+// session.
+func (conn *udpConn) allowed(addr *net.UDPAddr) bool {
+	switch conn.natMode {
+	case UDPNATPortRestricted:
+		if !addr.IP.Equal(conn.remoteAddr.IP) {
+			return false
+		}
+		conn.peersMu.Lock()
+		_, ok := conn.peerPorts[addr.Port]
+		conn.peersMu.Unlock()
+		return ok
+	case UDPNATSymmetric:
+		return addr.Port == conn.remoteAddr.Port && addr.IP.Equal(conn.remoteAddr.IP)
+	}
+	return true
+}
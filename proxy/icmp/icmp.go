@@ -0,0 +1,96 @@
+package icmp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/ruilisi/go-tun2socks/core"
+)
+
+const (
+	protocolICMP   = 1
+	protocolICMPv6 = 58
+)
+
+// ICMP handler that forwards echo requests using unprivileged ICMP datagram
+// sockets and writes the replies back to TUN. On Linux the sockets require
+// the gid of the process to be within the net.ipv4.ping_group_range sysctl.
+// A socket is opened per request, the stack bounds how many requests are
+// handled at once.
+type handler struct {
+	timeout time.Duration
+}
+
+// NewHandler returns a handler forwarding echo requests, requests not
+// answered within timeout are dropped.
+func NewHandler(timeout time.Duration) core.ICMPHandler {
+	return &handler{timeout: timeout}
+}
+
+func (h *handler) HandleEcho(req *core.ICMPEchoRequest) error {
+	network, address, proto := "udp4", "0.0.0.0", protocolICMP
+	var reqType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if req.IsIPv6() {
+		network, address, proto = "udp6", "::", protocolICMPv6
+		reqType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	c, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	msg := icmp.Message{
+		Type: reqType,
+		Body: &icmp.Echo{ID: int(req.ID), Seq: int(req.Seq), Data: req.Data},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := c.WriteTo(b, &net.UDPAddr{IP: req.Dst}); err != nil {
+		return err
+	}
+
+	c.SetReadDeadline(time.Now().Add(h.timeout))
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return errors.New("echo request timed out")
+			}
+			return err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		// The kernel rewrites the ID with the socket port, only the
+		// sequence number is left to match.
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != int(req.Seq) {
+			continue
+		}
+		return req.Reply(echo.Data)
+	}
+}
+
+// ICMP handler replying to every echo request immediately regardless of
+// the reachability of the destination, for proxies that cannot carry ICMP.
+type fakeHandler struct{}
+
+func NewFakeHandler() core.ICMPHandler {
+	return &fakeHandler{}
+}
+
+func (h *fakeHandler) HandleEcho(req *core.ICMPEchoRequest) error {
+	return req.Reply(req.Data)
+}
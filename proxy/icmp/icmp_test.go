@@ -0,0 +1,105 @@
+package icmp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/ruilisi/go-tun2socks/core"
+)
+
+var (
+	stackOnce sync.Once
+	out       = make(chan []byte, 4)
+)
+
+// startStack runs the stack with its output written to out, it is shared
+// by the tests since lwIP keeps global state.
+func startStack() {
+	stackOnce.Do(func() {
+		core.NewLWIPStack(true, true)
+		core.RegisterOutputFn(func(data []byte) (int, error) {
+			select {
+			case out <- append([]byte(nil), data...):
+			default:
+			}
+			return len(data), nil
+		})
+	})
+}
+
+// checkReply checks that pkt is an echo reply to req carrying data.
+func checkReply(t *testing.T, pkt []byte, req *core.ICMPEchoRequest, data []byte) {
+	t.Helper()
+	var hdr int
+	var proto int
+	var replyType icmp.Type
+	var src, dst net.IP
+	if req.IsIPv6() {
+		hdr, proto, replyType = ipv6.HeaderLen, protocolICMPv6, ipv6.ICMPTypeEchoReply
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+	} else {
+		hdr, proto, replyType = ipv4.HeaderLen, protocolICMP, ipv4.ICMPTypeEchoReply
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+	}
+	if !src.Equal(req.Dst) || !dst.Equal(req.Src) {
+		t.Errorf("reply from %v to %v, want from %v to %v", src, dst, req.Dst, req.Src)
+	}
+	msg, err := icmp.ParseMessage(proto, pkt[hdr:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if msg.Type != replyType || !ok {
+		t.Fatalf("got %v, want an echo reply", msg.Type)
+	}
+	if echo.ID != int(req.ID) || echo.Seq != int(req.Seq) || !bytes.Equal(echo.Data, data) {
+		t.Errorf("got reply %d/%d %q, want %d/%d %q", echo.ID, echo.Seq, echo.Data, req.ID, req.Seq, data)
+	}
+}
+
+func nextPacket(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case pkt := <-out:
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply written")
+		return nil
+	}
+}
+
+func TestFakeHandler(t *testing.T) {
+	startStack()
+	h := NewFakeHandler()
+	for _, req := range []*core.ICMPEchoRequest{
+		{Src: net.IPv4(10, 0, 0, 2), Dst: net.IPv4(192, 0, 2, 1), ID: 1, Seq: 2, Data: []byte("ping")},
+		{Src: net.ParseIP("fd00::2"), Dst: net.ParseIP("2001:db8::1"), ID: 1, Seq: 2, Data: []byte("ping")},
+	} {
+		if err := h.HandleEcho(req); err != nil {
+			t.Fatal(err)
+		}
+		checkReply(t, nextPacket(t), req, req.Data)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	c, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		t.Skipf("unprivileged ICMP sockets unavailable: %v", err)
+	}
+	c.Close()
+	startStack()
+	h := NewHandler(5 * time.Second)
+	req := &core.ICMPEchoRequest{Src: net.IPv4(10, 0, 0, 2), Dst: net.IPv4(127, 0, 0, 1), ID: 1, Seq: 2, Data: []byte("ping")}
+	if err := h.HandleEcho(req); err != nil {
+		t.Fatal(err)
+	}
+	checkReply(t, nextPacket(t), req, req.Data)
+}
@@ -0,0 +1,100 @@
+package redirect
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ruilisi/go-tun2socks/core"
+	"github.com/ruilisi/go-tun2socks/tun/tuntest"
+)
+
+var (
+	stackOnce sync.Once
+	peer      *tuntest.Peer
+)
+
+// startStack runs the stack on an in-memory TUN device and returns the
+// client peer on the other end. It is shared by the tests since lwIP keeps
+// global state.
+func startStack() *tuntest.Peer {
+	stackOnce.Do(func() {
+		dev, peerDev := tuntest.NewPipe()
+		s := core.NewLWIPStack(true, true)
+		core.RegisterOutputFn(dev.Write)
+		go io.CopyBuffer(s, dev, make([]byte, 65535))
+		peer = tuntest.NewPeer(peerDev, net.IPv4(10, 0, 0, 2))
+	})
+	return peer
+}
+
+func TestTCP(t *testing.T) {
+	p := startStack()
+	echo, err := tuntest.ListenEcho()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	core.RegisterTCPConnHandler(NewTCPHandler(echo.Addr()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	c, err := p.DialTCP(ctx, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		c.Write(data)
+		c.CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d bytes differ from the %d sent", len(got), len(data))
+	}
+	if err := c.WaitClosed(ctx); err != nil {
+		t.Errorf("connection not closed after both sides closed: %v", err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	p := startStack()
+	echo, err := tuntest.ListenEcho()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	core.RegisterUDPConnHandler(NewUDPHandler(echo.Addr(), time.Minute))
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	c, err := p.DialUDP(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := []byte("ping")
+	buf := make([]byte, 1500)
+	c.Write(msg)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replies appear to come from the original destination.
+	if !bytes.Equal(buf[:n], msg) || addr.String() != target.String() {
+		t.Errorf("got %q from %v, want %q from %v", buf[:n], addr, msg, target)
+	}
+}
@@ -1,6 +1,7 @@
 package redirect
 
 import (
+	"context"
 	"io"
 	"net"
 
@@ -76,12 +77,25 @@ func (h *tcpHandler) handleOutput(conn net.Conn, output io.WriteCloser) {
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	c, err := net.Dial("tcp", h.target)
+	return h.HandleContext(context.Background(), conn, target)
+}
+
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	c, err := h.DialContext(ctx, target)
 	if err != nil {
 		return err
 	}
-	go h.handleInput(conn, c)
-	go h.handleOutput(conn, c)
+	return h.HandleDialed(ctx, conn, c, target)
+}
+
+func (h *tcpHandler) DialContext(ctx context.Context, target *net.TCPAddr) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", h.target)
+}
+
+func (h *tcpHandler) HandleDialed(ctx context.Context, conn, upstream net.Conn, target *net.TCPAddr) error {
+	go h.handleInput(conn, upstream)
+	go h.handleOutput(conn, upstream)
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/ruilisi/go-tun2socks/common/log"
+	"github.com/ruilisi/go-tun2socks/component/pool"
 	"github.com/ruilisi/go-tun2socks/core"
 )
 
@@ -29,8 +30,11 @@ func NewUDPHandler(target string, timeout time.Duration) core.UDPConnHandler {
 	}
 }
 
-func (h *udpHandler) fetchUDPInput(conn core.UDPConn, pc *net.UDPConn) {
-	buf := core.NewBytes(pool.BufSize)
+// fetchUDPInput writes the replies of the redirect target to TUN, they
+// appear to come from the destination the client sent to so that they pass
+// connected sockets and the NAT filter of the stack.
+func (h *udpHandler) fetchUDPInput(conn core.UDPConn, pc *net.UDPConn, target *net.UDPAddr) {
+	buf := pool.NewBytes(pool.BufSize)
 
 	defer func() {
 		h.Close(conn)
@@ -39,13 +43,13 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, pc *net.UDPConn) {
 
 	for {
 		pc.SetDeadline(time.Now().Add(h.timeout))
-		n, addr, err := pc.ReadFromUDP(buf)
+		n, _, err := pc.ReadFromUDP(buf)
 		if err != nil {
 			// log.Printf("failed to read UDP data from remote: %v", err)
 			return
 		}
 
-		_, err = conn.WriteFrom(buf[:n], addr)
+		_, err = conn.WriteFrom(buf[:n], target)
 		if err != nil {
 			log.Warnf("failed to write UDP data to TUN")
 			return
@@ -65,7 +69,7 @@ func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 	h.udpTargetAddrs[conn] = tgtAddr
 	h.udpConns[conn] = pc
 	h.Unlock()
-	go h.fetchUDPInput(conn, pc)
+	go h.fetchUDPInput(conn, pc, target)
 	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
 	return nil
 }
@@ -0,0 +1,251 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ruilisi/go-tun2socks/core"
+	"github.com/ruilisi/go-tun2socks/tun/tuntest"
+)
+
+var (
+	stackOnce sync.Once
+	peer      *tuntest.Peer
+)
+
+// startStack runs the stack on an in-memory TUN device and returns the
+// client peer on the other end. It is shared by the tests since lwIP keeps
+// global state.
+func startStack() *tuntest.Peer {
+	stackOnce.Do(func() {
+		dev, peerDev := tuntest.NewPipe()
+		s := core.NewLWIPStack(true, true)
+		core.RegisterOutputFn(dev.Write)
+		go io.CopyBuffer(s, dev, make([]byte, 65535))
+		peer = tuntest.NewPeer(peerDev, net.IPv4(10, 0, 0, 2))
+	})
+	return peer
+}
+
+// socksServer is a SOCKS5 server stand-in, it connects CONNECT requests to
+// upstream whatever their target and echoes the datagrams of UDP
+// associations.
+type socksServer struct {
+	ln       net.Listener
+	relay    net.PacketConn
+	upstream string
+	targets  chan string
+}
+
+func newSOCKSServer(t *testing.T, upstream string) *socksServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		ln.Close()
+		t.Fatal(err)
+	}
+	s := &socksServer{ln: ln, relay: relay, upstream: upstream, targets: make(chan string, 16)}
+	t.Cleanup(func() {
+		ln.Close()
+		relay.Close()
+	})
+	go s.serve()
+	go s.echo()
+	return s
+}
+
+func (s *socksServer) port() uint16 {
+	return uint16(s.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *socksServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *socksServer) handle(c net.Conn) {
+	defer c.Close()
+	buf := make([]byte, MaxAddrLen)
+	// VER NMETHODS METHODS, answered with no authentication required.
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	c.Write([]byte{5, 0})
+	// VER CMD RSV DST.ADDR DST.PORT
+	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		return
+	}
+	cmd := buf[1]
+	addr, err := readAddr(c, buf)
+	if err != nil {
+		return
+	}
+	select {
+	case s.targets <- addr.String():
+	default:
+	}
+
+	switch cmd {
+	case socks5Connect:
+		up, err := net.Dial("tcp", s.upstream)
+		if err != nil {
+			c.Write([]byte{5, 5, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer up.Close()
+		c.Write([]byte{5, 0, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+		done := make(chan struct{})
+		go func() {
+			io.Copy(up, c)
+			up.(*net.TCPConn).CloseWrite()
+			close(done)
+		}()
+		io.Copy(c, up)
+		c.(*net.TCPConn).CloseWrite()
+		<-done
+	case socks5UDPAssociate:
+		c.Write(append([]byte{5, 0, 0}, ParseAddr(s.relay.LocalAddr().String())...))
+		// The association lasts as long as the connection.
+		io.Copy(io.Discard, c)
+	}
+}
+
+// echo sends the datagrams relayed back unchanged, their header naming the
+// target as the sender, as if the target had echoed them.
+func (s *socksServer) echo() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.relay.WriteTo(buf[:n], addr)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	p := startStack()
+	echo, err := tuntest.ListenEcho()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	srv := newSOCKSServer(t, echo.Addr())
+	core.RegisterTCPConnHandler(NewTCPHandler("127.0.0.1", srv.port()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	target := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+	c, err := p.DialTCP(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	go func() {
+		c.Write(data)
+		c.CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d bytes differ from the %d sent", len(got), len(data))
+	}
+	if err := c.WaitClosed(ctx); err != nil {
+		t.Errorf("connection not closed after both sides closed: %v", err)
+	}
+	if got := <-srv.targets; got != target.String() {
+		t.Errorf("proxy asked to connect to %v, want %v", got, target)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	echo, err := tuntest.ListenEcho()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	srv := newSOCKSServer(t, echo.Addr())
+	h := NewTCPHandler("127.0.0.1", srv.port()).(*tcpHandler)
+	target := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+
+	// The connection is not wrapped, relay half-closes it.
+	c, err := h.DialContext(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	dc, ok := c.(duplexConn)
+	if !ok {
+		t.Fatalf("dialed %T, want a connection closing each direction", c)
+	}
+	dc.Write([]byte("ping"))
+	dc.CloseWrite()
+	dc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got, err := io.ReadAll(dc); err != nil || string(got) != "ping" {
+		t.Errorf("echoed %q, %v", got, err)
+	}
+
+	// A refused CONNECT is reported as such.
+	refused := newSOCKSServer(t, "127.0.0.1:1")
+	h = NewTCPHandler("127.0.0.1", refused.port()).(*tcpHandler)
+	if _, err := h.DialContext(context.Background(), target); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("got %v, want ECONNREFUSED", err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	p := startStack()
+	srv := newSOCKSServer(t, "")
+	core.RegisterUDPConnHandler(NewUDPHandler("127.0.0.1", srv.port(), time.Minute))
+
+	target := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}
+	c, err := p.DialUDP(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := []byte("ping")
+	buf := make([]byte, 1500)
+	// The first datagram may be lost while the association is set up.
+	for i := 0; ; i++ {
+		c.Write(msg)
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			if i < 3 {
+				continue
+			}
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) || addr.String() != target.String() {
+			t.Errorf("got %q from %v, want %q from %v", buf[:n], addr, msg, target)
+		}
+		break
+	}
+}
@@ -1,9 +1,14 @@
 package socks
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"syscall"
 
 	"golang.org/x/net/proxy"
 
@@ -86,17 +91,68 @@ func (h *tcpHandler) relay(lhs, rhs net.Conn) {
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	dialer, err := proxy.SOCKS5("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), nil, nil)
+	return h.HandleContext(context.Background(), conn, target)
+}
+
+func (h *tcpHandler) HandleContext(ctx context.Context, conn net.Conn, target *net.TCPAddr) error {
+	c, err := h.DialContext(ctx, target)
 	if err != nil {
 		return err
 	}
+	return h.HandleDialed(ctx, conn, c, target)
+}
+
+// socksReplyErrors maps the errors of SOCKS replies to the errors the
+// stack turns into RSTs and ICMP destination unreachable messages.
+var socksReplyErrors = []struct {
+	reply string
+	err   error
+}{
+	{"network unreachable", syscall.ENETUNREACH},
+	{"host unreachable", syscall.EHOSTUNREACH},
+	{"TTL expired", syscall.EHOSTUNREACH},
+	{"connection refused", syscall.ECONNREFUSED},
+	{"connection not allowed by ruleset", syscall.EACCES},
+}
+
+// connDialer is implemented by the SOCKS5 dialer of x/net/proxy, it runs
+// the handshake on a connection dialed by the caller.
+type connDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+}
 
-	c, err := dialer.Dial(target.Network(), target.String())
+func (h *tcpHandler) DialContext(ctx context.Context, target *net.TCPAddr) (net.Conn, error) {
+	proxyAddr := core.ParseTCPAddr(h.proxyHost, h.proxyPort).String()
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	cd, ok := dialer.(connDialer)
+	if !ok {
+		return nil, errors.New("socks: dialer cannot dial on a connection")
+	}
+
+	// Dial the proxy here rather than through the dialer, which wraps the
+	// connection and hides CloseWrite from relay.
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cd.DialWithConn(ctx, c, target.Network(), target.String()); err != nil {
+		c.Close()
+		for _, e := range socksReplyErrors {
+			if strings.HasSuffix(err.Error(), e.reply) {
+				return nil, fmt.Errorf("%w: %v", e.err, err)
+			}
+		}
+		return nil, err
+	}
+	return c, nil
+}
 
-	go h.relay(conn, c)
+func (h *tcpHandler) HandleDialed(ctx context.Context, conn, upstream net.Conn, target *net.TCPAddr) error {
+	go h.relay(conn, upstream)
 
 	log.Infof("new proxy connection to %v", target)
 
@@ -1,6 +1,7 @@
 package socks
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -88,17 +89,25 @@ func (h *udpHandler) fetchUDPInput(conn core.UDPConn, input net.PacketConn) {
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return h.ConnectContext(context.Background(), conn, target)
+}
+
+func (h *udpHandler) ConnectContext(ctx context.Context, conn core.UDPConn, target *net.UDPAddr) error {
 	if target == nil {
-		return h.connectInternal(conn, "")
+		return h.connectInternal(ctx, conn, "")
 	}
-	return h.connectInternal(conn, target.String())
+	return h.connectInternal(ctx, conn, target.String())
 }
 
-func (h *udpHandler) connectInternal(conn core.UDPConn, dest string) error {
-	c, err := net.DialTimeout("tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String(), 4*time.Second)
+func (h *udpHandler) connectInternal(ctx context.Context, conn core.UDPConn, dest string) error {
+	d := &net.Dialer{Timeout: 4 * time.Second}
+	c, err := d.DialContext(ctx, "tcp", core.ParseTCPAddr(h.proxyHost, h.proxyPort).String())
 	if err != nil {
 		return err
 	}
+	// Interrupt the handshake if ctx is cancelled before it completes.
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
 
 	// send VER, NMETHODS, METHODS
 	c.Write([]byte{5, 1, 0})
@@ -0,0 +1,120 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Maximum number of queues of a TUN device, MAX_TAP_QUEUES of Linux.
+const maxQueues = 256
+
+var errInvalidQueueCount = errors.New("invalid TUN queue count")
+
+// MultiQueueDevice is a TUN device with several queues. Each queue is read
+// on its own, packets written to the device are spread across the queues
+// by flow, packets of a flow are written to the same queue in order.
+type MultiQueueDevice struct {
+	Queues []io.ReadWriteCloser
+
+	mu      sync.Mutex
+	batches [][][]byte
+}
+
+// queue returns the index of the queue of the flow of pkt.
+func (d *MultiQueueDevice) queue(pkt []byte) int {
+	if len(d.Queues) == 1 {
+		return 0
+	}
+	return int(flowHash(pkt) % uint32(len(d.Queues)))
+}
+
+func (d *MultiQueueDevice) Write(pkt []byte) (int, error) {
+	return d.Queues[d.queue(pkt)].Write(pkt)
+}
+
+// WriteBatch writes the packets of every queue as a batch if the queues
+// implement BatchWriter. It returns the number of packets written.
+func (d *MultiQueueDevice) WriteBatch(pkts [][]byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.batches) != len(d.Queues) {
+		d.batches = make([][][]byte, len(d.Queues))
+	}
+	for _, pkt := range pkts {
+		i := d.queue(pkt)
+		d.batches[i] = append(d.batches[i], pkt)
+	}
+	var written int
+	var err error
+	for i, batch := range d.batches {
+		if len(batch) == 0 {
+			continue
+		}
+		n, werr := writeBatch(d.Queues[i], batch)
+		written += n
+		if werr != nil && err == nil {
+			err = werr
+		}
+		for j := range batch {
+			batch[j] = nil
+		}
+		d.batches[i] = batch[:0]
+	}
+	return written, err
+}
+
+func writeBatch(w io.Writer, pkts [][]byte) (int, error) {
+	if bw, ok := w.(BatchWriter); ok {
+		return bw.WriteBatch(pkts)
+	}
+	for i, pkt := range pkts {
+		if _, err := w.Write(pkt); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
+func (d *MultiQueueDevice) Close() error {
+	var err error
+	for _, q := range d.Queues {
+		if cerr := q.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// flowHash hashes the addresses, and the ports of TCP and UDP, of an IP
+// packet.
+func flowHash(pkt []byte) uint32 {
+	var addrs []byte
+	var proto byte
+	var l4 int
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		addrs, proto, l4 = pkt[12:20], pkt[9], int(pkt[0]&0x0f)*4
+		// Only the first fragment has the ports, they are left out of
+		// every fragment so that a datagram goes to a single queue.
+		if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			proto = 0
+		}
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		addrs, proto, l4 = pkt[8:40], pkt[6], 40
+	default:
+		return 0
+	}
+	// FNV-1a.
+	h := uint32(2166136261)
+	for _, b := range addrs {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	if (proto == protoTCP || proto == protoUDP) && len(pkt) >= l4+4 {
+		for _, b := range pkt[l4 : l4+4] {
+			h = (h ^ uint32(b)) * 16777619
+		}
+	}
+	return h
+}
@@ -0,0 +1,84 @@
+package tun
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+type recordingQueue struct {
+	pkts [][]byte
+}
+
+func (q *recordingQueue) Read(b []byte) (int, error) { return 0, nil }
+func (q *recordingQueue) Close() error               { return nil }
+func (q *recordingQueue) Write(pkt []byte) (int, error) {
+	q.pkts = append(q.pkts, pkt)
+	return len(pkt), nil
+}
+
+func TestMultiQueueWriteBatch(t *testing.T) {
+	queues := make([]*recordingQueue, 4)
+	d := &MultiQueueDevice{}
+	for i := range queues {
+		queues[i] = &recordingQueue{}
+		d.Queues = append(d.Queues, queues[i])
+	}
+	// Segments of 8 flows, interleaved.
+	var pkts [][]byte
+	for seq := 0; seq < 3; seq++ {
+		for flow := 0; flow < 8; flow++ {
+			pkt, h := superPacket(flow%2 == 1, 10)
+			binary.BigEndian.PutUint16(pkt[h.csumStart+2:], uint16(flow))
+			pkt[len(pkt)-1] = byte(seq)
+			pkts = append(pkts, pkt)
+		}
+	}
+	if n, err := d.WriteBatch(pkts); n != len(pkts) || err != nil {
+		t.Fatalf("WriteBatch: %d, %v", n, err)
+	}
+
+	used := 0
+	for _, q := range queues {
+		if len(q.pkts) != 0 {
+			used++
+		}
+		// The segments of a flow are written to the queue in order.
+		next := make(map[string]byte)
+		for _, pkt := range q.pkts {
+			i := d.queue(pkt)
+			if d.Queues[i] != q {
+				t.Fatalf("packet written to queue of another flow")
+			}
+			flow := string(pkt[:len(pkt)-1])
+			if pkt[len(pkt)-1] != next[flow] {
+				t.Errorf("segment %d of flow out of order", pkt[len(pkt)-1])
+			}
+			next[flow]++
+		}
+	}
+	if used < 2 {
+		t.Errorf("%d queues used by 8 flows", used)
+	}
+}
+
+func TestFlowHashFragments(t *testing.T) {
+	udp := func(flags, offset uint16, payload []byte) []byte {
+		pkt := make([]byte, 20+len(payload))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[6:], flags|offset)
+		pkt[9] = protoUDP
+		copy(pkt[12:], []byte{10, 0, 0, 2, 1, 1, 1, 1})
+		copy(pkt[20:], payload)
+		return pkt
+	}
+	first := udp(0x2000, 0, []byte{0x13, 0x88, 0x00, 0x35, 0, 16, 0, 0})
+	last := udp(0, 1, make([]byte, 8))
+	if flowHash(first) != flowHash(last) {
+		t.Error("fragments of a datagram hash differently")
+	}
+	whole := udp(0, 0, []byte{0x13, 0x88, 0x00, 0x35, 0, 8, 0, 0})
+	other := udp(0, 0, []byte{0x13, 0x89, 0x00, 0x35, 0, 8, 0, 0})
+	if flowHash(whole) == flowHash(other) {
+		t.Error("ports of unfragmented datagrams not hashed")
+	}
+}
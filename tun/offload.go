@@ -0,0 +1,312 @@
+package tun
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// BatchWriter is implemented by TUN devices that write several packets at
+// once, e.g. coalescing TCP segments of a flow into a single write.
+type BatchWriter interface {
+	// WriteBatch writes pkts in order and returns the number of packets
+	// written.
+	WriteBatch(pkts [][]byte) (int, error)
+}
+
+// DropCounter is implemented by TUN devices dropping packets read that do
+// not fit the buffer passed to Read, e.g. segments of a TCP super-packet.
+type DropCounter interface {
+	// Dropped returns the number of packets dropped.
+	Dropped() uint64
+}
+
+// With IFF_VNET_HDR every packet on the TUN device is preceded by a
+// virtio_net_hdr describing its offloads.
+const (
+	virtioNetHdrLen = 10
+
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+)
+
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+// The header is in the byte order of the host.
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:])
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFIN = 0x01
+	tcpPSH = 0x08
+	tcpACK = 0x10
+	tcpCWR = 0x80
+
+	maxIPPacketLen = 0xffff
+)
+
+var errInvalidOffloadPacket = errors.New("invalid offload packet")
+
+func checksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum sums the pseudo header of a TCP segment of length bytes in
+// the IP packet pkt.
+func pseudoHeaderSum(pkt []byte, length int) uint32 {
+	var sum uint32
+	if pkt[0]>>4 == 4 {
+		sum = checksum(0, pkt[12:20])
+	} else {
+		sum = checksum(0, pkt[8:40])
+	}
+	return sum + protoTCP + uint32(length)
+}
+
+func setIPv4HeaderChecksum(ip []byte, hdrLen int) {
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:], ^foldChecksum(checksum(0, ip[:hdrLen])))
+}
+
+// completeChecksum fills in the checksum left partial by the kernel, the
+// checksum field holds the sum of the pseudo header.
+func completeChecksum(pkt []byte, h *virtioNetHdr) error {
+	start := int(h.csumStart)
+	off := start + int(h.csumOffset)
+	if off+2 > len(pkt) {
+		return errInvalidOffloadPacket
+	}
+	binary.BigEndian.PutUint16(pkt[off:], ^foldChecksum(checksum(0, pkt[start:])))
+	return nil
+}
+
+// splitTCP splits a TCP super-packet into segments of h.gsoSize bytes of
+// payload, the segments are stored in buf and appended to segs.
+func splitTCP(pkt []byte, h *virtioNetHdr, buf []byte, segs [][]byte) ([]byte, [][]byte, error) {
+	l4 := int(h.csumStart)
+	if len(pkt) == 0 || l4+20 > len(pkt) || h.gsoSize == 0 {
+		return buf, segs, errInvalidOffloadPacket
+	}
+	v4 := pkt[0]>>4 == 4
+	if v4 && l4 < 20 || !v4 && l4 < 40 {
+		return buf, segs, errInvalidOffloadPacket
+	}
+	hdrLen := l4 + int(pkt[l4+12]>>4)*4
+	if hdrLen < l4+20 || hdrLen > len(pkt) {
+		return buf, segs, errInvalidOffloadPacket
+	}
+	payload := pkt[hdrLen:]
+	mss := int(h.gsoSize)
+	n := (len(payload) + mss - 1) / mss
+	if need := len(payload) + n*hdrLen; cap(buf) < need {
+		buf = make([]byte, need)
+	}
+	buf = buf[:cap(buf)]
+
+	seq := binary.BigEndian.Uint32(pkt[l4+4:])
+	id := binary.BigEndian.Uint16(pkt[4:])
+	flags := pkt[l4+13]
+	pos := 0
+	for i := 0; i < n; i++ {
+		off := i * mss
+		end := off + mss
+		if end > len(payload) {
+			end = len(payload)
+		}
+		seg := buf[pos : pos+hdrLen+end-off]
+		pos += len(seg)
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		if v4 {
+			binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+			setIPv4HeaderChecksum(seg, l4)
+		} else {
+			binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)-40))
+		}
+
+		tcp := seg[l4:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(off))
+		f := flags
+		if i != 0 {
+			f &^= tcpCWR
+		}
+		if i != n-1 {
+			f &^= tcpFIN | tcpPSH
+		}
+		tcp[13] = f
+		tcp[16], tcp[17] = 0, 0
+		sum := checksum(pseudoHeaderSum(seg, len(tcp)), tcp)
+		binary.BigEndian.PutUint16(tcp[16:], ^foldChecksum(sum))
+		segs = append(segs, seg)
+	}
+	return buf, segs, nil
+}
+
+// tcpSegment returns the offset of the TCP header of pkt and the length of
+// the IP and TCP headers, or zeros if pkt is not a TCP segment that may be
+// coalesced: it carries payload, has only ACK and PSH set, and is neither an
+// IPv4 fragment nor has IPv6 extension headers.
+func tcpSegment(pkt []byte) (l4, hdrLen int) {
+	if len(pkt) < 40 {
+		return 0, 0
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if pkt[0]&0x0f != 5 || pkt[9] != protoTCP || binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 ||
+			int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			return 0, 0
+		}
+		l4 = 20
+	case 6:
+		if len(pkt) < 60 || pkt[6] != protoTCP || int(binary.BigEndian.Uint16(pkt[4:]))+40 != len(pkt) {
+			return 0, 0
+		}
+		l4 = 40
+	default:
+		return 0, 0
+	}
+	hdrLen = l4 + int(pkt[l4+12]>>4)*4
+	if hdrLen < l4+20 || hdrLen >= len(pkt) || pkt[l4+13]&^tcpPSH != tcpACK {
+		return 0, 0
+	}
+	return l4, hdrLen
+}
+
+// sameFlow reports whether the headers of the TCP segments a and b, both
+// of hdrLen bytes, are equal but for the fields that differ between
+// segments of a burst.
+func sameFlow(a, b []byte, l4, hdrLen int) bool {
+	if len(b) < hdrLen || b[0] != a[0] {
+		return false
+	}
+	if l4 == 20 {
+		// TOS, TTL, protocol and addresses.
+		if a[1] != b[1] || a[8] != b[8] || string(a[12:20]) != string(b[12:20]) {
+			return false
+		}
+	} else {
+		// Traffic class, flow label, hop limit and addresses.
+		if string(a[:4]) != string(b[:4]) || a[7] != b[7] || string(a[8:40]) != string(b[8:40]) {
+			return false
+		}
+	}
+	ta, tb := a[l4:hdrLen], b[l4:hdrLen]
+	// Ports, acknowledgment number, data offset, window and options.
+	return string(ta[:4]) == string(tb[:4]) && string(ta[8:13]) == string(tb[8:13]) &&
+		string(ta[14:16]) == string(tb[14:16]) && string(ta[18:]) == string(tb[18:])
+}
+
+// coalesceTCP merges the longest run of segments of a single flow at the
+// start of pkts into one super-packet, written after a virtio_net_hdr into
+// buf. It returns the packet and the number of segments merged, a single
+// segment is returned as is with a header requesting no offload.
+func coalesceTCP(pkts [][]byte, buf []byte) ([]byte, int) {
+	head := pkts[0]
+	l4, hdrLen := tcpSegment(head)
+	count := 1
+	length := len(head)
+	if l4 != 0 {
+		mss := len(head) - hdrLen
+		seq := binary.BigEndian.Uint32(head[l4+4:]) + uint32(mss)
+		last := mss
+		for _, pkt := range pkts[1:] {
+			if last != mss || pkts[count-1][l4+13]&tcpPSH != 0 {
+				break
+			}
+			if ql4, qhdrLen := tcpSegment(pkt); ql4 != l4 || qhdrLen != hdrLen || !sameFlow(head, pkt, l4, hdrLen) {
+				break
+			}
+			size := len(pkt) - hdrLen
+			if size > mss || binary.BigEndian.Uint32(pkt[l4+4:]) != seq || length+size > maxIPPacketLen {
+				break
+			}
+			seq += uint32(size)
+			last = size
+			length += size
+			count++
+		}
+	}
+
+	need := virtioNetHdrLen + length
+	if cap(buf) < need {
+		buf = make([]byte, need)
+	}
+	buf = buf[:need]
+	var h virtioNetHdr
+	if count == 1 {
+		h.encode(buf)
+		copy(buf[virtioNetHdrLen:], head)
+		return buf, 1
+	}
+
+	pkt := buf[virtioNetHdrLen:]
+	pos := copy(pkt, head)
+	for _, seg := range pkts[1:count] {
+		pos += copy(pkt[pos:], seg[hdrLen:])
+	}
+	// The flags of the last segment carry PSH.
+	pkt[l4+13] |= pkts[count-1][l4+13]
+	if l4 == 20 {
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		setIPv4HeaderChecksum(pkt, l4)
+		h.gsoType = virtioNetHdrGSOTCPv4
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		h.gsoType = virtioNetHdrGSOTCPv6
+	}
+	// The kernel computes the checksum of every segment from the sum of
+	// the pseudo header.
+	tcp := pkt[l4:]
+	binary.BigEndian.PutUint16(tcp[16:], foldChecksum(pseudoHeaderSum(pkt, len(tcp))))
+	h.flags = virtioNetHdrFNeedsCsum
+	h.hdrLen = uint16(hdrLen)
+	h.gsoSize = uint16(len(head) - hdrLen)
+	h.csumStart = uint16(l4)
+	h.csumOffset = 16
+	h.encode(buf)
+	return buf, count
+}
@@ -0,0 +1,125 @@
+package tun
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// offloadDevice is a TUN device opened with IFF_VNET_HDR. TCP super-packets
+// read from the kernel are split into segments returned by successive
+// Reads, segments passed to WriteBatch are coalesced into super-packets.
+type offloadDevice struct {
+	f *os.File
+
+	// Read side, Read is not safe for concurrent use.
+	rbuf    []byte
+	segBuf  []byte
+	pending [][]byte
+	dropped atomic.Uint64
+
+	wmu  sync.Mutex
+	wbuf []byte
+}
+
+// OpenTunDeviceWithOffload opens a TUN device with TCP segmentation and
+// checksum offload, packets read and written are plain IP packets as with
+// OpenTunDevice. The device also implements BatchWriter.
+func OpenTunDeviceWithOffload(name, addr, gw, mask string, dns []string, persist bool) (io.ReadWriteCloser, error) {
+	f, err := openTunQueue(name, unix.IFF_VNET_HDR, persist)
+	if err != nil {
+		return nil, err
+	}
+	return newOffloadDevice(f), nil
+}
+
+func newOffloadDevice(f *os.File) *offloadDevice {
+	return &offloadDevice{
+		f:    f,
+		rbuf: make([]byte, virtioNetHdrLen+maxIPPacketLen),
+	}
+}
+
+// Read reads a packet into b. Packets and segments larger than b are
+// dropped and counted, see Dropped.
+func (d *offloadDevice) Read(b []byte) (int, error) {
+	for {
+		if len(d.pending) > 0 {
+			seg := d.pending[0]
+			d.pending = d.pending[1:]
+			if len(b) < len(seg) {
+				d.dropped.Add(1)
+				continue
+			}
+			return copy(b, seg), nil
+		}
+		n, err := d.f.Read(d.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		if n < virtioNetHdrLen {
+			continue
+		}
+		var h virtioNetHdr
+		h.decode(d.rbuf)
+		pkt := d.rbuf[virtioNetHdrLen:n]
+		switch h.gsoType &^ virtioNetHdrGSOECN {
+		case virtioNetHdrGSONone:
+			if h.flags&virtioNetHdrFNeedsCsum != 0 && completeChecksum(pkt, &h) != nil {
+				continue
+			}
+			if len(b) < len(pkt) {
+				d.dropped.Add(1)
+				continue
+			}
+			return copy(b, pkt), nil
+		case virtioNetHdrGSOTCPv4, virtioNetHdrGSOTCPv6:
+			// Malformed super-packets are dropped.
+			d.segBuf, d.pending, _ = splitTCP(pkt, &h, d.segBuf, d.pending[:0])
+		}
+	}
+}
+
+// Dropped returns the number of packets read that did not fit the buffer
+// passed to Read.
+func (d *offloadDevice) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+func (d *offloadDevice) Write(pkt []byte) (int, error) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if cap(d.wbuf) < virtioNetHdrLen+len(pkt) {
+		d.wbuf = make([]byte, virtioNetHdrLen+len(pkt))
+	}
+	buf := d.wbuf[:virtioNetHdrLen+len(pkt)]
+	var h virtioNetHdr
+	h.encode(buf)
+	copy(buf[virtioNetHdrLen:], pkt)
+	if _, err := d.f.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(pkt), nil
+}
+
+func (d *offloadDevice) WriteBatch(pkts [][]byte) (int, error) {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	written := 0
+	for written < len(pkts) {
+		buf, n := coalesceTCP(pkts[written:], d.wbuf)
+		d.wbuf = buf
+		if _, err := d.f.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (d *offloadDevice) Close() error {
+	return d.f.Close()
+}
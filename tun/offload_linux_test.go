@@ -0,0 +1,58 @@
+package tun
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOffloadDeviceDropsOversized(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newOffloadDevice(os.NewFile(uintptr(fds[0]), "tun"))
+	defer d.Close()
+	kernel := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernel.Close()
+	write := func(pkt []byte, h virtioNetHdr) {
+		buf := make([]byte, virtioNetHdrLen+len(pkt))
+		h.encode(buf)
+		copy(buf[virtioNetHdrLen:], pkt)
+		if _, err := kernel.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first segment of the super-packet and the large plain packet do
+	// not fit, the last segment and the small packet are read.
+	pkt, h := superPacket(false, 2500)
+	h.gsoSize = 2000
+	write(pkt, h)
+	large := make([]byte, 2000)
+	large[0] = 0x45
+	write(large, virtioNetHdr{})
+	small := bytes.Repeat([]byte{0x45}, 100)
+	write(small, virtioNetHdr{})
+
+	b := make([]byte, 1500)
+	n, err := d.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int(h.hdrLen) + 500; n != want {
+		t.Errorf("read %d bytes, want the last segment of %d", n, want)
+	}
+	n, err = d.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], small) {
+		t.Errorf("read %d bytes, want the small packet", n)
+	}
+	if got := d.Dropped(); got != 2 {
+		t.Errorf("%d packets dropped, want 2", got)
+	}
+}
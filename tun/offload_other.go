@@ -0,0 +1,18 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"io"
+)
+
+// OpenTunDeviceWithOffload is only supported on Linux.
+func OpenTunDeviceWithOffload(name, addr, gw, mask string, dns []string, persist bool) (io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN offload is only supported on Linux")
+}
+
+// OpenTunDeviceMultiQueue is only supported on Linux.
+func OpenTunDeviceMultiQueue(name, addr, gw, mask string, dns []string, persist bool, queues int, offload bool) (*MultiQueueDevice, error) {
+	return nil, errors.New("multi-queue TUN is only supported on Linux")
+}
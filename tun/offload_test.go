@@ -0,0 +1,119 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// superPacket builds a TCP packet with a timestamp option and payload bytes
+// of payload, over IPv4 or IPv6.
+func superPacket(v6 bool, payload int) ([]byte, virtioNetHdr) {
+	l4 := 20
+	if v6 {
+		l4 = 40
+	}
+	hdrLen := l4 + 32
+	pkt := make([]byte, hdrLen+payload)
+	if v6 {
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		pkt[6] = protoTCP
+		pkt[7] = 64
+		pkt[23], pkt[39] = 2, 1
+	} else {
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[4:], 100)
+		pkt[8] = 64
+		pkt[9] = protoTCP
+		copy(pkt[12:], []byte{10, 0, 0, 2, 10, 0, 0, 1})
+		setIPv4HeaderChecksum(pkt, l4)
+	}
+	tcp := pkt[l4:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 80)
+	binary.BigEndian.PutUint32(tcp[4:], 0xfffff000)
+	binary.BigEndian.PutUint32(tcp[8:], 1)
+	tcp[12] = 8 << 4
+	tcp[13] = tcpACK | tcpPSH
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	copy(tcp[20:], []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2})
+	for i := hdrLen; i < len(pkt); i++ {
+		pkt[i] = byte(i)
+	}
+	gsoType := uint8(virtioNetHdrGSOTCPv4)
+	if v6 {
+		gsoType = virtioNetHdrGSOTCPv6
+	}
+	return pkt, virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		gsoType:    gsoType,
+		hdrLen:     uint16(hdrLen),
+		gsoSize:    1000,
+		csumStart:  uint16(l4),
+		csumOffset: 16,
+	}
+}
+
+func TestSplitAndCoalesceTCP(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		pkt, h := superPacket(v6, 2500)
+		l4, hdrLen := int(h.csumStart), int(h.hdrLen)
+		_, segs, err := splitTCP(pkt, &h, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segs) != 3 {
+			t.Fatalf("%d segments, want 3", len(segs))
+		}
+		var payload []byte
+		for i, seg := range segs {
+			tcp := seg[l4:]
+			if !v6 && foldChecksum(checksum(0, seg[:l4])) != 0xffff {
+				t.Errorf("segment %d: bad IPv4 header checksum", i)
+			}
+			if foldChecksum(checksum(pseudoHeaderSum(seg, len(tcp)), tcp)) != 0xffff {
+				t.Errorf("segment %d: bad TCP checksum", i)
+			}
+			if seq := binary.BigEndian.Uint32(tcp[4:]); seq != 0xfffff000+uint32(i*1000) {
+				t.Errorf("segment %d: seq %x", i, seq)
+			}
+			if psh := tcp[13]&tcpPSH != 0; psh != (i == 2) {
+				t.Errorf("segment %d: PSH %v", i, psh)
+			}
+			payload = append(payload, seg[hdrLen:]...)
+		}
+		if !bytes.Equal(payload, pkt[hdrLen:]) {
+			t.Errorf("payload mismatch")
+		}
+
+		// Coalescing the segments gives back the super-packet, a segment of
+		// another flow is not merged.
+		other, _ := superPacket(v6, 100)
+		other[l4+1]++
+		buf, n := coalesceTCP(append(segs, other), nil)
+		if n != 3 {
+			t.Fatalf("%d segments coalesced, want 3", n)
+		}
+		var ch virtioNetHdr
+		ch.decode(buf)
+		if ch != h {
+			t.Errorf("header %+v, want %+v", ch, h)
+		}
+		_, resegs, err := splitTCP(buf[virtioNetHdrLen:], &ch, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range segs {
+			if !bytes.Equal(resegs[i], segs[i]) {
+				t.Errorf("segment %d differs after coalescing", i)
+			}
+		}
+
+		buf, n = coalesceTCP([][]byte{other}, buf)
+		if n != 1 || !bytes.Equal(buf[virtioNetHdrLen:], other) || buf[1] != virtioNetHdrGSONone {
+			t.Errorf("single segment not passed as is")
+		}
+	}
+}
@@ -2,8 +2,10 @@ package tun
 
 import (
 	"io"
+	"os"
 
 	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
 )
 
 func OpenTunDevice(name, addr, gw, mask string, dns []string, persist bool) (io.ReadWriteCloser, error) {
@@ -18,3 +20,67 @@ func OpenTunDevice(name, addr, gw, mask string, dns []string, persist bool) (io.
 	}
 	return tunDev, nil
 }
+
+// openTunQueue opens a queue of the TUN device name with the IFF_* flags in
+// addition to IFF_TUN and IFF_NO_PI. The file is non-blocking so that Close
+// interrupts a pending Read.
+func openTunQueue(name string, flags uint16, persist bool) (*os.File, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | flags)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("TUNSETIFF", err)
+	}
+	if persist {
+		if err := unix.IoctlSetInt(fd, unix.TUNSETPERSIST, 1); err != nil {
+			unix.Close(fd)
+			return nil, os.NewSyscallError("TUNSETPERSIST", err)
+		}
+	}
+	if flags&unix.IFF_VNET_HDR != 0 {
+		if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, unix.TUN_F_CSUM|unix.TUN_F_TSO4|unix.TUN_F_TSO6); err != nil {
+			unix.Close(fd)
+			return nil, os.NewSyscallError("TUNSETOFFLOAD", err)
+		}
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+// OpenTunDeviceMultiQueue opens queues queues of a multi-queue TUN device,
+// each queue should be read by its own goroutine. With offload the queues
+// are opened as by OpenTunDeviceWithOffload.
+func OpenTunDeviceMultiQueue(name, addr, gw, mask string, dns []string, persist bool, queues int, offload bool) (*MultiQueueDevice, error) {
+	if queues < 1 || queues > maxQueues {
+		return nil, errInvalidQueueCount
+	}
+	flags := uint16(unix.IFF_MULTI_QUEUE)
+	if offload {
+		flags |= unix.IFF_VNET_HDR
+	}
+	d := &MultiQueueDevice{}
+	for i := 0; i < queues; i++ {
+		f, err := openTunQueue(name, flags, persist)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		if offload {
+			d.Queues = append(d.Queues, newOffloadDevice(f))
+		} else {
+			d.Queues = append(d.Queues, f)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,77 @@
+package tuntest
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// EchoServer is a local stand-in for remote hosts, it echoes TCP streams
+// and UDP datagrams on the same loopback port.
+type EchoServer struct {
+	TCP net.Listener
+	UDP net.PacketConn
+}
+
+// ListenEcho starts an EchoServer on a free port of 127.0.0.1.
+func ListenEcho() (*EchoServer, error) {
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		pc, err := net.ListenPacket("udp", ln.Addr().String())
+		if err != nil {
+			// The port is taken for UDP, try another one.
+			ln.Close()
+			continue
+		}
+		s := &EchoServer{TCP: ln, UDP: pc}
+		go s.serveTCP()
+		go s.serveUDP()
+		return s, nil
+	}
+	return nil, errors.New("no free port for both TCP and UDP")
+}
+
+// Addr returns the address the server listens on.
+func (s *EchoServer) Addr() string {
+	return s.TCP.Addr().String()
+}
+
+func (s *EchoServer) serveTCP() {
+	for {
+		c, err := s.TCP.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			// Close the sending side once the client closed its own.
+			if _, err := io.Copy(c, c); err == nil {
+				c.(*net.TCPConn).CloseWrite()
+				io.Copy(io.Discard, c)
+			}
+		}()
+	}
+}
+
+func (s *EchoServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.UDP.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.UDP.WriteTo(buf[:n], addr)
+	}
+}
+
+// Close stops the server, established connections are left open.
+func (s *EchoServer) Close() error {
+	err := s.TCP.Close()
+	if uerr := s.UDP.Close(); err == nil {
+		err = uerr
+	}
+	return err
+}
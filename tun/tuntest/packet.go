@@ -0,0 +1,196 @@
+package tuntest
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// segment is a parsed TCP segment or UDP datagram.
+type segment struct {
+	proto   byte
+	src     net.IP
+	dst     net.IP
+	srcPort uint16
+	dstPort uint16
+
+	// TCP only.
+	seq    uint32
+	ack    uint32
+	flags  byte
+	window uint16
+
+	payload []byte
+}
+
+func checksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeaderSum(src, dst net.IP, proto byte, length int) uint32 {
+	sum := checksum(0, src)
+	sum = checksum(sum, dst)
+	return sum + uint32(proto) + uint32(length)
+}
+
+// buildIP wraps a transport payload into an IPv4 or IPv6 packet depending
+// on the address family of src, the transport checksum at csumOff is
+// filled in.
+func buildIP(src, dst net.IP, proto byte, transport []byte, csumOff int) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		src, dst = src4, dst4
+	} else {
+		src, dst = src.To16(), dst.To16()
+	}
+	binary.BigEndian.PutUint16(transport[csumOff:], 0)
+	csum := foldChecksum(checksum(pseudoHeaderSum(src, dst, proto, len(transport)), transport))
+	if proto == protoUDP && csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(transport[csumOff:], csum)
+
+	if len(src) == net.IPv4len {
+		pkt := make([]byte, 20+len(transport))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[6] = 0x40 // DF
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src)
+		copy(pkt[16:20], dst)
+		binary.BigEndian.PutUint16(pkt[10:], foldChecksum(checksum(0, pkt[:20])))
+		copy(pkt[20:], transport)
+		return pkt
+	}
+	pkt := make([]byte, 40+len(transport))
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(transport)))
+	pkt[6] = proto
+	pkt[7] = 64
+	copy(pkt[8:24], src)
+	copy(pkt[24:40], dst)
+	copy(pkt[40:], transport)
+	return pkt
+}
+
+func buildTCP(s *segment, mss uint16) []byte {
+	hdrLen := 20
+	if mss != 0 {
+		hdrLen += 4
+	}
+	b := make([]byte, hdrLen+len(s.payload))
+	binary.BigEndian.PutUint16(b[0:], s.srcPort)
+	binary.BigEndian.PutUint16(b[2:], s.dstPort)
+	binary.BigEndian.PutUint32(b[4:], s.seq)
+	binary.BigEndian.PutUint32(b[8:], s.ack)
+	b[12] = byte(hdrLen/4) << 4
+	b[13] = s.flags
+	binary.BigEndian.PutUint16(b[14:], s.window)
+	if mss != 0 {
+		b[20], b[21] = 2, 4
+		binary.BigEndian.PutUint16(b[22:], mss)
+	}
+	copy(b[hdrLen:], s.payload)
+	return buildIP(s.src, s.dst, protoTCP, b, 16)
+}
+
+func buildUDP(s *segment) []byte {
+	b := make([]byte, 8+len(s.payload))
+	binary.BigEndian.PutUint16(b[0:], s.srcPort)
+	binary.BigEndian.PutUint16(b[2:], s.dstPort)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	copy(b[8:], s.payload)
+	return buildIP(s.src, s.dst, protoUDP, b, 6)
+}
+
+var errMalformed = errors.New("malformed packet")
+
+// parse parses a TCP or UDP packet, fragmented packets and IPv6 extension
+// headers are not supported.
+func parse(pkt []byte) (*segment, error) {
+	if len(pkt) < 1 {
+		return nil, errMalformed
+	}
+	s := &segment{}
+	var transport []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, errMalformed
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:]))
+		if total > len(pkt) || ihl > total {
+			return nil, errMalformed
+		}
+		s.proto = pkt[9]
+		s.src = net.IP(append([]byte(nil), pkt[12:16]...))
+		s.dst = net.IP(append([]byte(nil), pkt[16:20]...))
+		transport = pkt[ihl:total]
+	case 6:
+		if len(pkt) < 40 {
+			return nil, errMalformed
+		}
+		total := 40 + int(binary.BigEndian.Uint16(pkt[4:]))
+		if total > len(pkt) {
+			return nil, errMalformed
+		}
+		s.proto = pkt[6]
+		s.src = net.IP(append([]byte(nil), pkt[8:24]...))
+		s.dst = net.IP(append([]byte(nil), pkt[24:40]...))
+		transport = pkt[40:total]
+	default:
+		return nil, errMalformed
+	}
+
+	switch s.proto {
+	case protoTCP:
+		if len(transport) < 20 {
+			return nil, errMalformed
+		}
+		off := int(transport[12]>>4) * 4
+		if off < 20 || off > len(transport) {
+			return nil, errMalformed
+		}
+		s.srcPort = binary.BigEndian.Uint16(transport[0:])
+		s.dstPort = binary.BigEndian.Uint16(transport[2:])
+		s.seq = binary.BigEndian.Uint32(transport[4:])
+		s.ack = binary.BigEndian.Uint32(transport[8:])
+		s.flags = transport[13]
+		s.window = binary.BigEndian.Uint16(transport[14:])
+		s.payload = append([]byte(nil), transport[off:]...)
+	case protoUDP:
+		if len(transport) < 8 {
+			return nil, errMalformed
+		}
+		s.srcPort = binary.BigEndian.Uint16(transport[0:])
+		s.dstPort = binary.BigEndian.Uint16(transport[2:])
+		s.payload = append([]byte(nil), transport[8:]...)
+	}
+	return s, nil
+}
@@ -0,0 +1,136 @@
+package tuntest
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// Peer is a userspace client sitting on the peer end of a TUN pipe, it
+// plays the role of the applications whose traffic the stack intercepts.
+// It implements just enough TCP to establish connections, transfer data
+// in order and close them over a lossless link.
+type Peer struct {
+	dev io.ReadWriteCloser
+	ip  net.IP
+
+	mu       sync.Mutex
+	nextPort uint16
+	tcpConns map[flowKey]*TCPConn
+	udpConns map[flowKey]*UDPConn
+
+	// Unhandled receives packets not belonging to any connection, it is
+	// never closed and packets are dropped when it is full.
+	Unhandled chan []byte
+
+	done chan struct{}
+}
+
+type flowKey struct {
+	proto   byte
+	local   uint16
+	remote  string
+	rmtPort uint16
+}
+
+// NewPeer starts a peer with address ip reading from and writing to dev.
+func NewPeer(dev io.ReadWriteCloser, ip net.IP) *Peer {
+	p := &Peer{
+		dev:       dev,
+		ip:        ip,
+		nextPort:  uint16(20000 + rand.Intn(20000)),
+		tcpConns:  make(map[flowKey]*TCPConn),
+		udpConns:  make(map[flowKey]*UDPConn),
+		Unhandled: make(chan []byte, 64),
+		done:      make(chan struct{}),
+	}
+	go p.readLoop()
+	return p
+}
+
+// Close closes the underlying device and all connections.
+func (p *Peer) Close() error {
+	err := p.dev.Close()
+	<-p.done
+	return err
+}
+
+func (p *Peer) allocPort() uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextPort++
+	if p.nextPort < 20000 {
+		p.nextPort = 20000
+	}
+	return p.nextPort
+}
+
+func (p *Peer) send(pkt []byte) error {
+	_, err := p.dev.Write(pkt)
+	return err
+}
+
+func (p *Peer) readLoop() {
+	defer close(p.done)
+	buf := make([]byte, 65535)
+	for {
+		n, err := p.dev.Read(buf)
+		if err != nil {
+			p.mu.Lock()
+			for _, c := range p.tcpConns {
+				c.fail(net.ErrClosed)
+			}
+			for _, c := range p.udpConns {
+				c.close()
+			}
+			p.mu.Unlock()
+			return
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		s, err := parse(pkt)
+		if err != nil || (s.proto != protoTCP && s.proto != protoUDP) {
+			p.unhandled(pkt)
+			continue
+		}
+		key := flowKey{proto: s.proto, local: s.dstPort, remote: s.src.String(), rmtPort: s.srcPort}
+		p.mu.Lock()
+		tc := p.tcpConns[key]
+		uc := p.udpConns[key]
+		if uc == nil && s.proto == protoUDP {
+			// Unconnected sockets accept datagrams from any source.
+			uc = p.udpConns[flowKey{proto: protoUDP, local: s.dstPort}]
+		}
+		p.mu.Unlock()
+		switch {
+		case tc != nil:
+			tc.input(s)
+		case uc != nil:
+			uc.input(s)
+		default:
+			p.unhandled(pkt)
+		}
+	}
+}
+
+func (p *Peer) unhandled(pkt []byte) {
+	select {
+	case p.Unhandled <- pkt:
+	default:
+	}
+}
+
+func (p *Peer) removeTCP(c *TCPConn) {
+	p.mu.Lock()
+	delete(p.tcpConns, c.key)
+	p.mu.Unlock()
+}
+
+func (p *Peer) removeUDP(c *UDPConn) {
+	p.mu.Lock()
+	delete(p.udpConns, c.key)
+	p.mu.Unlock()
+}
+
+var errUnsupportedAddr = errors.New("address family mismatch")
@@ -0,0 +1,419 @@
+package tuntest
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	peerMSS    = 1460
+	peerWindow = 65535
+
+	// retransmitInterval is how often unacknowledged data is resent, the
+	// link is lossless but the stack may drop segments under pressure, or
+	// refuse them while the handler connects.
+	retransmitInterval = 200 * time.Millisecond
+)
+
+type tcpState int
+
+const (
+	tcpSynSent tcpState = iota
+	tcpEstablished
+	tcpClosed
+)
+
+// TCPConn is a client-side TCP connection of a Peer, it implements
+// net.Conn.
+type TCPConn struct {
+	peer  *Peer
+	key   flowKey
+	laddr *net.TCPAddr
+	raddr *net.TCPAddr
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	state   tcpState
+	err     error
+	iss     uint32
+	sndUna  uint32
+	sndNxt  uint32
+	sndWnd  uint32
+	sndBuf  []byte // unacknowledged data starting at sndUna
+	finSent bool
+	finAckd bool
+
+	// closed is set by Close, received data is discarded from then on.
+	closed bool
+
+	rcvNxt    uint32
+	rcvBuf    []byte
+	rcvFin    bool
+	rcvAdvWnd uint16 // last advertised receive window
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	established chan struct{}
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+
+// DialTCP opens a TCP connection from the peer to raddr through the
+// device, it returns once the three-way handshake completes.
+func (p *Peer) DialTCP(ctx context.Context, raddr *net.TCPAddr) (*TCPConn, error) {
+	if (raddr.IP.To4() == nil) != (p.ip.To4() == nil) {
+		return nil, errUnsupportedAddr
+	}
+	port := p.allocPort()
+	c := &TCPConn{
+		peer:        p,
+		key:         flowKey{proto: protoTCP, local: port, remote: raddr.IP.String(), rmtPort: uint16(raddr.Port)},
+		laddr:       &net.TCPAddr{IP: p.ip, Port: int(port)},
+		raddr:       raddr,
+		iss:         uint32(time.Now().UnixNano()),
+		established: make(chan struct{}),
+		stop:        make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+
+	p.mu.Lock()
+	p.tcpConns[c.key] = c
+	p.mu.Unlock()
+
+	t := time.NewTicker(retransmitInterval)
+	defer t.Stop()
+	for {
+		if err := p.send(c.segment(tcpSYN, c.iss, nil, peerMSS)); err != nil {
+			c.fail(err)
+			return nil, err
+		}
+		select {
+		case <-c.established:
+			c.mu.Lock()
+			err := c.err
+			c.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			go c.retransmitLoop()
+			return c, nil
+		case <-ctx.Done():
+			c.fail(ctx.Err())
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// rcvWnd returns the receive window, it shrinks as unread data piles up.
+func (c *TCPConn) rcvWnd() uint16 {
+	if len(c.rcvBuf) >= peerWindow {
+		return 0
+	}
+	return uint16(peerWindow - len(c.rcvBuf))
+}
+
+func (c *TCPConn) segment(flags byte, seq uint32, payload []byte, mss uint16) []byte {
+	c.rcvAdvWnd = c.rcvWnd()
+	return buildTCP(&segment{
+		src:     c.laddr.IP,
+		dst:     c.raddr.IP,
+		srcPort: uint16(c.laddr.Port),
+		dstPort: uint16(c.raddr.Port),
+		seq:     seq,
+		ack:     c.rcvNxt,
+		flags:   flags,
+		window:  c.rcvAdvWnd,
+		payload: payload,
+	}, mss)
+}
+
+func (c *TCPConn) input(s *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if s.flags&tcpRST != 0 {
+		c.failLocked(syscall.ECONNRESET)
+		return
+	}
+
+	if c.state == tcpSynSent {
+		if s.flags&(tcpSYN|tcpACK) != tcpSYN|tcpACK || s.ack != c.iss+1 {
+			return
+		}
+		c.rcvNxt = s.seq + 1
+		c.sndUna = s.ack
+		c.sndWnd = uint32(s.window)
+		c.state = tcpEstablished
+		c.peer.send(c.segment(tcpACK, c.sndNxt, nil, 0))
+		close(c.established)
+		return
+	}
+	if c.state != tcpEstablished {
+		return
+	}
+
+	if s.flags&tcpACK != 0 {
+		if seqLT(c.sndUna, s.ack) && !seqLT(c.sndNxt, s.ack) {
+			acked := s.ack - c.sndUna
+			if c.finSent && s.ack == c.sndNxt {
+				c.finAckd = true
+				acked--
+			}
+			c.sndBuf = c.sndBuf[acked:]
+			c.sndUna = s.ack
+		}
+		c.sndWnd = uint32(s.window)
+	}
+
+	needAck := false
+	if len(s.payload) > 0 {
+		needAck = true
+		if s.seq == c.rcvNxt && !c.rcvFin {
+			// Drop what does not fit in the window, it gets resent.
+			payload := s.payload
+			if wnd := int(c.rcvWnd()); len(payload) > wnd {
+				payload = payload[:wnd]
+			}
+			if !c.closed {
+				c.rcvBuf = append(c.rcvBuf, payload...)
+			}
+			c.rcvNxt += uint32(len(payload))
+			if len(payload) < len(s.payload) {
+				s.flags &^= tcpFIN
+			}
+		}
+	}
+	if s.flags&tcpFIN != 0 {
+		needAck = true
+		if s.seq+uint32(len(s.payload)) == c.rcvNxt && !c.rcvFin {
+			c.rcvFin = true
+			c.rcvNxt++
+		}
+	}
+	if needAck {
+		c.peer.send(c.segment(tcpACK, c.sndNxt, nil, 0))
+	}
+	if c.rcvFin && c.finAckd {
+		c.state = tcpClosed
+		c.shutdown()
+	}
+}
+
+func (c *TCPConn) retransmitLoop() {
+	t := time.NewTicker(retransmitInterval)
+	defer t.Stop()
+	lastUna := uint32(0)
+	for {
+		select {
+		case <-t.C:
+		case <-c.stop:
+			return
+		}
+		c.mu.Lock()
+		if c.state == tcpEstablished && c.sndUna == lastUna && c.sndUna != c.sndNxt {
+			// Go back to the first unacknowledged byte and resend all
+			// data in flight, the stack drops what follows a lost
+			// segment.
+			for off := 0; off < len(c.sndBuf); off += peerMSS {
+				n := min(len(c.sndBuf)-off, peerMSS)
+				c.peer.send(c.segment(tcpACK|tcpPSH, c.sndUna+uint32(off), c.sndBuf[off:off+n], 0))
+			}
+			if c.finSent && !c.finAckd {
+				c.peer.send(c.segment(tcpFIN|tcpACK, c.sndNxt-1, nil, 0))
+			}
+		}
+		lastUna = c.sndUna
+		c.mu.Unlock()
+	}
+}
+
+func (c *TCPConn) shutdown() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.peer.removeTCP(c)
+	})
+}
+
+func (c *TCPConn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	if c.state == tcpSynSent {
+		close(c.established)
+	}
+	c.state = tcpClosed
+	c.shutdown()
+}
+
+func (c *TCPConn) fail(err error) {
+	c.mu.Lock()
+	c.failLocked(err)
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// waitLocked waits for a state change or until deadline.
+func (c *TCPConn) waitLocked(deadline time.Time) error {
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.AfterFunc(d, c.cond.Broadcast)
+		defer t.Stop()
+	}
+	c.cond.Wait()
+	return nil
+}
+
+func (c *TCPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.rcvBuf) == 0 {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if c.rcvFin {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.waitLocked(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rcvBuf)
+	c.rcvBuf = c.rcvBuf[n:]
+	if c.state == tcpEstablished && c.rcvAdvWnd < peerWindow/2 && c.rcvWnd() >= peerWindow/2 {
+		// Window update.
+		c.peer.send(c.segment(tcpACK, c.sndNxt, nil, 0))
+	}
+	return n, nil
+}
+
+func (c *TCPConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.closed {
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.finSent {
+			return written, io.ErrClosedPipe
+		}
+		inflight := uint32(len(c.sndBuf))
+		if inflight >= c.sndWnd {
+			if err := c.waitLocked(c.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > peerMSS {
+			n = peerMSS
+		}
+		if uint32(n) > c.sndWnd-inflight {
+			n = int(c.sndWnd - inflight)
+		}
+		chunk := b[written : written+n]
+		c.sndBuf = append(c.sndBuf, chunk...)
+		if err := c.peer.send(c.segment(tcpACK|tcpPSH, c.sndNxt, chunk, 0)); err != nil {
+			return written, err
+		}
+		c.sndNxt += uint32(n)
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN segment, the reading side stays open.
+func (c *TCPConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finSent || c.state != tcpEstablished {
+		return nil
+	}
+	c.finSent = true
+	err := c.peer.send(c.segment(tcpFIN|tcpACK, c.sndNxt, nil, 0))
+	c.sndNxt++
+	return err
+}
+
+// Close sends a FIN segment and discards the data received from then on,
+// the connection is acknowledged until the remote side closes it as well.
+func (c *TCPConn) Close() error {
+	err := c.CloseWrite()
+	c.mu.Lock()
+	c.closed = true
+	c.rcvBuf = nil
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return err
+}
+
+// Abort resets the connection.
+func (c *TCPConn) Abort() error {
+	c.mu.Lock()
+	err := c.peer.send(c.segment(tcpRST|tcpACK, c.sndNxt, nil, 0))
+	c.mu.Unlock()
+	c.fail(syscall.ECONNRESET)
+	return err
+}
+
+// WaitClosed blocks until both sides have closed the connection or it is
+// reset, or ctx is done.
+func (c *TCPConn) WaitClosed(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, c.cond.Broadcast)
+	defer stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.state != tcpClosed {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.cond.Wait()
+	}
+	return c.err
+}
+
+func (c *TCPConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *TCPConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,152 @@
+package tuntest
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDPConn is a client-side UDP socket of a Peer, it implements
+// net.PacketConn.
+type UDPConn struct {
+	peer  *Peer
+	key   flowKey
+	laddr *net.UDPAddr
+	raddr *net.UDPAddr // nil for unconnected sockets
+
+	mu           sync.Mutex
+	rx           chan *segment
+	closed       chan struct{}
+	closeOnce    sync.Once
+	readDeadline time.Time
+}
+
+// DialUDP opens a UDP socket connected to raddr, it only receives
+// datagrams sent from raddr.
+func (p *Peer) DialUDP(raddr *net.UDPAddr) (*UDPConn, error) {
+	if (raddr.IP.To4() == nil) != (p.ip.To4() == nil) {
+		return nil, errUnsupportedAddr
+	}
+	port := p.allocPort()
+	return p.newUDP(flowKey{proto: protoUDP, local: port, remote: raddr.IP.String(), rmtPort: uint16(raddr.Port)}, raddr), nil
+}
+
+// ListenUDP opens an unconnected UDP socket on port, zero picks a port.
+func (p *Peer) ListenUDP(port uint16) *UDPConn {
+	if port == 0 {
+		port = p.allocPort()
+	}
+	return p.newUDP(flowKey{proto: protoUDP, local: port}, nil)
+}
+
+func (p *Peer) newUDP(key flowKey, raddr *net.UDPAddr) *UDPConn {
+	c := &UDPConn{
+		peer:   p,
+		key:    key,
+		laddr:  &net.UDPAddr{IP: p.ip, Port: int(key.local)},
+		raddr:  raddr,
+		rx:     make(chan *segment, 256),
+		closed: make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.udpConns[key] = c
+	p.mu.Unlock()
+	return c
+}
+
+func (c *UDPConn) input(s *segment) {
+	select {
+	case c.rx <- s:
+	default:
+	}
+}
+
+func (c *UDPConn) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// Write sends b to the connected address.
+func (c *UDPConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.raddr)
+}
+
+func (c *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	raddr, ok := addr.(*net.UDPAddr)
+	if !ok || raddr == nil {
+		return 0, errUnsupportedAddr
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	pkt := buildUDP(&segment{
+		src:     c.laddr.IP,
+		dst:     raddr.IP,
+		srcPort: uint16(c.laddr.Port),
+		dstPort: uint16(raddr.Port),
+		payload: b,
+	})
+	if err := c.peer.send(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read reads a datagram from the connected address.
+func (c *UDPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case s := <-c.rx:
+		return copy(b, s.payload), &net.UDPAddr{IP: s.src, Port: int(s.srcPort)}, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *UDPConn) Close() error {
+	c.close()
+	c.peer.removeUDP(c)
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr { return c.laddr }
+
+// RemoteAddr returns the connected address, nil for unconnected sockets.
+func (c *UDPConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}